@@ -2,22 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/gob"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
+	"sync"
 	"time"
 	
 	"github.com/boltdb/bolt"
 )
 
 const (
-	dbFile              = "blockchain.db"
-	blocksBucket        = "blocks"
-	genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
+	blocksBucket = "blocks"
+	// how long to wait for the lock a running node holds on the chain
+	dbOpenTimeout = time.Second
 )
 
 type Block struct {
@@ -27,6 +30,13 @@ type Block struct {
 	Hash          []byte
 	Nonce         int
 	Height        int
+	Bits          int
+	// set by proof-of-authority blocks
+	Signer    []byte
+	Signature []byte
+	
+	// merkle root of a block rebuilt from its header, which has no transactions
+	merkleRoot []byte
 }
 
 func (b *Block) Serialize() []byte {
@@ -41,47 +51,103 @@ func (b *Block) Serialize() []byte {
 	return result.Bytes()
 }
 
-func NewBlock(trasnactions []*Transaction, prevBlockHash []byte, height int) *Block {
+func NewBlock(engine ConsensusEngine, trasnactions []*Transaction, prev *Block) *Block {
+	block, err := NewBlockContext(context.Background(), engine, trasnactions, prev)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	return block
+}
+
+// NewBlockContext builds the block following prev (nil for the genesis block)
+// and seals it with engine, giving up when ctx is cancelled
+func NewBlockContext(ctx context.Context, engine ConsensusEngine, trasnactions []*Transaction, prev *Block) (*Block, error) {
 	block := &Block{
-		time.Now().Unix(),
-		trasnactions,
-		prevBlockHash,
-		[]byte{},
-		0,
-		height,
+		Timestamp:     time.Now().Unix(),
+		Transactions:  trasnactions,
+		PrevBlockHash: []byte{},
+		Hash:          []byte{},
+		Bits:          engine.Difficulty(prev),
+	}
+	if prev != nil {
+		block.PrevBlockHash = prev.Hash
+		block.Height = prev.Height + 1
+	} else if activeNet.GenesisTimestamp != 0 {
+		block.Timestamp = activeNet.GenesisTimestamp
 	}
 	
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+	err := engine.Seal(ctx, block)
+	if err != nil {
+		return nil, err
+	}
 	
-	block.Hash = hash
-	block.Nonce = nonce
-	return block
+	return block, nil
 }
 
+var errStaleTip = errors.New("chain tip changed while mining")
+
+var errOrphanBlock = errors.New("the parent of the block is unknown")
+
 type BlockChain struct {
-	tip []byte
-	db  *bolt.DB
+	tip    []byte
+	db     *timedDB
+	engine ConsensusEngine
+	// the miner and the connection handlers move tip while the RPC, REST and
+	// metrics handlers read it
+	tipLock sync.RWMutex
+	// held from the validation of a block until it is stored with its UTXO
+	// changes, so it is checked against the UTXO set it is applied to
+	chainLock sync.Mutex
+}
+
+// Tip is the hash of the best block
+func (bc *BlockChain) Tip() []byte {
+	bc.tipLock.RLock()
+	defer bc.tipLock.RUnlock()
+	
+	return bc.tip
+}
+
+func (bc *BlockChain) setTip(hash []byte) {
+	bc.tipLock.Lock()
+	defer bc.tipLock.Unlock()
+	
+	bc.tip = hash
 }
 
 func (bc *BlockChain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
+	newBlock, err := bc.MineBlockContext(context.Background(), transactions)
+	if err != nil {
+		log.Panic(err)
+	}
 	
+	return newBlock
+}
+
+// MineBlockContext mines transactions on top of the current tip and takes the
+// block into the UTXO set. It fails when ctx is cancelled or when another block
+// became the tip in the meantime.
+func (bc *BlockChain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	var lastBlock *Block
+	
+	blockTXs := make(map[string]Transaction)
 	for _, tx := range transactions {
-		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR: invalid transaction")
+		blockTXs[hex.EncodeToString(tx.ID)] = *tx
+	}
+	
+	for _, tx := range transactions {
+		if bc.VerifyTransactionWith(tx, blockTXs) != true {
+			return nil, errors.New("ERROR: invalid transaction")
 		}
 	}
 	
 	viewf := func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+		lastHash := b.Get([]byte("l"))
 		
 		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
-		
-		lastHeight = block.Height
+		lastBlock = DeserializeBlock(blockData)
 		
 		return nil
 	}
@@ -91,45 +157,52 @@ func (bc *BlockChain) MineBlock(transactions []*Transaction) *Block {
 		log.Panic(err)
 	}
 	
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
-	
-	updatef := func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		
-		err := b.Put(newBlock.Hash, newBlock.SerializeBlock())
-		if err != nil {
-			log.Panic(err)
-		}
-		
-		err = b.Put([]byte("l"), newBlock.Hash)
+	// mined blocks are held to the locks ValidateBlock checks in blocks from others
+	mtp := bc.MedianTimePast(lastBlock.Hash)
+	for _, tx := range transactions {
+		err = bc.CheckLocks(tx, lastBlock.Height+1, mtp)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
-		
-		bc.tip = newBlock.Hash
-		
-		return nil
 	}
 	
-	err = bc.db.Update(updatef)
+	newBlock, err := NewBlockContext(ctx, bc.engine, transactions, lastBlock)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	return newBlock
+	
+	bc.chainLock.Lock()
+	defer bc.chainLock.Unlock()
+	
+	if bytes.Compare(bc.Tip(), lastBlock.Hash) != 0 {
+		return nil, errStaleTip
+	}
+	// the transactions were picked before the tip was read, the block is
+	// checked against the UTXO set it goes into like any other
+	err = bc.connectTip(newBlock)
+	if err != nil {
+		return nil, err
+	}
+	
+	return newBlock, nil
 }
 
-func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+func NewGenesisBlock(engine ConsensusEngine, coinbase *Transaction) *Block {
+	return NewBlock(engine, []*Transaction{coinbase}, nil)
 }
 
 func NewBlockchain(nodeID string) *BlockChain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
-	if dbExists() == false {
+	dbFile := fmt.Sprintf(activeNet.DBFile, nodeID)
+	if dbExists(dbFile) == false {
 		fmt.Println("No existing blockchain found. Create one first.")
 		os.Exit(1)
 	}
 	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: dbOpenTimeout})
+	if err == bolt.ErrTimeout {
+		fmt.Println("The blockchain is in use by a running node. Start it with -rpcport to run this command through it.")
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Panic(err)
 	}
@@ -138,37 +211,43 @@ func NewBlockchain(nodeID string) *BlockChain {
 		b := tx.Bucket([]byte(blocksBucket))
 		tip = b.Get([]byte("l"))
 		
-		return nil
+		return checkNetwork(tx)
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 	
+	engine, err := loadEngine(db, nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	
 	bc := BlockChain{
-		tip,
-		db,
+		tip:    tip,
+		db:     &timedDB{db},
+		engine: engine,
 	}
 	return &bc
 }
 
-func dbExists() bool {
+func dbExists(dbFile string) bool {
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
-func CreateBlockchain(address string, nodeid string) *BlockChain {
-	dbFile := fmt.Sprintf(dbFile, nodeid)
-	if dbExists() {
+func CreateBlockchain(address string, nodeid string, engine ConsensusEngine) *BlockChain {
+	dbFile := fmt.Sprintf(activeNet.DBFile, nodeid)
+	if dbExists(dbFile) {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
 	}
 	
 	var tip []byte
 	
-	cbtx := NewCoinbaseTx(address, genesisCoinbaseData)
-	genesis := NewGenesisBlock(cbtx)
+	cbtx := NewCoinbaseTx(address, activeNet.GenesisCoinbaseData)
+	genesis := NewGenesisBlock(engine, cbtx)
 	
 	db, err := bolt.Open(dbFile, 0600, nil)
 	if err != nil {
@@ -192,13 +271,15 @@ func CreateBlockchain(address string, nodeid string) *BlockChain {
 		}
 		tip = genesis.Hash
 		
-		return nil
+		return saveEngine(tx, engine)
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 	
-	bc := BlockChain{tip, db}
+	bc := BlockChain{tip: tip, db: &timedDB{db}, engine: engine}
+	events.Publish(BlockConnected{&bc, genesis})
+	events.Publish(TipChanged{&bc, genesis})
 	
 	return &bc
 }
@@ -214,15 +295,77 @@ func (b *Block) SerializeBlock() []byte {
 }
 
 func (b *Block) HashTransaction() []byte {
+	if b.merkleRoot != nil {
+		return b.merkleRoot
+	}
+	root, _ := b.computeMerkleRoot()
+	
+	return root
+}
+
+// computeMerkleRoot also tells whether the transactions repeat in a way that
+// leaves the root unchanged
+func (b *Block) computeMerkleRoot() ([]byte, bool) {
+	builder := NewMerkleBuilder()
+	for _, tx := range b.Transactions {
+		builder.Add(tx.Serialize())
+	}
+	
+	return builder.Root(), builder.Mutated()
+}
+
+// MerkleTree is the tree over the serialized transactions of b
+func (b *Block) MerkleTree() *MerkleTree {
 	var transactions [][]byte
 	
 	for _, tx := range b.Transactions {
 		transactions = append(transactions, tx.Serialize())
 	}
 	
-	tree := NewMerkleTree(transactions)
-	
-	return tree.RootNode.Data
+	return NewMerkleTree(transactions)
+}
+
+// BlockHeader is a block without its transactions, which the merkle root
+// stands in for
+type BlockHeader struct {
+	Timestamp     int64
+	MerkleRoot    []byte
+	PrevBlockHash []byte
+	Hash          []byte
+	Nonce         int
+	Height        int
+	Bits          int
+	Signer        []byte
+	Signature     []byte
+}
+
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{
+		b.Timestamp,
+		b.HashTransaction(),
+		b.PrevBlockHash,
+		b.Hash,
+		b.Nonce,
+		b.Height,
+		b.Bits,
+		b.Signer,
+		b.Signature,
+	}
+}
+
+// Block turns the header back into a block for the consensus engine to verify
+func (h *BlockHeader) Block() *Block {
+	return &Block{
+		Timestamp:     h.Timestamp,
+		PrevBlockHash: h.PrevBlockHash,
+		Hash:          h.Hash,
+		Nonce:         h.Nonce,
+		Height:        h.Height,
+		Bits:          h.Bits,
+		Signer:        h.Signer,
+		Signature:     h.Signature,
+		merkleRoot:    h.MerkleRoot,
+	}
 }
 
 func DeserializeBlock(data []byte) *Block {
@@ -237,12 +380,12 @@ func DeserializeBlock(data []byte) *Block {
 
 type BlockchainIterator struct {
 	currentHash []byte
-	db          *bolt.DB
+	db          *timedDB
 }
 
 func (bc *BlockChain) Iterator() *BlockchainIterator {
 	bci := &BlockchainIterator{
-		bc.tip,
+		bc.Tip(),
 		bc.db,
 	}
 	
@@ -274,12 +417,18 @@ func (bc *BlockChain) FindUTXO() map[string]TxOutputs {
 	
 	for {
 		block := bci.Next()
+		mtp := int64(-1)
 		
-		for _, tx := range block.Transactions {
+		// later transactions of a block may spend earlier ones
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			txID := hex.EncodeToString(tx.ID)
 		
 		Outputs:
 			for outIdx, out := range tx.Vout {
+				if out.IsUnspendable() {
+					continue
+				}
 				if spentTXOs[txID] != nil {
 					for _, spentTXOs := range spentTXOs[txID] {
 						if spentTXOs == outIdx {
@@ -287,8 +436,13 @@ func (bc *BlockChain) FindUTXO() map[string]TxOutputs {
 						}
 					}
 				}
+				if mtp < 0 {
+					mtp = bc.MedianTimePast(block.PrevBlockHash)
+				}
 				outs := UTXO[txID]
+				outs.Height, outs.Time = block.Height, mtp
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
 				UTXO[txID] = outs
 			}
 			if tx.IsCoinbase() == false {
@@ -325,23 +479,79 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New("Transaction is not found")
 }
 
-func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+// FindTransactionBlock returns the block holding the transaction ID and its index there
+func (bc *BlockChain) FindTransactionBlock(ID []byte) (*Block, int, error) {
+	bci := bc.Iterator()
+	
+	for {
+		block := bci.Next()
+		
+		for i, tx := range block.Transactions {
+			if bytes.Compare(tx.ID, ID) == 0 {
+				return block, i, nil
+			}
+		}
+		
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	
+	return nil, 0, errors.New("Transaction is not found")
+}
+
+// prevTransactions collects the transactions referenced by the inputs of tx,
+// looking in pool first and then in the chain
+func (bc *BlockChain) prevTransactions(tx *Transaction, pool map[string]Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
+	if tx.IsCoinbase() {
+		return prevTXs, nil
+	}
 	
 	for _, vin := range tx.Vin {
-		prevTX, _ := bc.FindTransaction(vin.Txid)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		txID := hex.EncodeToString(vin.Txid)
+		prevTX, ok := pool[txID]
+		if !ok {
+			var err error
+			prevTX, err = bc.FindTransaction(vin.Txid)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return nil, fmt.Errorf("output %s:%d does not exist", txID, vin.Vout)
+		}
+		prevTXs[txID] = prevTX
+	}
+	
+	return prevTXs, nil
+}
+
+func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+	bc.SignTransactionWith(tx, privKey, nil)
+}
+
+// SignTransactionWith signs tx whose inputs may also spend the unconfirmed
+// transactions in pool
+func (bc *BlockChain) SignTransactionWith(tx *Transaction, privKey ecdsa.PrivateKey, pool map[string]Transaction) {
+	prevTXs, err := bc.prevTransactions(tx, pool)
+	if err != nil {
+		log.Panic(err)
 	}
 	
 	tx.Sign(privKey, prevTXs)
 }
 
 func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
-	prevTXs := make(map[string]Transaction)
-	
-	for _, vin := range tx.Vin {
-		prevTX, _ := bc.FindTransaction(vin.Txid)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	return bc.VerifyTransactionWith(tx, nil)
+}
+
+// VerifyTransactionWith verifies tx whose inputs may also spend the unconfirmed
+// transactions in pool
+func (bc *BlockChain) VerifyTransactionWith(tx *Transaction, pool map[string]Transaction) bool {
+	prevTXs, err := bc.prevTransactions(tx, pool)
+	if err != nil {
+		return false
 	}
 	
 	return tx.Verify(prevTXs)
@@ -388,6 +598,23 @@ func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
+// GetBlockByHeight walks back from the tip to the block at height
+func (bc *BlockChain) GetBlockByHeight(height int) (*Block, error) {
+	bci := bc.Iterator()
+	
+	for {
+		block := bci.Next()
+		
+		if block.Height == height {
+			return block, nil
+		}
+		
+		if block.Height < height || len(block.PrevBlockHash) == 0 {
+			return nil, fmt.Errorf("no block at height %d", height)
+		}
+	}
+}
+
 func (bc *BlockChain) GetBlockHashes() [][]byte {
 	var blocks [][]byte
 	bci := bc.Iterator()
@@ -405,31 +632,412 @@ func (bc *BlockChain) GetBlockHashes() [][]byte {
 	return blocks
 }
 
-func (bc *BlockChain) AddBlock(block *Block) {
+// GetHeaders returns up to max headers of the blocks after the latest block
+// of locator, starting from the genesis block when none of them is known
+func (bc *BlockChain) GetHeaders(locator [][]byte, max int) []BlockHeader {
+	known := make(map[string]bool)
+	for _, hash := range locator {
+		known[hex.EncodeToString(hash)] = true
+	}
+	
+	var list []BlockHeader
+	bci := bc.Iterator()
+	
+	for {
+		block := bci.Next()
+		if known[hex.EncodeToString(block.Hash)] {
+			break
+		}
+		
+		list = append(list, block.Header())
+		
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	if len(list) > max {
+		list = list[:max]
+	}
+	
+	return list
+}
+
+// applyBlock stores block as the new tip together with its UTXO changes and
+// the outputs it spent, all in one update. The caller holds chainLock and
+// validated block.
+func (bc *BlockChain) applyBlock(block *Block) error {
+	mtp := bc.MedianTimePast(block.PrevBlockHash)
+	
 	err := bc.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		blockInDb := b.Get(block.Hash)
+		if bytes.Compare(b.Get([]byte("l")), block.PrevBlockHash) != 0 {
+			return errStaleTip
+		}
+		
+		err := b.Put(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+		spent, err := updateUTXO(tx.Bucket([]byte(utxoBucket)), block, mtp)
+		if err != nil {
+			return err
+		}
+		undo, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+		if err != nil {
+			return err
+		}
+		err = undo.Put(block.Hash, gobEncode(spent))
+		if err != nil {
+			return err
+		}
+		
+		return b.Put([]byte("l"), block.Hash)
+	})
+	if err != nil {
+		return err
+	}
+	
+	bc.setTip(block.Hash)
+	return nil
+}
+
+// revertTip takes the tip out of the best chain and puts the outputs it spent
+// back into the UTXO set, all in one update. The block itself stays stored.
+// The caller holds chainLock.
+func (bc *BlockChain) revertTip() (*Block, error) {
+	block, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		return nil, err
+	}
+	if len(block.PrevBlockHash) == 0 {
+		return nil, errors.New("the genesis block can't be disconnected")
+	}
+	spent, err := bc.spentOutputs(&block)
+	if err != nil {
+		return nil, err
+	}
+	
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		if bytes.Compare(b.Get([]byte("l")), block.Hash) != 0 {
+			return errStaleTip
+		}
+		
+		err := revertUTXO(tx.Bucket([]byte(utxoBucket)), &block, spent)
+		if err != nil {
+			return err
+		}
+		if undo := tx.Bucket([]byte(undoBucket)); undo != nil {
+			err = undo.Delete(block.Hash)
+			if err != nil {
+				return err
+			}
+		}
 		
-		if blockInDb != nil {
-			return nil
+		return b.Put([]byte("l"), block.PrevBlockHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	
+	bc.setTip(block.PrevBlockHash)
+	return &block, nil
+}
+
+// spentOutputs returns the outputs block spent from its undo data. Blocks
+// connected before undo data was kept get theirs from the chain.
+func (bc *BlockChain) spentOutputs(block *Block) ([]spentOutput, error) {
+	var spent []spentOutput
+	var data []byte
+	
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(undoBucket)); b != nil {
+			data = b.Get(block.Hash)
 		}
 		
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&spent)
+		return spent, err
+	}
+	
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		
+		for _, vin := range tx.Vin {
+			prevBlock, index, err := bc.FindTransactionBlock(vin.Txid)
+			if err != nil {
+				return nil, err
+			}
+			prevTx := prevBlock.Transactions[index]
+			if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+				return nil, fmt.Errorf("output %s does not exist", outpointKey(vin.Txid, vin.Vout))
+			}
+			
+			mtp := bc.MedianTimePast(prevBlock.PrevBlockHash)
+			spent = append(spent, spentOutput{vin.Txid, vin.Vout, prevTx.Vout[vin.Vout], prevBlock.Height, mtp})
+		}
+	}
+	
+	return spent, nil
+}
+
+// ValidateBlock fully checks a block that extends the current tip: header seal,
+// linkage, coinbase value, size and every transaction against the UTXO set
+func (bc *BlockChain) ValidateBlock(block *Block) error {
+	start := time.Now()
+	defer func() { metrics.BlockValidated(time.Since(start)) }()
+	
+	if bytes.Compare(block.PrevBlockHash, bc.Tip()) != 0 {
+		return errors.New("block does not extend the current tip")
+	}
+	
+	prev, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	err = bc.checkBlock(block, &prev)
+	if err != nil {
+		return err
+	}
+	
+	UTXOSet := UTXOSet{bc}
+	mtp := bc.MedianTimePast(block.PrevBlockHash)
+	blockTXs := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	size, fees := 0, 0
+	
+	for i, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+		size += len(tx.Serialize())
+		
+		if _, ok := blockTXs[txID]; ok {
+			return fmt.Errorf("duplicate transaction %s", txID)
+		}
+		
+		err = tx.CheckDataOutputs()
+		if err != nil {
+			return err
+		}
+		
+		err = tx.CheckOutputLocks()
+		if err != nil {
+			return err
+		}
+		
+		if i > 0 {
+			if tx.IsCoinbase() {
+				return errors.New("more than one coinbase")
+			}
+			
+			// inputs may only spend confirmed outputs or earlier transactions of this block
+			for _, vin := range tx.Vin {
+				key := outpointKey(vin.Txid, vin.Vout)
+				if spent[key] {
+					return fmt.Errorf("transaction %s double spends %s", txID, key)
+				}
+				spent[key] = true
+				
+				if _, ok := blockTXs[hex.EncodeToString(vin.Txid)]; ok {
+					continue
+				}
+				if _, ok := UTXOSet.FindOutput(vin.Txid, vin.Vout); !ok {
+					return fmt.Errorf("transaction %s spends missing output %s", txID, key)
+				}
+			}
+			
+			prevTXs, err := bc.prevTransactions(tx, blockTXs)
+			if err != nil {
+				return err
+			}
+			if !tx.Verify(prevTXs) {
+				return fmt.Errorf("transaction %s has an invalid signature", txID)
+			}
+			err = bc.CheckLocks(tx, block.Height, mtp)
+			if err != nil {
+				return err
+			}
+			
+			fee := tx.Fee(prevTXs)
+			if fee < 0 {
+				return fmt.Errorf("transaction %s spends more than its inputs", txID)
+			}
+			fees += fee
+		}
+		
+		blockTXs[txID] = *tx
+	}
+	
+	if size > maxBlockSize {
+		return fmt.Errorf("block size %d exceeds %d", size, maxBlockSize)
+	}
+	
+	reward := 0
+	for _, out := range block.Transactions[0].Vout {
+		reward += out.Value
+	}
+	if reward > activeNet.Subsidy+fees {
+		return fmt.Errorf("coinbase pays %d, more than %d", reward, activeNet.Subsidy+fees)
+	}
+	
+	return nil
+}
+
+// checkBlock is the part of ValidateBlock that doesn't need the UTXO set:
+// the place of block after prev, its seal and the shape of its transactions
+func (bc *BlockChain) checkBlock(block *Block, prev *Block) error {
+	if block.Height != prev.Height+1 {
+		return fmt.Errorf("bad height %d, expected %d", block.Height, prev.Height+1)
+	}
+	if block.Timestamp > time.Now().Add(2*time.Hour).Unix() {
+		return errors.New("block timestamp is too far in the future")
+	}
+	
+	err := bc.engine.VerifyHeader(block, prev)
+	if err != nil {
+		return err
+	}
+	
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return errors.New("first transaction is not a coinbase")
+	}
+	if _, mutated := block.computeMerkleRoot(); mutated {
+		return errors.New("block repeats transactions behind its merkle root")
+	}
+	
+	return nil
+}
+
+// ConnectBlock validates block, stores it as the new tip and updates the UTXO
+// set. A block on another branch is stored once checkBlock passes, and when
+// its branch has more work than the best chain the chain reorganizes onto it.
+// The block events follow, once the UTXO set has the blocks.
+func (bc *BlockChain) ConnectBlock(block *Block) error {
+	bc.chainLock.Lock()
+	defer bc.chainLock.Unlock()
+	
+	if bytes.Compare(block.PrevBlockHash, bc.Tip()) == 0 {
+		return bc.connectTip(block)
+	}
+	if _, err := bc.GetBlock(block.Hash); err == nil {
+		return nil
+	}
+	
+	prev, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		return errOrphanBlock
+	}
+	err = bc.checkBlock(block, &prev)
+	if err != nil {
+		return err
+	}
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize())
+	})
+	if err != nil {
+		return err
+	}
+	
+	tip, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		return err
+	}
+	detach, attach, err := bc.branches(&tip, block)
+	if err != nil {
+		return err
+	}
+	if branchWork(attach).Cmp(branchWork(detach)) <= 0 {
+		fmt.Printf("Stored block %x on a side branch\n", block.Hash)
+		return nil
+	}
+	
+	return bc.reorganize(detach, attach)
+}
+
+// connectTip is ConnectBlock for a caller holding chainLock
+func (bc *BlockChain) connectTip(block *Block) error {
+	err := bc.ValidateBlock(block)
+	if err != nil {
+		return err
+	}
+	
+	err = bc.applyBlock(block)
+	if err != nil {
+		return err
+	}
+	
+	events.Publish(UTXOSetChanged{bc, block})
+	bc.publishTipChange(block.PrevBlockHash, block)
+	
+	return nil
+}
+
+// reorganize moves the best chain from the blocks of detach onto the ones of
+// attach, both listed from their highest block down to the fork point. The
+// blocks of attach are validated as they are connected, if one fails it is
+// dropped with the blocks above it and the old chain comes back.
+func (bc *BlockChain) reorganize(detach, attach []*Block) error {
+	oldTip := bc.Tip()
+	fmt.Printf("Reorganizing: %d blocks out, %d blocks in\n", len(detach), len(attach))
+	
+	for range detach {
+		_, err := bc.revertTip()
 		if err != nil {
 			log.Panic(err)
 		}
+	}
+	
+	for i := len(attach) - 1; i >= 0; i-- {
+		err := bc.ValidateBlock(attach[i])
+		if err == nil {
+			err = bc.applyBlock(attach[i])
+		}
+		if err == nil {
+			continue
+		}
 		
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
+		for j := i + 1; j < len(attach); j++ {
+			_, rerr := bc.revertTip()
+			if rerr != nil {
+				log.Panic(rerr)
+			}
+		}
+		for j := len(detach) - 1; j >= 0; j-- {
+			rerr := bc.applyBlock(detach[j])
+			if rerr != nil {
+				log.Panic(rerr)
+			}
+		}
+		bc.dropBlocks(attach[:i+1])
+		
+		return fmt.Errorf("block %x of the new branch is invalid: %s", attach[i].Hash, err)
+	}
+	
+	events.Publish(UTXOSetChanged{bc, nil})
+	bc.publishTipChange(oldTip, attach[0])
+	
+	return nil
+}
+
+// dropBlocks deletes blocks of a side branch that turned out invalid
+func (bc *BlockChain) dropBlocks(blocks []*Block) {
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
 		
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
+		for _, block := range blocks {
+			err := b.Delete(block.Hash)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
-			bc.tip = block.Hash
 		}
 		
 		return nil
@@ -438,3 +1046,53 @@ func (bc *BlockChain) AddBlock(block *Block) {
 		log.Panic(err)
 	}
 }
+
+// branches walks back from a and b to the block they have in common and
+// returns the blocks above it on either side, the highest first
+func (bc *BlockChain) branches(a, b *Block) ([]*Block, []*Block, error) {
+	var aBranch, bBranch []*Block
+	
+	for bytes.Compare(a.Hash, b.Hash) != 0 {
+		if a.Height > b.Height {
+			aBranch = append(aBranch, a)
+			prev, err := bc.GetBlock(a.PrevBlockHash)
+			if err != nil {
+				return nil, nil, err
+			}
+			a = &prev
+		} else {
+			bBranch = append(bBranch, b)
+			prev, err := bc.GetBlock(b.PrevBlockHash)
+			if err != nil {
+				return nil, nil, err
+			}
+			b = &prev
+		}
+	}
+	
+	return aBranch, bBranch, nil
+}
+
+// branchWork adds up the work behind blocks, a block with Bits takes 2^Bits
+// hashes on average
+func branchWork(blocks []*Block) *big.Int {
+	work := new(big.Int)
+	for _, block := range blocks {
+		work.Add(work, new(big.Int).Lsh(big.NewInt(1), uint(block.Bits)))
+	}
+	
+	return work
+}
+
+// Generate mines n blocks that only hold a coinbase paying address
+func (bc *BlockChain) Generate(n int, address string) []*Block {
+	var blocks []*Block
+	
+	for i := 0; i < n; i++ {
+		cbTx := NewCoinbaseTx(address, "")
+		newBlock := bc.MineBlock([]*Transaction{cbTx})
+		blocks = append(blocks, newBlock)
+	}
+	
+	return blocks
+}
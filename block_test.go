@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	
+	"github.com/boltdb/bolt"
+)
+
+// nextTestBlock is an unmined block paying a coinbase on top of bc
+func nextTestBlock(bc *BlockChain, wallet *Wallet) *Block {
+	return &Block{
+		Timestamp:     time.Now().Unix(),
+		Transactions:  []*Transaction{NewCoinbaseTx(address(wallet), "")},
+		PrevBlockHash: bc.Tip(),
+		Height:        bc.GetBestHeight() + 1,
+		Bits:          bc.engine.Difficulty(nil),
+	}
+}
+
+// mineOn seals a block holding a coinbase paying to and txs on top of prev,
+// without connecting it
+func mineOn(bc *BlockChain, prev *Block, to string, txs ...*Transaction) *Block {
+	txs = append([]*Transaction{NewCoinbaseTx(to, "")}, txs...)
+	
+	return NewBlock(bc.engine, txs, prev)
+}
+
+// checkUTXOSet compares the UTXO set with the one rebuilt from the best chain
+func checkUTXOSet(t *testing.T, bc *BlockChain) {
+	t.Helper()
+	
+	stored := make(map[string]TxOutputs)
+	UTXOSet := UTXOSet{bc}
+	for txID := range bc.FindUTXO() {
+		id, _ := hex.DecodeString(txID)
+		if outs, ok := UTXOSet.FindOutputs(id); ok {
+			stored[txID] = outs
+		}
+	}
+	if !reflect.DeepEqual(stored, bc.FindUTXO()) || UTXOSet.CountTransactions() != len(stored) {
+		t.Errorf("the UTXO set doesn't match the best chain")
+	}
+}
+
+func TestValidateBlockRejectsBadHeaders(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	
+	tests := []struct {
+		name   string
+		change func(b *Block)
+		want   string
+	}{
+		{"stale parent", func(b *Block) { b.PrevBlockHash = make([]byte, 32) }, "does not extend"},
+		{"height", func(b *Block) { b.Height++ }, "bad height"},
+		{"future", func(b *Block) { b.Timestamp = time.Now().Add(3 * time.Hour).Unix() }, "future"},
+		{"bits", func(b *Block) { b.Bits-- }, "difficulty"},
+		{"hash", func(b *Block) { b.Hash = make([]byte, 32) }, "does not match"},
+		{"target", func(b *Block) {
+			pow := NewProofOfWork(b)
+			for ; ; b.Nonce++ {
+				hash := sha256.Sum256(pow.prepareData(b.Timestamp, b.Nonce))
+				b.Hash = hash[:]
+				if !pow.Validate() {
+					return
+				}
+			}
+		}, "target"},
+	}
+	
+	for _, test := range tests {
+		block := nextTestBlock(bc, wallet)
+		block.Hash = make([]byte, 32)
+		test.change(block)
+		
+		err := bc.ValidateBlock(block)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error about %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestConnectBlockExtendsTip(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	
+	block := nextTestBlock(bc, wallet)
+	err := bc.engine.Seal(context.Background(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bc.ConnectBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.Tip(), block.Hash) {
+		t.Fatal("connected block is not the tip")
+	}
+	
+	// a stored block is skipped
+	if err := bc.ConnectBlock(block); err != nil || !bytes.Equal(bc.Tip(), block.Hash) {
+		t.Errorf("connecting the block again moved the tip: %v", err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	
+	blocks := bc.Generate(3, address(wallet))
+	if len(blocks) != 3 || bc.GetBestHeight() != 3 || !bytes.Equal(bc.Tip(), blocks[2].Hash) {
+		t.Fatalf("generated %d blocks up to height %d, want 3", len(blocks), bc.GetBestHeight())
+	}
+	
+	balance := 0
+	for _, out := range (UTXOSet{bc}).FindUTXO(HashPubKey(wallet.PublicKey)) {
+		balance += out.Value
+	}
+	if balance != 4*activeNet.Subsidy {
+		t.Errorf("balance %d, want the genesis and 3 generated rewards", balance)
+	}
+}
+
+func TestRegtestGenesisIsFixed(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	again := NewGenesisBlock(bc.engine, NewCoinbaseTx(address(wallet), activeNet.GenesisCoinbaseData))
+	if genesis.Timestamp != activeNet.GenesisTimestamp || !bytes.Equal(again.Hash, genesis.Hash) {
+		t.Error("regtest genesis blocks paying the same address differ")
+	}
+}
+
+func TestValidateBlockRejectsMutatedMerkleRoot(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := newTestTx(wallet, genesis.Transactions[0], []int{0}, activeNet.Subsidy)
+	
+	// [coinbase tx tx tx] has the merkle root of [coinbase tx tx]
+	block := nextTestBlock(bc, wallet)
+	block.Transactions = append(block.Transactions, tx, tx, tx)
+	err = bc.engine.Seal(context.Background(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	err = bc.ValidateBlock(block)
+	if err == nil || !strings.Contains(err.Error(), "merkle root") {
+		t.Errorf("got %v, want the repeated transactions rejected", err)
+	}
+}
+
+func TestReorganizeToMoreWork(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	other := address(NewWallet())
+	genesis, _ := bc.GetBlock(bc.Tip())
+	
+	tx := NewUTXOTransaction(wallet, other, 3, &UTXOSet{bc}, nil)
+	a1 := bc.MineBlock([]*Transaction{NewCoinbaseTx(address(wallet), ""), tx})
+	a2 := bc.Generate(1, address(wallet))[0]
+	checkUTXOSet(t, bc)
+	
+	stream, stop := events.Stream(100)
+	defer stop()
+	
+	// an equal branch doesn't take over
+	b1 := mineOn(bc, &genesis, other)
+	b2 := mineOn(bc, b1, other)
+	for _, block := range []*Block{b1, b2} {
+		if err := bc.ConnectBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Compare(bc.Tip(), a2.Hash) != 0 {
+		t.Fatal("an equal side branch became the best chain")
+	}
+	
+	b3 := mineOn(bc, b2, other)
+	if err := bc.ConnectBlock(b3); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(bc.Tip(), b3.Hash) != 0 {
+		t.Fatal("the branch with more work didn't become the best chain")
+	}
+	checkUTXOSet(t, bc)
+	if balance := len(UTXOSet{bc}.FindUTXO(HashPubKey(wallet.PublicKey))); balance != 1 {
+		t.Errorf("wallet has %d outputs after the reorganization, want the genesis coinbase", balance)
+	}
+	if !mempool.Has(hex.EncodeToString(tx.ID)) {
+		t.Error("the transaction of the old branch didn't return to the mempool")
+	}
+	
+	var disconnected, connected [][]byte
+	for len(stream) > 0 {
+		switch e := (<-stream).(type) {
+		case BlockDisconnected:
+			disconnected = append(disconnected, e.Block.Hash)
+		case BlockConnected:
+			connected = append(connected, e.Block.Hash)
+		}
+	}
+	if !reflect.DeepEqual(disconnected, [][]byte{a2.Hash, a1.Hash}) {
+		t.Errorf("disconnected %x, want the old branch tip first", disconnected)
+	}
+	if !reflect.DeepEqual(connected, [][]byte{b1.Hash, b2.Hash, b3.Hash}) {
+		t.Errorf("connected %x, want the new branch in chain order", connected)
+	}
+}
+
+func TestReorganizeRollsBackInvalidBranch(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, _ := bc.GetBlock(bc.Tip())
+	tip := bc.Generate(2, address(wallet))[1]
+	
+	// the second block spends an output that doesn't exist
+	bad := &Transaction{nil, []TxInput{{make([]byte, 32), 0, nil, nil, nil, 0}}, []TxOutput{*NewTxOutput(1, address(wallet))}, 0}
+	bad.ID = bad.Hash()
+	c1 := mineOn(bc, &genesis, address(wallet))
+	c2 := mineOn(bc, c1, address(wallet), bad)
+	c3 := mineOn(bc, c2, address(wallet))
+	for _, block := range []*Block{c1, c2} {
+		if err := bc.ConnectBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bc.ConnectBlock(c3); err == nil {
+		t.Fatal("reorganized onto a branch with an invalid block")
+	}
+	
+	if bytes.Compare(bc.Tip(), tip.Hash) != 0 {
+		t.Fatal("the old chain didn't come back")
+	}
+	checkUTXOSet(t, bc)
+	if _, err := bc.GetBlock(c1.Hash); err != nil {
+		t.Error("the valid block below the invalid one was dropped")
+	}
+	for _, block := range []*Block{c2, c3} {
+		if _, err := bc.GetBlock(block.Hash); err == nil {
+			t.Errorf("invalid block %x stayed stored", block.Hash)
+		}
+	}
+}
+
+func TestConnectOrphanBlock(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, _ := bc.GetBlock(bc.Tip())
+	
+	b1 := mineOn(bc, &genesis, address(wallet))
+	b2 := mineOn(bc, b1, address(wallet))
+	if err := bc.ConnectBlock(b2); err != errOrphanBlock {
+		t.Fatalf("got %v for a block without its parent", err)
+	}
+}
+
+func TestReorganizeWithoutUndoData(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	other := address(NewWallet())
+	genesis, _ := bc.GetBlock(bc.Tip())
+	
+	tx := NewUTXOTransaction(wallet, other, 3, &UTXOSet{bc}, nil)
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(address(wallet), ""), tx})
+	
+	// chains connected before undo data was kept have none
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(undoBucket))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	b1 := mineOn(bc, &genesis, other)
+	b2 := mineOn(bc, b1, other)
+	for _, block := range []*Block{b1, b2} {
+		if err := bc.ConnectBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Compare(bc.Tip(), b2.Hash) != 0 {
+		t.Fatal("the branch with more work didn't become the best chain")
+	}
+	checkUTXOSet(t, bc)
+}
+
+func TestRejectOutputNotLockedToItsHash(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	
+	// anyone could spend the output, but the wallet would count it as its own
+	coinbase := NewCoinbaseTx(address(wallet), "")
+	coinbase.Vout[0].Script = NewScriptBuilder().AddOp(OP_1).Script()
+	coinbase.ID = coinbase.Hash()
+	tip, _ := bc.GetBlock(bc.Tip())
+	if err := bc.ConnectBlock(NewBlock(bc.engine, []*Transaction{coinbase}, &tip)); err == nil {
+		t.Fatal("connected a block paying to a hash with another script")
+	}
+	
+	out := TxOutput{1, HashPubKey(wallet.PublicKey), PayToScriptHashScript(HashPubKey(wallet.PublicKey))}
+	if !out.IsLockedWithKey(HashPubKey(wallet.PublicKey)) {
+		t.Error("a script hash output isn't found by its hash")
+	}
+	out.Script = NewScriptBuilder().AddOp(OP_1).Script()
+	if out.IsLockedWithKey(HashPubKey(wallet.PublicKey)) {
+		t.Error("an output with another script is found by its hash")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// limits on the filters peers accept
+const (
+	maxBloomFilterSize = 36000
+	maxBloomHashes     = 50
+)
+
+// BloomFilter tells a peer which transactions a light client is interested
+// in. It matches some transactions the client doesn't care about as well, so
+// the peer can't tell its addresses exactly.
+type BloomFilter struct {
+	Bits   []byte
+	Hashes int
+	Tweak  uint32
+}
+
+// NewBloomFilter sizes a filter for elements items matching others with the
+// probability fpRate. Filters with the same tweak hash the same way.
+func NewBloomFilter(elements int, fpRate float64, tweak uint32) *BloomFilter {
+	if elements < 1 {
+		elements = 1
+	}
+	
+	size := int(-float64(elements) * math.Log(fpRate) / (math.Ln2 * math.Ln2) / 8)
+	if size < 1 {
+		size = 1
+	}
+	if size > maxBloomFilterSize {
+		size = maxBloomFilterSize
+	}
+	
+	hashes := int(float64(size*8) / float64(elements) * math.Ln2)
+	if hashes < 1 {
+		hashes = 1
+	}
+	if hashes > maxBloomHashes {
+		hashes = maxBloomHashes
+	}
+	
+	return &BloomFilter{make([]byte, size), hashes, tweak}
+}
+
+func (f *BloomFilter) bit(n int, data []byte) uint32 {
+	var seed [4]byte
+	binary.LittleEndian.PutUint32(seed[:], uint32(n)*0xfba4c795+f.Tweak)
+	
+	h := fnv.New32a()
+	h.Write(seed[:])
+	h.Write(data)
+	
+	return h.Sum32() % uint32(len(f.Bits)*8)
+}
+
+func (f *BloomFilter) Add(data []byte) {
+	for n := 0; n < f.Hashes; n++ {
+		bit := f.bit(n, data)
+		f.Bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (f *BloomFilter) Contains(data []byte) bool {
+	if len(f.Bits) == 0 {
+		return false
+	}
+	
+	for n := 0; n < f.Hashes; n++ {
+		bit := f.bit(n, data)
+		if f.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	
+	return true
+}
+
+// IsValid checks a filter received from a peer
+func (f *BloomFilter) IsValid() bool {
+	return len(f.Bits) > 0 && len(f.Bits) <= maxBloomFilterSize &&
+		f.Hashes > 0 && f.Hashes <= maxBloomHashes
+}
+
+// MatchesTx tells whether tx pays or spends a key or script whose hash is in
+// the filter. Outputs keep the hash, inputs push the key or the redeem script.
+func (f *BloomFilter) MatchesTx(tx *Transaction) bool {
+	for _, out := range tx.Vout {
+		if len(out.PubKeyHash) > 0 && f.Contains(out.PubKeyHash) {
+			return true
+		}
+	}
+	if tx.IsCoinbase() {
+		return false
+	}
+	
+	for _, vin := range tx.Vin {
+		ops, err := parseScript(vin.UnlockingScript())
+		if err != nil {
+			continue
+		}
+		for _, op := range ops {
+			if len(op.data) > 0 && f.Contains(HashPubKey(op.data)) {
+				return true
+			}
+		}
+	}
+	
+	return false
+}
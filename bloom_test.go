@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(100, 0.001, 7)
+	if !filter.IsValid() {
+		t.Fatalf("new filter is invalid: %d bytes, %d hashes", len(filter.Bits), filter.Hashes)
+	}
+	
+	for i := 0; i < 100; i++ {
+		filter.Add([]byte(fmt.Sprintf("in %d", i)))
+	}
+	for i := 0; i < 100; i++ {
+		if !filter.Contains([]byte(fmt.Sprintf("in %d", i))) {
+			t.Fatalf("added element %d is missing", i)
+		}
+	}
+	
+	matched := 0
+	for i := 0; i < 10000; i++ {
+		if filter.Contains([]byte(fmt.Sprintf("out %d", i))) {
+			matched++
+		}
+	}
+	if matched > 100 {
+		t.Errorf("%d of 10000 other elements matched", matched)
+	}
+	
+	a, b := NewBloomFilter(100, 0.001, 7), NewBloomFilter(100, 0.001, 8)
+	a.Add([]byte("in 0"))
+	b.Add([]byte("in 0"))
+	if bytes.Equal(a.Bits, b.Bits) {
+		t.Error("filters with another tweak hash the same way")
+	}
+}
+
+func TestBloomFilterLimits(t *testing.T) {
+	filter := NewBloomFilter(1000000, 0.000001, 0)
+	if len(filter.Bits) != maxBloomFilterSize || !filter.IsValid() {
+		t.Errorf("filter of %d bytes, want it capped at %d", len(filter.Bits), maxBloomFilterSize)
+	}
+	
+	tests := []BloomFilter{
+		{Bits: nil, Hashes: 1},
+		{Bits: make([]byte, 1), Hashes: 0},
+		{Bits: make([]byte, 1), Hashes: maxBloomHashes + 1},
+		{Bits: make([]byte, maxBloomFilterSize+1), Hashes: 1},
+	}
+	for _, test := range tests {
+		if test.IsValid() {
+			t.Errorf("filter of %d bytes and %d hashes is valid", len(test.Bits), test.Hashes)
+		}
+	}
+	if (&BloomFilter{}).Contains([]byte("anything")) {
+		t.Error("an empty filter matched")
+	}
+}
+
+func TestBloomFilterMatchesTx(t *testing.T) {
+	wallet, other := NewWallet(), NewWallet()
+	filter := NewBloomFilter(10, 0.000001, 0)
+	filter.Add(HashPubKey(wallet.PublicKey))
+	
+	funding := NewCoinbaseTx(address(wallet), "")
+	if !filter.MatchesTx(funding) {
+		t.Error("a payment to the wallet didn't match")
+	}
+	if filter.MatchesTx(NewCoinbaseTx(address(other), "")) {
+		t.Error("a payment to another wallet matched")
+	}
+	
+	spend := &Transaction{
+		Vin:  []TxInput{{Txid: funding.ID, Vout: 0, PubKey: wallet.PublicKey}},
+		Vout: []TxOutput{*NewTxOutput(1, address(other))},
+	}
+	spend.ID = spend.Hash()
+	spend.Sign(wallet.PrivateKey, map[string]Transaction{hex.EncodeToString(funding.ID): *funding})
+	if !filter.MatchesTx(spend) {
+		t.Error("a spend from the wallet didn't match")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	
+	"github.com/boltdb/bolt"
+)
+
+const (
+	cfiltersBucket  = "cfilters"
+	cfheadersBucket = "cfheaders"
+)
+
+// limits on the filters and filter headers one request may ask for
+const (
+	maxCFiltersPerRequest  = 1000
+	maxCFHeadersPerRequest = 2000
+)
+
+// NewBlockFilter builds the compact filter of b over the pubkey hashes its
+// outputs are locked with and the outpoints its inputs spend. The filter is
+// keyed with the block hash.
+func NewBlockFilter(b *Block) *GCSFilter {
+	var items [][]byte
+	
+	for _, tx := range b.Transactions {
+		for _, out := range tx.Vout {
+			if len(out.PubKeyHash) > 0 {
+				items = append(items, out.PubKeyHash)
+			}
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			items = append(items, outpointBytes(vin.Txid, vin.Vout))
+		}
+	}
+	
+	return BuildGCSFilter(blockFilterKey(b.Hash), items)
+}
+
+// blockFilterKey is the SipHash key of the filter of the block hash
+func blockFilterKey(hash []byte) [16]byte {
+	var key [16]byte
+	copy(key[:], hash)
+	
+	return key
+}
+
+// outpointBytes is how a spent output goes into block filters
+func outpointBytes(txid []byte, vout int) []byte {
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], uint32(vout))
+	
+	return append(append([]byte{}, txid...), index[:]...)
+}
+
+// filterHeader commits to filter and every filter before it, so a client can
+// check filters from one peer against the headers of another
+func filterHeader(filter []byte, prevHeader []byte) []byte {
+	filterHash := sha256.Sum256(filter)
+	header := sha256.Sum256(append(filterHash[:], prevHeader...))
+	
+	return header[:]
+}
+
+// the filter index follows the best chain
+func init() {
+	events.OnBlockConnected(func(e BlockConnected) {
+		err := e.Chain.db.Update(func(tx *bolt.Tx) error {
+			return putBlockFilter(tx, e.Block)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+	})
+}
+
+// putBlockFilter stores the filter of block and its header. Blocks before it
+// that have none, because they were stored before filters existed, get
+// theirs first. Orphans get theirs once their parents are in and a block is
+// stored on top of them.
+func putBlockFilter(tx *bolt.Tx, block *Block) error {
+	filterBucket, err := tx.CreateBucketIfNotExists([]byte(cfiltersBucket))
+	if err != nil {
+		return err
+	}
+	headerBucket, err := tx.CreateBucketIfNotExists([]byte(cfheadersBucket))
+	if err != nil {
+		return err
+	}
+	
+	missing := []*Block{block}
+	prevHeader := make([]byte, sha256.Size)
+	for hash := block.PrevBlockHash; len(hash) > 0; {
+		if header := headerBucket.Get(hash); header != nil {
+			prevHeader = append([]byte{}, header...)
+			break
+		}
+		
+		blockData := tx.Bucket([]byte(blocksBucket)).Get(hash)
+		if blockData == nil {
+			return nil
+		}
+		prev := DeserializeBlock(blockData)
+		missing = append(missing, prev)
+		hash = prev.PrevBlockHash
+	}
+	
+	for i := len(missing) - 1; i >= 0; i-- {
+		filter := NewBlockFilter(missing[i]).Bytes()
+		header := filterHeader(filter, prevHeader)
+		
+		err := filterBucket.Put(missing[i].Hash, filter)
+		if err != nil {
+			return err
+		}
+		err = headerBucket.Put(missing[i].Hash, header)
+		if err != nil {
+			return err
+		}
+		prevHeader = header
+	}
+	
+	return nil
+}
+
+// GetCFilter returns the serialized filter of the block hash
+func (bc *BlockChain) GetCFilter(hash []byte) ([]byte, error) {
+	return bc.getFilterData(cfiltersBucket, hash)
+}
+
+// GetCFHeader returns the filter header of the block hash
+func (bc *BlockChain) GetCFHeader(hash []byte) ([]byte, error) {
+	return bc.getFilterData(cfheadersBucket, hash)
+}
+
+func (bc *BlockChain) getFilterData(bucket string, hash []byte) ([]byte, error) {
+	var data []byte
+	
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b != nil {
+			data = append([]byte{}, b.Get(hash)...)
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("no filter for block %x", hash)
+		}
+		
+		return nil
+	})
+	
+	return data, err
+}
+
+// blockRange returns the hashes of the blocks from startHeight up to
+// stopHash, at most max of them
+func (bc *BlockChain) blockRange(startHeight int, stopHash []byte, max int) ([][]byte, error) {
+	stop, err := bc.GetBlock(stopHash)
+	if err != nil {
+		return nil, err
+	}
+	if startHeight < 0 || startHeight > stop.Height {
+		return nil, fmt.Errorf("bad start height %d", startHeight)
+	}
+	if stop.Height-startHeight+1 > max {
+		return nil, errors.New("too many blocks requested")
+	}
+	
+	hashes := make([][]byte, stop.Height-startHeight+1)
+	block := stop
+	for i := len(hashes) - 1; i >= 0; i-- {
+		hashes[i] = block.Hash
+		if i > 0 {
+			block, err = bc.GetBlock(block.PrevBlockHash)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	
+	return hashes, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestChain creates a regtest chain in a temporary directory with a genesis
+// block paying a new wallet. The mempool starts out empty and there are no
+// peers to announce anything to.
+func newTestChain(t *testing.T) (*BlockChain, *Wallet) {
+	t.Helper()
+	
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseChainParams(&RegtestParams)
+	knownNodes = nil
+	mempool = NewTxPool()
+	
+	wallet := NewWallet()
+	bc := CreateBlockchain(address(wallet), "test", NewPowEngine(NewMiner(1)))
+	UTXOSet{bc}.Reindex()
+	
+	t.Cleanup(func() {
+		bc.db.Close()
+		os.Chdir(wd)
+		UseChainParams(&MainNetParams)
+	})
+	
+	return bc, wallet
+}
+
+// addTestBlock puts a block holding txs on top of bc without proof of work
+func addTestBlock(bc *BlockChain, txs ...*Transaction) *Block {
+	return addTestBlockAt(bc, time.Now().Unix(), txs...)
+}
+
+func addTestBlockAt(bc *BlockChain, timestamp int64, txs ...*Transaction) *Block {
+	block := &Block{Timestamp: timestamp, Transactions: txs, PrevBlockHash: bc.Tip(), Bits: activeNet.TargetBits}
+	if bc.Tip() != nil {
+		block.Height = bc.GetBestHeight() + 1
+	}
+	hash := sha256.Sum256(append(block.PrevBlockHash, block.HashTransaction()...))
+	block.Hash = hash[:]
+	
+	err := bc.applyBlock(block)
+	if err != nil {
+		panic(err)
+	}
+	
+	return block
+}
+
+// newTestTx spends outputs vouts of prev, all locked to w, into outputs of
+// values paying w
+func newTestTx(w *Wallet, prev *Transaction, vouts []int, values ...int) *Transaction {
+	tx := &Transaction{}
+	for _, vout := range vouts {
+		tx.Vin = append(tx.Vin, TxInput{Txid: prev.ID, Vout: vout, PubKey: w.PublicKey})
+	}
+	for _, value := range values {
+		tx.Vout = append(tx.Vout, *NewTxOutput(value, address(w)))
+	}
+	tx.ID = tx.Hash()
+	tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev})
+	
+	return tx
+}
+
+func address(w *Wallet) string {
+	return string(w.GetAddress())
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
-	"cyain/utils"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type CLI struct{}
@@ -19,23 +25,94 @@ func (cli *CLI) Run() {
 		fmt.Printf("NODE_ID env. var is not set!")
 		os.Exit(1)
 	}
+	networkFromEnv()
 	
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
+	broadcastCmd := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	combinePSBTCmd := flag.NewFlagSet("combinepsbt", flag.ExitOnError)
+	auditContractCmd := flag.NewFlagSet("auditcontract", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	createPSBTCmd := flag.NewFlagSet("createpsbt", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	finalizePSBTCmd := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	getTxProofCmd := flag.NewFlagSet("gettxproof", flag.ExitOnError)
+	initiateCmd := flag.NewFlagSet("initiate", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	participateCmd := flag.NewFlagSet("participate", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	redeemCmd := flag.NewFlagSet("redeem", flag.ExitOnError)
+	refundCmd := flag.NewFlagSet("refund", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	rpcCmd := flag.NewFlagSet("rpc", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	signPSBTCmd := flag.NewFlagSet("signpsbt", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	startSPVCmd := flag.NewFlagSet("startspv", flag.ExitOnError)
+	timestampCmd := flag.NewFlagSet("timestamp", flag.ExitOnError)
+	verifyTimestampCmd := flag.NewFlagSet("verifytimestamp", flag.ExitOnError)
 	
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createBlockchainPoA := createBlockchainCmd.String("poa", "", "Use proof of authority with the comma separated signer addresses")
+	createMultisigM := createMultisigCmd.Int("m", 0, "Number of signatures needed")
+	createMultisigPubKeys := createMultisigCmd.String("pubkeys", "", "Comma separated hex public keys")
+	generateCount := generateCmd.Int("n", 1, "Number of blocks to mine")
+	generateAddress := generateCmd.String("address", "", "The address to send block rewards to")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "The address to print the public key of")
+	getTxProofTxid := getTxProofCmd.String("txid", "", "ID of the transaction to prove")
+	createPSBTFrom := createPSBTCmd.String("from", "", "Source address, keys or multisig")
+	createPSBTTo := createPSBTCmd.String("to", "", "Destination wallet address")
+	createPSBTAmount := createPSBTCmd.Int("amount", 0, "Amount to send")
+	createPSBTFile := createPSBTCmd.String("file", "", "File to write the partially signed transaction to")
+	createPSBTLockTime := createPSBTCmd.Int64("locktime", 0, "Height or unix time the transaction can't be mined before")
+	createPSBTSequence := createPSBTCmd.Uint("sequence", 0, "Relative lock of every input, in blocks or with bit 22 set in units of 512 seconds")
+	signPSBTFile := signPSBTCmd.String("file", "", "Partially signed transaction file")
+	combinePSBTFiles := combinePSBTCmd.String("files", "", "Comma separated partially signed transaction files")
+	combinePSBTFile := combinePSBTCmd.String("file", "", "File to write the combined transaction to")
+	finalizePSBTFile := finalizePSBTCmd.String("file", "", "Partially signed transaction file")
+	broadcastHex := broadcastCmd.String("hex", "", "Hex encoded transaction")
+	initiateFrom := initiateCmd.String("from", "", "Address paying into the contract and getting the refund")
+	initiateTo := initiateCmd.String("to", "", "Address of the participant")
+	initiateAmount := initiateCmd.Int("amount", 0, "Amount to lock in the contract")
+	initiateLockFor := initiateCmd.Int64("lockfor", 48*60*60, "Seconds until the contract can be refunded")
+	initiateMine := initiateCmd.Bool("mine", false, "Mine immediately on the same node")
+	participateFrom := participateCmd.String("from", "", "Address paying into the contract and getting the refund")
+	participateTo := participateCmd.String("to", "", "Address of the initiator")
+	participateAmount := participateCmd.Int("amount", 0, "Amount to lock in the contract")
+	participateSecretHash := participateCmd.String("secrethash", "", "Secret hash from the initiator's contract")
+	participateLockFor := participateCmd.Int64("lockfor", 24*60*60, "Seconds until the contract can be refunded")
+	participateMine := participateCmd.Bool("mine", false, "Mine immediately on the same node")
+	redeemContract := redeemCmd.String("contract", "", "Hex encoded contract")
+	redeemSecret := redeemCmd.String("secret", "", "Hex encoded secret")
+	redeemFee := redeemCmd.Int("fee", 0, "Fee taken out of the coins of the contract")
+	redeemMine := redeemCmd.Bool("mine", false, "Mine immediately on the same node")
+	refundContract := refundCmd.String("contract", "", "Hex encoded contract")
+	refundFee := refundCmd.Int("fee", 0, "Fee taken out of the coins of the contract")
+	refundMine := refundCmd.Bool("mine", false, "Mine immediately on the same node")
+	auditContract := auditContractCmd.String("contract", "", "Hex encoded contract")
+	timestampFile := timestampCmd.String("file", "", "File to timestamp")
+	timestampFrom := timestampCmd.String("from", "", "Address paying for the transaction")
+	timestampMine := timestampCmd.Bool("mine", false, "Mine immediately on the same node")
+	verifyTimestampFile := verifyTimestampCmd.String("file", "", "File to look for")
+	broadcastMiner := broadcastCmd.String("miner", "", "Mine immediately on the same node and send the reward to ADDRESS")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeThreads := startNodeCmd.Int("threads", 0, "Number of mining workers, 0 uses every CPU")
+	startNodeMineEmpty := startNodeCmd.Bool("mineempty", false, "Keep mining empty blocks while the mempool is empty")
+	startNodeRPCPort := startNodeCmd.String("rpcport", "", "Serve JSON-RPC on PORT")
+	startNodeRESTPort := startNodeCmd.String("restport", "", "Serve read-only chain data over HTTP on PORT")
+	startNodeMetricsPort := startNodeCmd.String("metricsport", "", "Serve Prometheus metrics on PORT")
+	startNodeRPCUser := startNodeCmd.String("rpcuser", "", "Accept RPC calls from USER besides the cookie")
+	startNodeRPCPassword := startNodeCmd.String("rpcpassword", "", "Password of the RPC user")
+	rpcMethod := rpcCmd.String("method", "", "Method to call")
+	rpcParams := rpcCmd.String("params", "", "JSON params of the call")
+	startSPVPeer := startSPVCmd.String("peer", "", "Full node to sync from, the first seed by default")
 	
 	switch os.Args[1] {
 	case "getbalance":
@@ -48,36 +125,126 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "auditcontract":
+		err := auditContractCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "broadcast":
+		err := broadcastCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "combinepsbt":
+		err := combinePSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createpsbt":
+		err := createPSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createwallet":
 		err := createWalletCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "finalizepsbt":
+		err := finalizePSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "generate":
+		err := generateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettxproof":
+		err := getTxProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "initiate":
+		err := initiateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "participate":
+		err := participateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "printchain":
 		err := printChainCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "redeem":
+		err := redeemCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "refund":
+		err := refundCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "reindexutxo":
 		err := reindexUTXOCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "rpc":
+		err := rpcCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "signpsbt":
+		err := signPSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "startnode":
 		err := startNodeCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "startspv":
+		err := startSPVCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "timestamp":
+		err := timestampCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifytimestamp":
+		err := verifyTimestampCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
@@ -96,13 +263,45 @@ func (cli *CLI) Run() {
 			createBlockchainCmd.Usage()
 			os.Exit(1)
 		}
-		cli.createBlockchain(*createBlockchainAddress, nodeID)
+		cli.createBlockchain(*createBlockchainAddress, *createBlockchainPoA, nodeID)
+	}
+	
+	if createMultisigCmd.Parsed() {
+		if *createMultisigM <= 0 || *createMultisigPubKeys == "" {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*createMultisigM, strings.Split(*createMultisigPubKeys, ","), nodeID)
 	}
 	
 	if createWalletCmd.Parsed() {
 		cli.createWallet(nodeID)
 	}
 	
+	if generateCmd.Parsed() {
+		if *generateAddress == "" || *generateCount <= 0 {
+			generateCmd.Usage()
+			os.Exit(1)
+		}
+		cli.generate(*generateCount, *generateAddress, nodeID)
+	}
+	
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getPubKey(*getPubKeyAddress, nodeID)
+	}
+	
+	if getTxProofCmd.Parsed() {
+		if *getTxProofTxid == "" {
+			getTxProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getTxProof(*getTxProofTxid, nodeID)
+	}
+	
 	if listAddressesCmd.Parsed() {
 		cli.listAddresses(nodeID)
 	}
@@ -115,6 +314,14 @@ func (cli *CLI) Run() {
 		cli.reindexUTXO(nodeID)
 	}
 	
+	if rpcCmd.Parsed() {
+		if *rpcMethod == "" {
+			rpcCmd.Usage()
+			os.Exit(1)
+		}
+		cli.rpc(*rpcMethod, *rpcParams, nodeID)
+	}
+	
 	if sendCmd.Parsed() {
 		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
 			sendCmd.Usage()
@@ -124,24 +331,152 @@ func (cli *CLI) Run() {
 		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
 	}
 	
+	if createPSBTCmd.Parsed() {
+		if *createPSBTFrom == "" || *createPSBTTo == "" || *createPSBTAmount <= 0 || *createPSBTFile == "" {
+			createPSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createPSBT(*createPSBTFrom, *createPSBTTo, *createPSBTAmount, *createPSBTLockTime, uint32(*createPSBTSequence), *createPSBTFile, nodeID)
+	}
+	
+	if signPSBTCmd.Parsed() {
+		if *signPSBTFile == "" {
+			signPSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signPSBT(*signPSBTFile, nodeID)
+	}
+	
+	if combinePSBTCmd.Parsed() {
+		if *combinePSBTFiles == "" || *combinePSBTFile == "" {
+			combinePSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.combinePSBT(strings.Split(*combinePSBTFiles, ","), *combinePSBTFile)
+	}
+	
+	if finalizePSBTCmd.Parsed() {
+		if *finalizePSBTFile == "" {
+			finalizePSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.finalizePSBT(*finalizePSBTFile)
+	}
+	
+	if initiateCmd.Parsed() {
+		if *initiateFrom == "" || *initiateTo == "" || *initiateAmount <= 0 {
+			initiateCmd.Usage()
+			os.Exit(1)
+		}
+		cli.initiate(*initiateFrom, *initiateTo, *initiateAmount, *initiateLockFor, nodeID, *initiateMine)
+	}
+	
+	if participateCmd.Parsed() {
+		if *participateFrom == "" || *participateTo == "" || *participateAmount <= 0 || *participateSecretHash == "" {
+			participateCmd.Usage()
+			os.Exit(1)
+		}
+		cli.participate(*participateFrom, *participateTo, *participateAmount, *participateSecretHash, *participateLockFor, nodeID, *participateMine)
+	}
+	
+	if redeemCmd.Parsed() {
+		if *redeemContract == "" || *redeemSecret == "" {
+			redeemCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendContract(*redeemContract, *redeemSecret, *redeemFee, nodeID, *redeemMine)
+	}
+	
+	if refundCmd.Parsed() {
+		if *refundContract == "" {
+			refundCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendContract(*refundContract, "", *refundFee, nodeID, *refundMine)
+	}
+	
+	if auditContractCmd.Parsed() {
+		if *auditContract == "" {
+			auditContractCmd.Usage()
+			os.Exit(1)
+		}
+		cli.auditContract(*auditContract, nodeID)
+	}
+	
+	if broadcastCmd.Parsed() {
+		if *broadcastHex == "" {
+			broadcastCmd.Usage()
+			os.Exit(1)
+		}
+		cli.broadcast(*broadcastHex, *broadcastMiner, nodeID)
+	}
+	
+	if timestampCmd.Parsed() {
+		if *timestampFile == "" || *timestampFrom == "" {
+			timestampCmd.Usage()
+			os.Exit(1)
+		}
+		cli.timestamp(*timestampFile, *timestampFrom, nodeID, *timestampMine)
+	}
+	
+	if verifyTimestampCmd.Parsed() {
+		if *verifyTimestampFile == "" {
+			verifyTimestampCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyTimestamp(*verifyTimestampFile, nodeID)
+	}
+	
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
 		if nodeID == "" {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		defaultMiner = NewMiner(*startNodeThreads)
+		rpc := RPCConfig{*startNodeRPCPort, *startNodeRPCUser, *startNodeRPCPassword}
+		cli.startNode(nodeID, *startNodeMiner, *startNodeMineEmpty, rpc, *startNodeRESTPort, *startNodeMetricsPort)
+	}
+	
+	if startSPVCmd.Parsed() {
+		peer := *startSPVPeer
+		if peer == "" {
+			peer = knownNodes[0]
+		}
+		fmt.Printf("Starting light client %s, syncing from %s\n", nodeID, peer)
+		StartLightClient(nodeID, peer)
 	}
 }
 
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
-	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
+	fmt.Println("  auditcontract -contract CONTRACT - Show the terms of an atomic swap contract, its funds and a revealed secret")
+	fmt.Println("  broadcast -hex TX [-miner ADDRESS] - Send a finalized transaction to the network or mine it right away")
+	fmt.Println("  combinepsbt -files FILES -file FILE - Merge the signatures of the comma separated FILES into FILE")
+	fmt.Println("  createblockchain -address ADDRESS [-poa SIGNERS] - Create a blockchain and send genesis block reward to ADDRESS")
+	fmt.Println("  createmultisig -m M -pubkeys PUBKEYS - Create an address spendable with M of the comma separated PUBKEYS")
+	fmt.Println("  createpsbt -from FROM -to TO -amount AMOUNT -file FILE [-locktime N] [-sequence N] - Write an unsigned transaction to FILE for signing elsewhere")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
+	fmt.Println("  finalizepsbt -file FILE - Print the transaction in FILE once it is fully signed")
+	fmt.Println("  generate -n N -address ADDRESS - Mine N blocks to ADDRESS right away (NETWORK=regtest only)")
 	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getpubkey -address ADDRESS - Print the public key of ADDRESS to share for multisig")
+	fmt.Println("  gettxproof -txid TXID - Print the merkle proof that the transaction TXID is in its block")
+	fmt.Println("  initiate -from FROM -to TO -amount AMOUNT [-lockfor SECONDS] - Start an atomic swap by locking AMOUNT in a contract with a new secret")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
+	fmt.Println("  participate -from FROM -to TO -amount AMOUNT -secrethash HASH [-lockfor SECONDS] - Lock AMOUNT in a contract on the initiator's secret hash")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
+	fmt.Println("  redeem -contract CONTRACT -secret SECRET [-fee FEE] - Take the coins locked in a contract with its secret")
+	fmt.Println("  refund -contract CONTRACT [-fee FEE] - Take back the coins locked in a contract once its lock time passed")
+	fmt.Println("  rpc -method METHOD [-params JSON] - Call METHOD on the running node and print the result")
 	fmt.Println("  send -from FROM -to TO -amount AMOUNT - Send AMOUNT of coins from FROM address to TO")
+	fmt.Println("  signpsbt -file FILE - Sign the transaction in FILE with every key of the wallet that can")
+	fmt.Println("  timestamp -file FILE -from ADDRESS - Record the hash of FILE on chain, paid by ADDRESS")
+	fmt.Println("  verifytimestamp -file FILE - Show the block that recorded the hash of FILE with a merkle proof")
+	fmt.Println("  startnode -miner ADDRESS -threads N -mineempty -rpcport PORT [-rpcuser USER -rpcpassword PASSWORD] [-restport PORT] [-metricsport PORT] - Start a node, mine to ADDRESS, serve JSON-RPC, the REST API and metrics")
+	fmt.Println()
+	fmt.Println("getbalance, generate, listaddresses and send go through the node while it runs with -rpcport.")
+	fmt.Println("  startspv [-peer ADDRESS] - Start a light client that only syncs block headers and the wallet's transactions")
 }
 
 func (cli *CLI) validateArgs() {
@@ -151,11 +486,25 @@ func (cli *CLI) validateArgs() {
 	}
 }
 
-func (cli *CLI) createBlockchain(address, nodeID string) {
+func (cli *CLI) createBlockchain(address, poaSigners, nodeID string) {
 	if !ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := CreateBlockchain(address, nodeID)
+	
+	var engine ConsensusEngine = NewPowEngine(defaultMiner)
+	if poaSigners != "" {
+		signers := strings.Split(poaSigners, ",")
+		for _, signer := range signers {
+			if !ValidateAddress(signer) {
+				log.Panic("ERROR: Signer address is not valid")
+			}
+		}
+		
+		wallets, _ := NewWallets(nodeID)
+		engine = NewPoAEngine(signers, wallets)
+	}
+	
+	bc := CreateBlockchain(address, nodeID, engine)
 	defer bc.db.Close()
 	
 	UTXOSet := UTXOSet{bc}
@@ -175,8 +524,12 @@ func (cli *CLI) printChain(nodeid string) {
 		
 		fmt.Printf("Prev hash: %x\n", block.PrevBlockHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+		var prev *Block
+		if len(block.PrevBlockHash) > 0 {
+			prevBlock, _ := bc.GetBlock(block.PrevBlockHash)
+			prev = &prevBlock
+		}
+		fmt.Printf("Seal: %s\n", strconv.FormatBool(bc.engine.VerifyHeader(block, prev) == nil))
 		fmt.Println()
 		
 		if len(block.PrevBlockHash) == 0 {
@@ -193,6 +546,14 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 		log.Panic("ERROR: Recipient address is not valid")
 	}
 	
+	if node := RunningNode(nodeID); node != nil {
+		var txid string
+		params := map[string]interface{}{"from": from, "to": to, "amount": amount, "mine": mineNow}
+		callNode(node, "sendtoaddress", params, &txid)
+		fmt.Println("Success!")
+		return
+	}
+	
 	bc := NewBlockchain(nodeID)
 	UTXOSet := UTXOSet{bc}
 	defer bc.db.Close()
@@ -202,34 +563,63 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 		log.Panic(err)
 	}
 	wallet := wallets.GetWallet(from)
+	wallets.SyncPending(&UTXOSet)
 	
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet, wallets.Pending)
 	
 	if mineNow {
-		cbTx := NewCoinbaseTx(from, "")
-		txs := []*Transaction{cbTx, tx}
-		
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		mineTransaction(bc, tx, wallets.Pending, from)
+		wallets.SyncPending(&UTXOSet)
 	} else {
 		sendTx(knownNodes[0], tx)
+		wallets.AddPending(tx)
 	}
+	wallets.SaveToFile(nodeID)
 	
 	fmt.Println("Success!")
 }
 
+// mineTransaction mines tx and the pending transactions into a block right away
+func mineTransaction(bc *BlockChain, tx *Transaction, pending map[string]Transaction, rewardAddress string) *Block {
+	pool := make(map[string]Transaction)
+	for txID, pendingTx := range pending {
+		pool[txID] = pendingTx
+	}
+	pool[hex.EncodeToString(tx.ID)] = *tx
+	
+	cbTx := NewCoinbaseTx(rewardAddress, "")
+	txs := append([]*Transaction{cbTx}, bc.NewBlockTemplate(pool, maxBlockSize)...)
+	
+	return bc.MineBlock(txs)
+}
+
 func (cli *CLI) getBalance(address string, nodeid string) {
 	if !ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := NewBlockchain(nodeid)
-	UTXOSet := UTXOSet{bc}
-	defer bc.db.Close()
+	if node := RunningNode(nodeid); node != nil {
+		var balance int
+		callNode(node, "getbalance", map[string]string{"address": address}, &balance)
+		fmt.Printf("Balance of '%s': %d\n", address, balance)
+		return
+	}
+	
+	pubKeyHash := AddressToPubKeyHash(address)
+	var UTXOs []TxOutput
+	
+	// a light client has no blockchain, just the transactions of its wallet
+	if !dbExists(fmt.Sprintf(activeNet.DBFile, nodeid)) && lightDBExists(nodeid) {
+		lc := NewLightChain(nodeid)
+		UTXOs = lc.FindUTXO(pubKeyHash)
+		lc.db.Close()
+	} else {
+		bc := NewBlockchain(nodeid)
+		UTXOSet := UTXOSet{bc}
+		UTXOs = UTXOSet.FindUTXO(pubKeyHash)
+		bc.db.Close()
+	}
 	
 	balance := 0
-	pubKeyHash := utils.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
 	
 	for _, out := range UTXOs {
 		balance += out.Value
@@ -239,19 +629,521 @@ func (cli *CLI) getBalance(address string, nodeid string) {
 }
 
 func (cli *CLI) createWallet(nodeid string) {
-	wallets, _ := NewWallets(nodeid)
+	wallets, err := NewWallets(nodeid)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
 	address := wallets.CreateWallet()
-	wallets.SaveToFile()
+	wallets.SaveToFile(nodeid)
 	
 	fmt.Printf("Your new address: %s\n", address)
 }
 
-func (cli *CLI) listAddresses(nodeid string) {
-	wallets, err := NewWallets(nodeid)
+func (cli *CLI) getPubKey(address, nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("ERROR: Address is not in the wallet")
+	}
+	
+	fmt.Printf("%x\n", wallet.PublicKey)
+}
+
+func (cli *CLI) createMultisig(m int, hexKeys []string, nodeID string) {
+	var pubKeys [][]byte
+	for _, hexKey := range hexKeys {
+		pubKey, err := hex.DecodeString(hexKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+	
+	script, err := MultisigScript(m, pubKeys)
 	if err != nil {
 		log.Panic(err)
 	}
-	addresses := wallets.GetAddresses()
+	
+	wallets, err := NewWallets(nodeID)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
+	address := ScriptAddress(script)
+	wallets.Scripts[address] = script
+	wallets.SaveToFile(nodeID)
+	
+	fmt.Printf("Your new %d-of-%d address: %s\n", m, len(pubKeys), address)
+}
+
+func (cli *CLI) initiate(from, to string, amount int, lockFor int64, nodeID string, mineNow bool) {
+	secret := make([]byte, htlcSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.Panic(err)
+	}
+	secretHash := sha256.Sum256(secret)
+	
+	fmt.Printf("Secret:      %x\n", secret)
+	fmt.Printf("Secret hash: %x\n", secretHash)
+	cli.fundContract(from, to, amount, secretHash[:], lockFor, nodeID, mineNow)
+}
+
+func (cli *CLI) participate(from, to string, amount int, secretHashHex string, lockFor int64, nodeID string, mineNow bool) {
+	secretHash, err := hex.DecodeString(secretHashHex)
+	if err != nil || len(secretHash) != sha256.Size {
+		log.Panic("ERROR: Secret hash is not valid")
+	}
+	
+	cli.fundContract(from, to, amount, secretHash, lockFor, nodeID, mineNow)
+}
+
+// fundContract pays amount into a contract that to can redeem with the
+// preimage of secretHash and from can refund after lockFor seconds
+func (cli *CLI) fundContract(from, to string, amount int, secretHash []byte, lockFor int64, nodeID string, mineNow bool) {
+	if !ValidateAddress(from) || IsScriptAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	if !ValidateAddress(to) || IsScriptAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+	
+	if node := RunningNode(nodeID); node != nil {
+		var info ContractInfo
+		params := map[string]interface{}{"from": from, "to": to, "amount": amount, "secrethash": hex.EncodeToString(secretHash), "lockfor": lockFor, "mine": mineNow}
+		callNode(node, "fundcontract", params, &info)
+		printContract(info)
+		return
+	}
+	
+	bc := NewBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+	
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet := wallets.GetWallet(from)
+	wallets.SyncPending(&UTXOSet)
+	
+	contract := &HTLC{
+		SecretHash: secretHash,
+		Recipient:  AddressToPubKeyHash(to),
+		Refund:     AddressToPubKeyHash(from),
+		LockTime:   time.Now().Unix() + lockFor,
+	}
+	tx := NewUTXOTransaction(&wallet, contract.Address(), amount, &UTXOSet, wallets.Pending)
+	
+	if mineNow {
+		mineTransaction(bc, tx, wallets.Pending, from)
+		wallets.SyncPending(&UTXOSet)
+	} else {
+		sendTx(knownNodes[0], tx)
+		wallets.AddPending(tx)
+	}
+	wallets.SaveToFile(nodeID)
+	
+	printContract(ContractInfo{hex.EncodeToString(contract.Script()), contract.Address(), hex.EncodeToString(tx.ID), contract.LockTime})
+}
+
+func printContract(info ContractInfo) {
+	fmt.Printf("Contract:    %s\n", info.Contract)
+	fmt.Printf("Address:     %s\n", info.Address)
+	fmt.Printf("Transaction: %s\n", info.Txid)
+	fmt.Printf("Refundable:  %s\n", time.Unix(info.LockTime, 0).Format(time.RFC3339))
+}
+
+// spendContract redeems the contract with secretHex or refunds it when that is
+// empty, paying fee out of its coins
+func (cli *CLI) spendContract(contractHex, secretHex string, fee int, nodeID string, mineNow bool) {
+	contract := parseContract(contractHex)
+	
+	if node := RunningNode(nodeID); node != nil {
+		var txid string
+		params := map[string]interface{}{"contract": contractHex, "secret": secretHex, "fee": fee, "mine": mineNow}
+		callNode(node, "spendcontract", params, &txid)
+		fmt.Printf("Sent %s\n", txid)
+		return
+	}
+	
+	var secret []byte
+	owner := contract.Refund
+	if secretHex != "" {
+		var err error
+		secret, err = hex.DecodeString(secretHex)
+		if err != nil {
+			log.Panic(err)
+		}
+		owner = contract.Recipient
+	}
+	
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet := wallets.FindWallet(owner)
+	if wallet == nil {
+		log.Panic("ERROR: The wallet has no key for this contract")
+	}
+	
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+	UTXOSet := UTXOSet{bc}
+	
+	tx, err := NewHTLCSpend(contract, wallet, secret, fee, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = bc.CheckLocks(tx, bc.GetBestHeight()+1, bc.MedianTimePast(bc.Tip()))
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	if mineNow {
+		mineTransaction(bc, tx, nil, string(wallet.GetAddress()))
+	} else {
+		sendTx(knownNodes[0], tx)
+	}
+	
+	fmt.Printf("Sent %x\n", tx.ID)
+}
+
+func (cli *CLI) auditContract(contractHex, nodeID string) {
+	contract := parseContract(contractHex)
+	
+	var audit ContractAudit
+	if node := RunningNode(nodeID); node != nil {
+		callNode(node, "auditcontract", map[string]string{"contract": contractHex}, &audit)
+	} else {
+		bc := NewBlockchain(nodeID)
+		defer bc.db.Close()
+		audit = NewContractAudit(bc, contract)
+	}
+	
+	fmt.Printf("Address:     %s\n", audit.Address)
+	fmt.Printf("Recipient:   %s\n", audit.Recipient)
+	fmt.Printf("Refund to:   %s\n", audit.Refund)
+	fmt.Printf("Secret hash: %s\n", audit.SecretHash)
+	fmt.Printf("Refundable:  %s\n", time.Unix(audit.LockTime, 0).Format(time.RFC3339))
+	fmt.Printf("Funds:       %d\n", audit.Funds)
+	if audit.Secret != "" {
+		fmt.Printf("Secret:      %s\n", audit.Secret)
+	}
+}
+
+func parseContract(contractHex string) *HTLC {
+	script, err := hex.DecodeString(contractHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	contract, err := ParseHTLC(script)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	return contract
+}
+
+func (cli *CLI) timestamp(file, from, nodeID string, mineNow bool) {
+	if !ValidateAddress(from) || IsScriptAddress(from) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	hash, err := HashFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	if node := RunningNode(nodeID); node != nil {
+		var txid string
+		params := map[string]interface{}{"from": from, "hash": hex.EncodeToString(hash), "mine": mineNow}
+		callNode(node, "timestamp", params, &txid)
+		fmt.Printf("File hash:   %x\n", hash)
+		fmt.Printf("Transaction: %s\n", txid)
+		return
+	}
+	
+	bc := NewBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+	
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet := wallets.GetWallet(from)
+	wallets.SyncPending(&UTXOSet)
+	
+	tx := NewDataTransaction(&wallet, hash, &UTXOSet, wallets.Pending)
+	
+	if mineNow {
+		mineTransaction(bc, tx, wallets.Pending, from)
+		wallets.SyncPending(&UTXOSet)
+	} else {
+		sendTx(knownNodes[0], tx)
+		wallets.AddPending(tx)
+	}
+	wallets.SaveToFile(nodeID)
+	
+	fmt.Printf("File hash:   %x\n", hash)
+	fmt.Printf("Transaction: %x\n", tx.ID)
+}
+
+func (cli *CLI) verifyTimestamp(file, nodeID string) {
+	hash, err := HashFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	var info TxProofInfo
+	if node := RunningNode(nodeID); node != nil {
+		callNode(node, "verifytimestamp", map[string]string{"hash": hex.EncodeToString(hash)}, &info)
+	} else {
+		bc := NewBlockchain(nodeID)
+		defer bc.db.Close()
+		
+		proof, err := bc.FindTimestamp(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		info = NewTxProofInfo(proof.Block, proof.Index, proof.Path)
+	}
+	
+	fmt.Printf("File hash:   %x\n", hash)
+	fmt.Printf("Block:       %s\n", info.BlockHash)
+	fmt.Printf("Height:      %d\n", info.Height)
+	fmt.Printf("Time:        %s\n", time.Unix(info.Time, 0).Format(time.RFC3339))
+	fmt.Printf("Transaction: %s\n", info.Txid)
+	printMerkleProof(info)
+}
+
+func (cli *CLI) getTxProof(txid, nodeID string) {
+	ID, err := hex.DecodeString(txid)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	var info TxProofInfo
+	if node := RunningNode(nodeID); node != nil {
+		callNode(node, "gettxproof", map[string]string{"txid": txid}, &info)
+	} else {
+		bc := NewBlockchain(nodeID)
+		defer bc.db.Close()
+		
+		info, err = bc.TxProof(ID)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	
+	fmt.Printf("Transaction: %x\n", ID)
+	fmt.Printf("Block:       %s\n", info.BlockHash)
+	fmt.Printf("Height:      %d\n", info.Height)
+	fmt.Printf("Index:       %d\n", info.Index)
+	printMerkleProof(info)
+}
+
+// printMerkleProof shows the proof of info and checks it
+func printMerkleProof(info TxProofInfo) {
+	root, err := hex.DecodeString(info.MerkleRoot)
+	if err != nil {
+		log.Panic(err)
+	}
+	leaf, err := hex.DecodeString(info.Leaf)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	fmt.Printf("Merkle root: %x\n", root)
+	fmt.Printf("Leaf:        %x\n", leaf)
+	fmt.Println("Merkle proof:")
+	var proof []MerkleStep
+	for _, step := range info.Proof {
+		hash, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		proof = append(proof, MerkleStep{hash, step.Left})
+		
+		side := "right"
+		if step.Left {
+			side = "left"
+		}
+		fmt.Printf("  %-5s %x\n", side, hash)
+	}
+	fmt.Printf("Valid:       %t\n", VerifyMerkleProof(root, leaf, proof))
+}
+
+func (cli *CLI) createPSBT(from, to string, amount int, lockTime int64, sequence uint32, file, nodeID string) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+	
+	var psbt *PSBT
+	if node := RunningNode(nodeID); node != nil {
+		var data string
+		params := map[string]interface{}{"from": from, "to": to, "amount": amount, "locktime": lockTime, "sequence": sequence}
+		callNode(node, "createpsbt", params, &data)
+		
+		var err error
+		psbt, err = DeserializePSBT(data)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		wallets, err := NewWallets(nodeID)
+		if err != nil && !os.IsNotExist(err) {
+			log.Panic(err)
+		}
+		
+		bc := NewBlockchain(nodeID)
+		defer bc.db.Close()
+		
+		psbt, err = NewPSBTTransaction(bc, from, to, amount, lockTime, sequence, wallets.Scripts)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	psbt.SaveToFile(file)
+	
+	fmt.Printf("Wrote %s with %d inputs to sign\n", file, len(psbt.Inputs))
+}
+
+func (cli *CLI) signPSBT(file, nodeID string) {
+	psbt, err := LoadPSBT(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	signed := 0
+	for _, wallet := range wallets.Wallets {
+		signed += psbt.Sign(wallet)
+	}
+	psbt.SaveToFile(file)
+	
+	fmt.Printf("Added %d signatures\n", signed)
+}
+
+func (cli *CLI) combinePSBT(files []string, file string) {
+	var combined *PSBT
+	
+	for _, name := range files {
+		psbt, err := LoadPSBT(name)
+		if err != nil {
+			log.Panic(err)
+		}
+		
+		if combined == nil {
+			combined = psbt
+			continue
+		}
+		err = combined.Combine(psbt)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	combined.SaveToFile(file)
+	
+	fmt.Printf("Wrote %s\n", file)
+}
+
+func (cli *CLI) finalizePSBT(file string) {
+	psbt, err := LoadPSBT(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	tx, err := psbt.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+func (cli *CLI) broadcast(txHex, minerAddress, nodeID string) {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx := DeserializeTransaction(data)
+	
+	if node := RunningNode(nodeID); node != nil {
+		var txid string
+		callNode(node, "sendrawtransaction", map[string]string{"hex": txHex, "mineto": minerAddress}, &txid)
+		fmt.Printf("Sent %s\n", txid)
+		return
+	}
+	
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+	
+	if !bc.VerifyTransaction(&tx) {
+		log.Panic("ERROR: Invalid transaction")
+	}
+	err = bc.CheckLocks(&tx, bc.GetBestHeight()+1, bc.MedianTimePast(bc.Tip()))
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	if minerAddress != "" {
+		if !ValidateAddress(minerAddress) {
+			log.Panic("ERROR: Miner address is not valid")
+		}
+		mineTransaction(bc, &tx, nil, minerAddress)
+	} else {
+		sendTx(knownNodes[0], &tx)
+	}
+	
+	fmt.Printf("Sent %x\n", tx.ID)
+}
+
+func (cli *CLI) generate(n int, address, nodeID string) {
+	if activeNet != &RegtestParams {
+		log.Panic("ERROR: generate is only available on regtest")
+	}
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	
+	if node := RunningNode(nodeID); node != nil {
+		var hashes []string
+		callNode(node, "generate", map[string]interface{}{"n": n, "address": address}, &hashes)
+		for _, hash := range hashes {
+			fmt.Println(hash)
+		}
+		return
+	}
+	
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+	
+	for _, block := range bc.Generate(n, address) {
+		fmt.Printf("%x\n", block.Hash)
+	}
+}
+
+func (cli *CLI) listAddresses(nodeid string) {
+	var addresses []string
+	if node := RunningNode(nodeid); node != nil {
+		callNode(node, "listaddresses", nil, &addresses)
+	} else {
+		wallets, err := NewWallets(nodeid)
+		if err != nil {
+			log.Panic(err)
+		}
+		addresses = wallets.GetAddresses()
+	}
 	
 	for _, address := range addresses {
 		fmt.Println(address)
@@ -265,6 +1157,13 @@ func (cli *CLI) listAddresses(nodeid string) {
 // getbalance -address RJaShsJmFJneYjtT1eWPmaafFyVny2HYS
 
 func (cli *CLI) reindexUTXO(nodeID string) {
+	if node := RunningNode(nodeID); node != nil {
+		var count int
+		callNode(node, "reindexutxo", nil, &count)
+		fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+		return
+	}
+	
 	bc := NewBlockchain(nodeID)
 	UTXOSet := UTXOSet{bc}
 	UTXOSet.Reindex()
@@ -273,7 +1172,7 @@ func (cli *CLI) reindexUTXO(nodeID string) {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, minerAddress string, mineEmpty bool, rpc RPCConfig, restPort, metricsPort string) {
 	fmt.Printf("Starting node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
@@ -282,5 +1181,34 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	StartServer(nodeID, minerAddress, mineEmpty, rpc, restPort, metricsPort)
+}
+
+func (cli *CLI) rpc(method, params, nodeID string) {
+	node := RunningNode(nodeID)
+	if node == nil {
+		log.Panic("ERROR: Node ", nodeID, " isn't running with -rpcport")
+	}
+	
+	var args interface{}
+	if params != "" {
+		args = json.RawMessage(params)
+	}
+	var result json.RawMessage
+	callNode(node, method, args, &result)
+	
+	var out bytes.Buffer
+	err := json.Indent(&out, result, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(out.String())
+}
+
+// callNode runs method on the running node and decodes its result
+func callNode(node *RPCClient, method string, params, result interface{}) {
+	err := node.Call(method, params, result)
+	if err != nil {
+		log.Panic("ERROR: ", err)
+	}
 }
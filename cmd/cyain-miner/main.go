@@ -0,0 +1,207 @@
+// cyain-miner is a standalone miner. It fetches work from a node with
+// getblocktemplate and hands solved nonces back with submitblock.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long to work on a template before asking for a fresh one
+const refreshInterval = 10 * time.Second
+
+type template struct {
+	ID            string `json:"id"`
+	Height        int    `json:"height"`
+	PrevBlockHash string `json:"previousblockhash"`
+	Target        string `json:"target"`
+	Header        string `json:"header"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type client struct {
+	url      string
+	user     string
+	password string
+	id       int64
+}
+
+func (c *client) call(method string, params, result interface{}) error {
+	request := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      atomic.AddInt64(&c.id, 1),
+		"method":  method,
+		"params":  params,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.user, c.password)
+	
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("the node refused the RPC credentials")
+	}
+	
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return errors.New(response.Error.Message)
+	}
+	
+	return json.Unmarshal(response.Result, result)
+}
+
+// search tries nonces on header until one hashes below target or stop is closed
+func search(header []byte, target *big.Int, workers int, stop <-chan struct{}, hashes *uint64) (int, bool) {
+	found := make(chan int, workers)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			
+			var hashInt big.Int
+			data := append(append([]byte{}, header...), make([]byte, 8)...)
+			nonceBytes := data[len(header):]
+			
+			for nonce := worker; nonce >= 0; nonce += workers {
+				if (nonce/workers)%4096 == 0 {
+					atomic.AddUint64(hashes, 4096)
+					select {
+					case <-quit:
+						return
+					default:
+					}
+				}
+				
+				binary.BigEndian.PutUint64(nonceBytes, uint64(nonce))
+				hash := sha256.Sum256(data)
+				hashInt.SetBytes(hash[:])
+				
+				if hashInt.Cmp(target) == -1 {
+					found <- nonce
+					return
+				}
+			}
+		}(i)
+	}
+	
+	defer wg.Wait()
+	defer close(quit)
+	
+	select {
+	case nonce := <-found:
+		return nonce, true
+	case <-stop:
+		return 0, false
+	}
+}
+
+func main() {
+	rpcURL := flag.String("rpc", "http://localhost:4000", "JSON-RPC endpoint of the node")
+	address := flag.String("address", "", "Address to send block rewards to")
+	threads := flag.Int("threads", runtime.NumCPU(), "Number of mining workers")
+	rpcUser := flag.String("rpcuser", "", "RPC user")
+	rpcPassword := flag.String("rpcpassword", "", "RPC password")
+	rpcCookie := flag.String("rpccookie", "", "Cookie file of a node on this machine, instead of -rpcuser and -rpcpassword")
+	flag.Parse()
+	
+	if *address == "" {
+		flag.Usage()
+		log.Fatal("-address is required")
+	}
+	
+	c := &client{url: *rpcURL, user: *rpcUser, password: *rpcPassword}
+	if *rpcCookie != "" {
+		// the address the node listens on, then user:password
+		data, err := ioutil.ReadFile(*rpcCookie)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		credentials := strings.SplitN(lines[len(lines)-1], ":", 2)
+		if len(credentials) != 2 {
+			log.Fatalf("malformed cookie file %s", *rpcCookie)
+		}
+		c.user, c.password = credentials[0], credentials[1]
+	}
+	var hashes uint64
+	start := time.Now()
+	
+	for {
+		var work template
+		err := c.call("getblocktemplate", map[string]string{"address": *address}, &work)
+		if err != nil {
+			log.Printf("getblocktemplate: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		
+		header, err := hex.DecodeString(work.Header)
+		if err != nil {
+			log.Fatal(err)
+		}
+		target, ok := new(big.Int).SetString(work.Target, 16)
+		if !ok {
+			log.Fatalf("bad target %s", work.Target)
+		}
+		
+		stop := make(chan struct{})
+		timer := time.AfterFunc(refreshInterval, func() { close(stop) })
+		nonce, solved := search(header, target, *threads, stop, &hashes)
+		timer.Stop()
+		
+		rate := float64(atomic.LoadUint64(&hashes)) / time.Since(start).Seconds()
+		if !solved {
+			fmt.Printf("height %d: no solution yet, %.0f H/s\n", work.Height, rate)
+			continue
+		}
+		
+		var hash string
+		err = c.call("submitblock", map[string]interface{}{"id": work.ID, "nonce": nonce}, &hash)
+		if err != nil {
+			log.Printf("submitblock: %s", err)
+			continue
+		}
+		fmt.Printf("height %d: mined block %s, %.0f H/s\n", work.Height, hash, rate)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+)
+
+// short transaction IDs keep the low 48 bits of a SipHash
+const shortIDMask = 1<<48 - 1
+
+// CompactBlock announces a block by its header and short IDs of its
+// transactions. The receiver finds most of them in its mempool and only
+// asks for the rest.
+type CompactBlock struct {
+	Header BlockHeader
+	// salts the short IDs, so transactions colliding on one peer don't
+	// collide everywhere
+	Nonce    uint64
+	ShortIDs []uint64
+	// transactions sent whole because the receiver can't have them, like the coinbase
+	Prefilled []PrefilledTx
+}
+
+type PrefilledTx struct {
+	Index int
+	Tx    Transaction
+}
+
+func NewCompactBlock(b *Block) *CompactBlock {
+	var nonce [8]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	cb := &CompactBlock{Header: b.Header(), Nonce: binary.LittleEndian.Uint64(nonce[:])}
+	for i, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			cb.Prefilled = append(cb.Prefilled, PrefilledTx{i, *tx})
+			continue
+		}
+		cb.ShortIDs = append(cb.ShortIDs, cb.ShortID(tx.ID))
+	}
+	
+	return cb
+}
+
+// ShortID is the ID txid goes by in cb
+func (cb *CompactBlock) ShortID(txid []byte) uint64 {
+	var nonce [8]byte
+	binary.LittleEndian.PutUint64(nonce[:], cb.Nonce)
+	key := sha256.Sum256(append(append([]byte{}, cb.Header.Hash...), nonce[:]...))
+	
+	hash := sipHash(binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:16]), txid)
+	
+	return hash & shortIDMask
+}
+
+// Fill places the prefilled transactions and those of pool matching a short
+// ID. It returns the transactions in block order, with nil where one is
+// missing, and the indexes of the missing ones.
+func (cb *CompactBlock) Fill(pool map[string]Transaction) ([]*Transaction, []int) {
+	txs := make([]*Transaction, len(cb.ShortIDs)+len(cb.Prefilled))
+	prefilled := make(map[int]bool)
+	for i := range cb.Prefilled {
+		if cb.Prefilled[i].Index < 0 || cb.Prefilled[i].Index >= len(txs) {
+			continue
+		}
+		txs[cb.Prefilled[i].Index] = &cb.Prefilled[i].Tx
+		prefilled[cb.Prefilled[i].Index] = true
+	}
+	
+	// short IDs go to the slots not prefilled, in order
+	slots := make(map[uint64]int)
+	collided := make(map[uint64]bool)
+	next := 0
+	for _, shortID := range cb.ShortIDs {
+		for prefilled[next] {
+			next++
+		}
+		if _, ok := slots[shortID]; ok {
+			collided[shortID] = true
+		}
+		slots[shortID] = next
+		next++
+	}
+	
+	for id := range pool {
+		tx := pool[id]
+		shortID := cb.ShortID(tx.ID)
+		slot, ok := slots[shortID]
+		if !ok || collided[shortID] {
+			continue
+		}
+		if txs[slot] != nil {
+			// two of our transactions share the ID, ask for the right one
+			collided[shortID] = true
+			txs[slot] = nil
+			continue
+		}
+		txs[slot] = &tx
+	}
+	
+	var missing []int
+	for i, tx := range txs {
+		if tx == nil {
+			missing = append(missing, i)
+		}
+	}
+	
+	return txs, missing
+}
+
+// Block puts the filled in transactions under the header. A short ID that
+// matched the wrong transaction shows in the merkle root, and so does a list
+// repeating transactions to keep the root of the real one.
+func (cb *CompactBlock) Block(txs []*Transaction) (*Block, error) {
+	b := &Block{
+		Timestamp:     cb.Header.Timestamp,
+		Transactions:  txs,
+		PrevBlockHash: cb.Header.PrevBlockHash,
+		Hash:          cb.Header.Hash,
+		Nonce:         cb.Header.Nonce,
+		Height:        cb.Header.Height,
+		Bits:          cb.Header.Bits,
+		Signer:        cb.Header.Signer,
+		Signature:     cb.Header.Signature,
+	}
+	for _, tx := range txs {
+		if tx == nil {
+			return nil, errors.New("the block is missing transactions")
+		}
+	}
+	root, mutated := b.computeMerkleRoot()
+	if mutated || bytes.Compare(root, cb.Header.MerkleRoot) != 0 {
+		return nil, errors.New("the transactions don't match the merkle root")
+	}
+	
+	return b, nil
+}
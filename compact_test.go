@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// newCompactTestBlock is a block of a coinbase and three spends, with the
+// spends also in a pool
+func newCompactTestBlock() (*Block, map[string]Transaction) {
+	wallet := NewWallet()
+	funding := NewCoinbaseTx(address(wallet), "")
+	block := &Block{Hash: []byte("block"), Transactions: []*Transaction{NewCoinbaseTx(address(wallet), "")}}
+	pool := make(map[string]Transaction)
+	for i := 1; i <= 3; i++ {
+		tx := newTestTx(wallet, funding, []int{0}, i)
+		block.Transactions = append(block.Transactions, tx)
+		pool[hex.EncodeToString(tx.ID)] = *tx
+	}
+	
+	return block, pool
+}
+
+func TestCompactBlockFromPool(t *testing.T) {
+	block, pool := newCompactTestBlock()
+	cb := NewCompactBlock(block)
+	if len(cb.Prefilled) != 1 || cb.Prefilled[0].Index != 0 || len(cb.ShortIDs) != 3 {
+		t.Fatalf("%d prefilled and %d short IDs, want the coinbase and 3", len(cb.Prefilled), len(cb.ShortIDs))
+	}
+	
+	txs, missing := cb.Fill(pool)
+	if len(missing) != 0 {
+		t.Fatalf("transactions %v missing with all of them in the pool", missing)
+	}
+	rebuilt, err := cb.Block(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rebuilt.HashTransaction()) != string(block.HashTransaction()) {
+		t.Error("the rebuilt block has another merkle root")
+	}
+}
+
+func TestCompactBlockMissingTransactions(t *testing.T) {
+	block, pool := newCompactTestBlock()
+	cb := NewCompactBlock(block)
+	delete(pool, hex.EncodeToString(block.Transactions[2].ID))
+	
+	txs, missing := cb.Fill(pool)
+	if len(missing) != 1 || missing[0] != 2 {
+		t.Fatalf("missing %v, want the transaction left out of the pool", missing)
+	}
+	if _, err := cb.Block(txs); err == nil {
+		t.Fatal("rebuilt a block with a transaction missing")
+	}
+	
+	txs[2] = block.Transactions[3]
+	if _, err := cb.Block(txs); err == nil {
+		t.Error("rebuilt a block with the wrong transaction")
+	}
+	txs[2] = block.Transactions[2]
+	if _, err := cb.Block(txs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompactBlockShortIDCollision(t *testing.T) {
+	block, pool := newCompactTestBlock()
+	cb := NewCompactBlock(block)
+	cb.ShortIDs[1] = cb.ShortIDs[0]
+	
+	// neither slot can tell which transaction it holds
+	if _, missing := cb.Fill(pool); len(missing) != 2 || missing[0] != 1 || missing[1] != 2 {
+		t.Errorf("missing %v, want both slots sharing the short ID", missing)
+	}
+	
+	other := NewCompactBlock(block)
+	if other.Nonce == cb.Nonce || other.ShortID(block.Transactions[1].ID) == cb.ShortID(block.Transactions[1].ID) {
+		t.Error("short IDs don't depend on the nonce")
+	}
+}
+
+func TestCompactBlockRejectsMutatedRebuild(t *testing.T) {
+	block, _ := newCompactTestBlock()
+	block.Transactions = block.Transactions[:3]
+	cb := NewCompactBlock(block)
+	
+	// [coinbase a b b] has the merkle root of [coinbase a b]
+	txs := append(append([]*Transaction{}, block.Transactions...), block.Transactions[2])
+	if _, err := cb.Block(txs); err == nil {
+		t.Error("rebuilt a block repeating a transaction")
+	}
+}
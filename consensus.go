@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	
+	"github.com/boltdb/bolt"
+)
+
+const consensusBucket = "consensus"
+
+// ConsensusEngine decides who may produce blocks and how they prove it
+type ConsensusEngine interface {
+	// Seal completes the header of b, setting at least its Hash
+	Seal(ctx context.Context, b *Block) error
+	// VerifyHeader checks the seal of b, prev is its parent or nil for the genesis block
+	VerifyHeader(b *Block, prev *Block) error
+	// Difficulty is the Bits value expected in the block following prev
+	Difficulty(prev *Block) int
+}
+
+// saveEngine records which engine the chain was created with
+func saveEngine(tx *bolt.Tx, engine ConsensusEngine) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(consensusBucket))
+	if err != nil {
+		return err
+	}
+	
+	err = b.Put([]byte("network"), []byte(activeNet.Name))
+	if err != nil {
+		return err
+	}
+	
+	switch e := engine.(type) {
+	case *PoAEngine:
+		err = b.Put([]byte("engine"), []byte("poa"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("signers"), []byte(strings.Join(e.signers, ",")))
+	default:
+		return b.Put([]byte("engine"), []byte("pow"))
+	}
+}
+
+// checkNetwork refuses a database created for another network
+func checkNetwork(tx *bolt.Tx) error {
+	name := MainNetParams.Name
+	
+	b := tx.Bucket([]byte(consensusBucket))
+	if b != nil && b.Get([]byte("network")) != nil {
+		name = string(b.Get([]byte("network")))
+	}
+	if name != activeNet.Name {
+		return fmt.Errorf("the blockchain belongs to the %s network, not %s", name, activeNet.Name)
+	}
+	
+	return nil
+}
+
+// loadEngine restores the engine of the chain in db. Proof-of-authority
+// signer keys are taken from the wallet file of nodeID, a node without one
+// only verifies blocks.
+func loadEngine(db *bolt.DB, nodeID string) (ConsensusEngine, error) {
+	var engine ConsensusEngine = NewPowEngine(defaultMiner)
+	
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(consensusBucket))
+		if b == nil || string(b.Get([]byte("engine"))) != "poa" {
+			return nil
+		}
+		
+		signers := strings.Split(string(b.Get([]byte("signers"))), ",")
+		wallets, err := NewWallets(nodeID)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		engine = NewPoAEngine(signers, wallets)
+		
+		return nil
+	})
+	
+	return engine, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	
+	"github.com/boltdb/bolt"
+)
+
+// newTestPoA is an engine for two signers holding the key of the first only
+func newTestPoA() (*PoAEngine, *Wallet, *Wallet) {
+	first, second := NewWallet(), NewWallet()
+	wallets := &Wallets{Wallets: map[string]*Wallet{address(first): first}}
+	
+	return NewPoAEngine([]string{address(first), address(second)}, wallets), first, second
+}
+
+func TestPoASealsInTurn(t *testing.T) {
+	engine, first, _ := newTestPoA()
+	
+	genesis, err := NewBlockContext(context.Background(), engine, []*Transaction{NewCoinbaseTx(address(first), "")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.VerifyHeader(genesis, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	_, err = NewBlockContext(context.Background(), engine, []*Transaction{NewCoinbaseTx(address(first), "")}, genesis)
+	if !errors.Is(err, errNotInTurn) {
+		t.Errorf("got %v sealing the block of the other signer, want errNotInTurn", err)
+	}
+}
+
+func TestPoAVerifyHeader(t *testing.T) {
+	engine, first, second := newTestPoA()
+	genesis := NewBlock(engine, []*Transaction{NewCoinbaseTx(address(first), "")}, nil)
+	
+	tests := []struct {
+		name   string
+		change func(b *Block) *Block
+		want   string
+	}{
+		{"signer", func(b *Block) *Block { b.Signer = second.PublicKey; return nil }, "must be signed"},
+		{"hash", func(b *Block) *Block { b.Timestamp++; return nil }, "does not match"},
+		{"signature", func(b *Block) *Block { b.Signature = signHash(second.PrivateKey, b.Hash); return nil }, "signature"},
+		{"bits", func(b *Block) *Block { b.Bits = MainNetParams.TargetBits; return nil }, "difficulty"},
+		{"period", func(b *Block) *Block { return &Block{Timestamp: b.Timestamp, Bits: 1} }, "too early"},
+	}
+	
+	for _, test := range tests {
+		block := *genesis
+		prev := test.change(&block)
+		
+		err := engine.VerifyHeader(&block, prev)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error about %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestPoASealWaitsForPeriod(t *testing.T) {
+	engine, first, _ := newTestPoA()
+	genesis := NewBlock(engine, []*Transaction{NewCoinbaseTx(address(first), "")}, nil)
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	
+	// height 2 is the turn of the first signer again
+	prev := &Block{Hash: genesis.Hash, Height: 1, Timestamp: genesis.Timestamp}
+	_, err := NewBlockContext(ctx, engine, []*Transaction{NewCoinbaseTx(address(first), "")}, prev)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the seal to wait out the period", err)
+	}
+}
+
+func TestLoadEngineReportsWalletErrors(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		return saveEngine(tx, NewPoAEngine([]string{address(wallet)}, nil))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// without a wallet file the node only verifies blocks
+	engine, err := loadEngine(bc.db.DB, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := engine.(*PoAEngine); !ok {
+		t.Fatalf("loaded %T, want the proof-of-authority engine", engine)
+	}
+	
+	Wallets{Network: MainNetParams.Name}.SaveToFile("test")
+	if _, err := loadEngine(bc.db.DB, "test"); err == nil {
+		t.Error("loaded the keys of a wallet of another network")
+	}
+}
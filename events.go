@@ -0,0 +1,244 @@
+package main
+
+import "sync"
+
+// BlockConnected is published for every block that joins the best chain, in
+// chain order
+type BlockConnected struct {
+	Chain *BlockChain
+	Block *Block
+}
+
+// BlockDisconnected is published for every block a reorganization takes out
+// of the best chain, the tip first
+type BlockDisconnected struct {
+	Chain *BlockChain
+	Block *Block
+}
+
+// TipChanged follows the BlockConnected and BlockDisconnected events of a
+// move of the tip
+type TipChanged struct {
+	Chain *BlockChain
+	Tip   *Block
+}
+
+type TxAccepted struct {
+	Tx *Transaction
+}
+
+// TxRemoved is published when a transaction leaves the mempool, mostly
+// because it was mined
+type TxRemoved struct {
+	Tx *Transaction
+}
+
+type PeerConnected struct {
+	Addr string
+}
+
+// UTXOSetChanged is published once the UTXO set took block in, Block is nil
+// after a reindex or a reorganization
+type UTXOSetChanged struct {
+	Chain *BlockChain
+	Block *Block
+}
+
+// Lagged takes the place of the events a stream missed, Missed of them, once
+// it has room again
+type Lagged struct {
+	Missed int
+}
+
+// EventBus hands the events of the node to their subscribers. Handlers run on
+// the goroutine publishing the event, in the order they subscribed, so they
+// must be quick and must not wait on the publisher. Streams get every event on
+// a channel instead, a stream that doesn't keep up misses events rather than
+// holding up the node and is told so with a Lagged event.
+type EventBus struct {
+	mu                sync.Mutex
+	blockConnected    []func(BlockConnected)
+	blockDisconnected []func(BlockDisconnected)
+	tipChanged        []func(TipChanged)
+	txAccepted        []func(TxAccepted)
+	txRemoved         []func(TxRemoved)
+	peerConnected     []func(PeerConnected)
+	utxoSetChanged    []func(UTXOSetChanged)
+	streams           map[int]*stream
+	next              int
+}
+
+type stream struct {
+	ch     chan interface{}
+	missed int
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{streams: make(map[int]*stream)}
+}
+
+var events = NewEventBus()
+
+func (b *EventBus) OnBlockConnected(f func(BlockConnected)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	b.blockConnected = append(b.blockConnected, f)
+}
+
+func (b *EventBus) OnBlockDisconnected(f func(BlockDisconnected)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	b.blockDisconnected = append(b.blockDisconnected, f)
+}
+
+func (b *EventBus) OnTipChanged(f func(TipChanged)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	b.tipChanged = append(b.tipChanged, f)
+}
+
+func (b *EventBus) OnTxAccepted(f func(TxAccepted)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	b.txAccepted = append(b.txAccepted, f)
+}
+
+func (b *EventBus) OnTxRemoved(f func(TxRemoved)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	b.txRemoved = append(b.txRemoved, f)
+}
+
+func (b *EventBus) OnPeerConnected(f func(PeerConnected)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	b.peerConnected = append(b.peerConnected, f)
+}
+
+func (b *EventBus) OnUTXOSetChanged(f func(UTXOSetChanged)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	b.utxoSetChanged = append(b.utxoSetChanged, f)
+}
+
+// Stream returns a channel of the events to come and the function that stops
+// them and closes it
+func (b *EventBus) Stream(buffer int) (<-chan interface{}, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	id := b.next
+	b.next++
+	ch := make(chan interface{}, buffer)
+	b.streams[id] = &stream{ch: ch}
+	
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			
+			delete(b.streams, id)
+			close(ch)
+		})
+	}
+}
+
+// Publish hands event, one of the event types above, to its handlers and to
+// every stream
+func (b *EventBus) Publish(event interface{}) {
+	b.mu.Lock()
+	// handlers may subscribe in turn, they are called without the lock
+	blockConnected := b.blockConnected
+	blockDisconnected := b.blockDisconnected
+	tipChanged := b.tipChanged
+	txAccepted := b.txAccepted
+	txRemoved := b.txRemoved
+	peerConnected := b.peerConnected
+	utxoSetChanged := b.utxoSetChanged
+	for _, s := range b.streams {
+		s.send(event)
+	}
+	b.mu.Unlock()
+	
+	switch e := event.(type) {
+	case BlockConnected:
+		for _, f := range blockConnected {
+			f(e)
+		}
+	case BlockDisconnected:
+		for _, f := range blockDisconnected {
+			f(e)
+		}
+	case TipChanged:
+		for _, f := range tipChanged {
+			f(e)
+		}
+	case TxAccepted:
+		for _, f := range txAccepted {
+			f(e)
+		}
+	case TxRemoved:
+		for _, f := range txRemoved {
+			f(e)
+		}
+	case PeerConnected:
+		for _, f := range peerConnected {
+			f(e)
+		}
+	case UTXOSetChanged:
+		for _, f := range utxoSetChanged {
+			f(e)
+		}
+	default:
+		panic("unknown event type")
+	}
+}
+
+// send queues event, after telling the stream about the events it missed
+func (s *stream) send(event interface{}) {
+	if s.missed > 0 {
+		select {
+		case s.ch <- Lagged{s.missed}:
+			s.missed = 0
+		default:
+			s.missed++
+			return
+		}
+	}
+	
+	select {
+	case s.ch <- event:
+	default:
+		s.missed++
+	}
+}
+
+// publishTipChange publishes the blocks disconnected and connected when the
+// tip moved from oldTip to newTip, the old branch first
+func (bc *BlockChain) publishTipChange(oldTip []byte, newTip *Block) {
+	var disconnected, connected []*Block
+	
+	old, err := bc.GetBlock(oldTip)
+	if err == nil {
+		disconnected, connected, err = bc.branches(&old, newTip)
+	}
+	if err != nil {
+		disconnected, connected = nil, []*Block{newTip}
+	}
+	
+	for _, block := range disconnected {
+		events.Publish(BlockDisconnected{bc, block})
+	}
+	for i := len(connected) - 1; i >= 0; i-- {
+		events.Publish(BlockConnected{bc, connected[i]})
+	}
+	events.Publish(TipChanged{bc, newTip})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	var calls []string
+	bus.OnPeerConnected(func(e PeerConnected) { calls = append(calls, "first "+e.Addr) })
+	bus.OnPeerConnected(func(e PeerConnected) { calls = append(calls, "second "+e.Addr) })
+	a, stopA := bus.Stream(1)
+	b, stopB := bus.Stream(1)
+	defer stopB()
+	
+	bus.Publish(PeerConnected{"a"})
+	bus.Publish(PeerConnected{"b"})
+	if len(calls) != 4 || calls[0] != "first a" || calls[1] != "second a" || calls[3] != "second b" {
+		t.Errorf("handlers called %v, want each event in subscription order", calls)
+	}
+	for _, ch := range []<-chan interface{}{a, b} {
+		if e := <-ch; e != (PeerConnected{"a"}) {
+			t.Errorf("got %v, want the first event", e)
+		}
+	}
+	if len(b) != 0 {
+		t.Error("a full stream got the event it had no room for")
+	}
+	
+	stopA()
+	stopA()
+	if _, open := <-a; open {
+		t.Error("the stream stayed open after it was stopped")
+	}
+	bus.Publish(PeerConnected{"c"})
+	if e := <-b; e != (Lagged{1}) {
+		t.Errorf("got %v after another stream stopped, want the missed event counted", e)
+	}
+}
+
+func TestConnectBlockEvents(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, _ := bc.GetBlock(bc.Tip())
+	block := NewBlock(bc.engine, []*Transaction{NewCoinbaseTx(address(wallet), "")}, &genesis)
+	
+	// handlers see the UTXO set with the block in it
+	inUTXOSet := false
+	events.OnBlockConnected(func(e BlockConnected) {
+		if e.Chain == bc {
+			_, inUTXOSet = UTXOSet{bc}.FindOutput(e.Block.Transactions[0].ID, 0)
+		}
+	})
+	ch, stop := events.Stream(16)
+	defer stop()
+	next := func() interface{} {
+		for e := range ch {
+			if _, ok := e.(UTXOSetChanged); !ok {
+				return e
+			}
+		}
+		return nil
+	}
+	
+	if err := bc.ConnectBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := next().(BlockConnected); !ok || !bytes.Equal(e.Block.Hash, block.Hash) {
+		t.Fatalf("got %v, want the block connected", e)
+	}
+	if e, ok := next().(TipChanged); !ok || !bytes.Equal(e.Tip.Hash, block.Hash) {
+		t.Fatalf("got %v, want the tip changed to the block", e)
+	}
+	if !inUTXOSet {
+		t.Error("the block was published before the UTXO set took it in")
+	}
+	
+	// the filter index follows the best chain
+	if _, err := bc.GetCFilter(block.Hash); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMempoolEvents(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, _ := bc.GetBlock(bc.Tip())
+	funding := genesis.Transactions[0]
+	tx := newTestTx(wallet, funding, []int{0}, activeNet.Subsidy)
+	child := newTestTx(wallet, tx, []int{0}, activeNet.Subsidy)
+	
+	ch, stop := events.Stream(16)
+	defer stop()
+	
+	for _, ptx := range []*Transaction{tx, child} {
+		if err := mempool.Accept(bc, *ptx); err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := (<-ch).(TxAccepted); !ok || !bytes.Equal(e.Tx.ID, ptx.ID) {
+			t.Fatalf("got %v, want the transaction accepted", e)
+		}
+	}
+	
+	// a block spending the output tx spends evicts it and its child
+	conflict := newTestTx(wallet, funding, []int{0}, 1, activeNet.Subsidy-1)
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTx(address(wallet), ""), conflict})
+	removed := make(map[string]bool)
+	for len(ch) > 0 {
+		if e, ok := (<-ch).(TxRemoved); ok {
+			removed[hex.EncodeToString(e.Tx.ID)] = true
+		}
+	}
+	if len(removed) != 2 || !removed[hex.EncodeToString(tx.ID)] || !removed[hex.EncodeToString(child.ID)] || mempool.Count() != 0 {
+		t.Errorf("removed %v, want the conflicting transaction and its child", removed)
+	}
+	
+	mempool.RemoveBlock(block)
+	if len(ch) != 0 {
+		t.Error("removing transactions not in the mempool was published")
+	}
+}
+
+func TestStreamReportsMissedEvents(t *testing.T) {
+	bus := NewEventBus()
+	stream, stop := bus.Stream(1)
+	defer stop()
+	
+	for i := 0; i < 3; i++ {
+		bus.Publish(PeerConnected{"a"})
+	}
+	if e := <-stream; e != (PeerConnected{"a"}) {
+		t.Fatalf("got %v, want the first event", e)
+	}
+	
+	bus.Publish(PeerConnected{"b"})
+	if e := <-stream; e != (Lagged{2}) {
+		t.Fatalf("got %v, want the two missed events counted", e)
+	}
+	bus.Publish(PeerConnected{"c"})
+	if e := <-stream; e != (Lagged{1}) {
+		t.Fatalf("got %v, want the event missed while the lag was reported", e)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// parameters of the Golomb-coded sets, as in BIP158: remainders take gcsP
+// bits and one in gcsM lookups of an item not in the set matches
+const (
+	gcsP = 19
+	gcsM = 784931
+)
+
+// GCSFilter is a Golomb-coded set: the sorted SipHash values of its items
+// mapped to [0, N*M), stored as Golomb-Rice coded differences. It is smaller
+// than a bloom filter with the same false positive rate but can't be added to
+// once built.
+type GCSFilter struct {
+	N    int
+	Data []byte
+}
+
+// BuildGCSFilter puts items into a new filter, key is the SipHash key
+func BuildGCSFilter(key [16]byte, items [][]byte) *GCSFilter {
+	unique := make(map[string]bool)
+	for _, item := range items {
+		unique[string(item)] = true
+	}
+	
+	f := &GCSFilter{N: len(unique)}
+	var values []uint64
+	for item := range unique {
+		values = append(values, f.hashItem(key, []byte(item)))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	
+	var w bitWriter
+	last := uint64(0)
+	for _, value := range values {
+		delta := value - last
+		last = value
+		
+		// quotient in unary, then the remainder
+		for q := delta >> gcsP; q > 0; q-- {
+			w.writeBit(true)
+		}
+		w.writeBit(false)
+		w.writeBits(delta, gcsP)
+	}
+	f.Data = w.data
+	
+	return f
+}
+
+// hashItem maps item to [0, N*M) without a modulo
+func (f *GCSFilter) hashItem(key [16]byte, item []byte) uint64 {
+	hash := sipHash(binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:]), item)
+	hi, _ := bits.Mul64(hash, uint64(f.N)*gcsM)
+	
+	return hi
+}
+
+// Match tells whether item may be in the filter
+func (f *GCSFilter) Match(key [16]byte, item []byte) bool {
+	return f.MatchAny(key, [][]byte{item})
+}
+
+// MatchAny tells whether any of items may be in the filter, walking the set once
+func (f *GCSFilter) MatchAny(key [16]byte, items [][]byte) bool {
+	if f.N == 0 || len(items) == 0 {
+		return false
+	}
+	
+	var targets []uint64
+	for _, item := range items {
+		targets = append(targets, f.hashItem(key, item))
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+	
+	r := bitReader{data: f.Data}
+	value := uint64(0)
+	for i := 0; i < f.N; i++ {
+		delta, err := r.readGolombRice()
+		if err != nil {
+			return false
+		}
+		value += delta
+		
+		for len(targets) > 0 && targets[0] < value {
+			targets = targets[1:]
+		}
+		if len(targets) == 0 {
+			return false
+		}
+		if targets[0] == value {
+			return true
+		}
+	}
+	
+	return false
+}
+
+// Bytes is the number of items followed by the coded set
+func (f *GCSFilter) Bytes() []byte {
+	var n [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(n[:], uint64(f.N))
+	
+	return append(n[:size], f.Data...)
+}
+
+func ParseGCSFilter(data []byte) (*GCSFilter, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 {
+		return nil, errors.New("malformed filter")
+	}
+	
+	return &GCSFilter{int(n), data[size:]}, nil
+}
+
+type bitWriter struct {
+	data []byte
+	// bits used in the last byte
+	used uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used%8 == 0 {
+		w.data = append(w.data, 0)
+		w.used = 0
+	}
+	if bit {
+		w.data[len(w.data)-1] |= 0x80 >> w.used
+	}
+	w.used++
+}
+
+// writeBits writes the count low bits of value, the highest first
+func (w *bitWriter) writeBits(value uint64, count int) {
+	for i := count - 1; i >= 0; i-- {
+		w.writeBit(value>>uint(i)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	data []byte
+	pos  uint
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= uint(len(r.data))*8 {
+		return false, errors.New("read past the end of the filter")
+	}
+	bit := r.data[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+	
+	return bit, nil
+}
+
+func (r *bitReader) readGolombRice() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		q++
+	}
+	
+	value := q << gcsP
+	for i := gcsP - 1; i >= 0; i-- {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			value |= 1 << uint(i)
+		}
+	}
+	
+	return value, nil
+}
+
+// sipHash is SipHash-2-4 of data with the key k0, k1
+func sipHash(k0, k1 uint64, data []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	compress := func(m uint64) {
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	
+	length := len(data)
+	for len(data) >= 8 {
+		compress(binary.LittleEndian.Uint64(data))
+		data = data[8:]
+	}
+	
+	// the last block holds the remaining bytes and the length
+	var last [8]byte
+	copy(last[:], data)
+	last[7] = byte(length)
+	compress(binary.LittleEndian.Uint64(last[:]))
+	
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func TestSipHash(t *testing.T) {
+	// vectors of the SipHash-2-4 paper, key 00 01 .. 0f and messages 00 01 ..
+	tests := []struct {
+		size int
+		want uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{1, 0x74f839c593dc67fd},
+		{8, 0x93f5f5799a932462},
+	}
+	
+	for _, test := range tests {
+		data := make([]byte, test.size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		if got := sipHash(0x0706050403020100, 0x0f0e0d0c0b0a0908, data); got != test.want {
+			t.Errorf("hash of %d bytes is %x, want %x", test.size, got, test.want)
+		}
+	}
+}
+
+func TestGCSFilter(t *testing.T) {
+	key := [16]byte{1, 2, 3}
+	var items [][]byte
+	for i := 0; i < 200; i++ {
+		items = append(items, []byte(fmt.Sprintf("in %d", i)))
+	}
+	filter := BuildGCSFilter(key, append(items, items[0]))
+	if filter.N != len(items) {
+		t.Fatalf("filter holds %d items, want %d", filter.N, len(items))
+	}
+	
+	parsed, err := ParseGCSFilter(filter.Bytes())
+	if err != nil || parsed.N != filter.N || !bytes.Equal(parsed.Data, filter.Data) {
+		t.Fatalf("filter didn't survive serialization: %v", err)
+	}
+	for _, item := range items {
+		if !parsed.Match(key, item) {
+			t.Fatalf("%s is missing", item)
+		}
+	}
+	
+	matched := 0
+	for i := 0; i < 10000; i++ {
+		if parsed.Match(key, []byte(fmt.Sprintf("out %d", i))) {
+			matched++
+		}
+	}
+	if matched > 2 {
+		t.Errorf("%d of 10000 other items matched", matched)
+	}
+	if parsed.Match([16]byte{4, 5, 6}, items[0]) {
+		t.Error("an item matched under another key")
+	}
+	
+	if !parsed.MatchAny(key, [][]byte{[]byte("out 1"), items[100], []byte("out 2")}) {
+		t.Error("MatchAny missed an item of the filter")
+	}
+	if parsed.MatchAny(key, [][]byte{[]byte("out 1"), []byte("out 2")}) {
+		t.Error("MatchAny matched items not in the filter")
+	}
+	
+	empty := BuildGCSFilter(key, nil)
+	if empty.Match(key, items[0]) {
+		t.Error("an empty filter matched")
+	}
+	if _, err := ParseGCSFilter(nil); err == nil {
+		t.Error("parsed a filter without its size")
+	}
+}
+
+func TestBlockFilters(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, _ := bc.GetBlock(bc.Tip())
+	funding := genesis.Transactions[0]
+	tx := newTestTx(wallet, funding, []int{0}, activeNet.Subsidy)
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTx(address(NewWallet()), ""), tx})
+	
+	data, err := bc.GetCFilter(block.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := ParseGCSFilter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := blockFilterKey(block.Hash)
+	if !filter.Match(key, HashPubKey(wallet.PublicKey)) || !filter.Match(key, outpointBytes(funding.ID, 0)) {
+		t.Error("the filter misses the output or the spent outpoint of the block")
+	}
+	if filter.Match(key, outpointBytes(funding.ID, 1)) {
+		t.Error("the filter matched an outpoint the block doesn't spend")
+	}
+	
+	genesisHeader, err := bc.GetCFHeader(genesis.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := bc.GetCFHeader(block.Hash)
+	if err != nil || !bytes.Equal(header, filterHeader(data, genesisHeader)) {
+		t.Errorf("filter header %x doesn't commit to the filter and the one before: %v", header, err)
+	}
+	genesisFilter, _ := bc.GetCFilter(genesis.Hash)
+	if !bytes.Equal(genesisHeader, filterHeader(genesisFilter, make([]byte, sha256.Size))) {
+		t.Error("the genesis filter header doesn't start from zero")
+	}
+	
+	hashes, err := bc.blockRange(0, block.Hash, 2)
+	if err != nil || len(hashes) != 2 || !bytes.Equal(hashes[0], genesis.Hash) || !bytes.Equal(hashes[1], block.Hash) {
+		t.Errorf("range %x, want the genesis block and the new one: %v", hashes, err)
+	}
+	if _, err := bc.blockRange(0, block.Hash, 1); err == nil {
+		t.Error("served a range over the limit")
+	}
+	if _, err := bc.blockRange(2, block.Hash, 2); err == nil {
+		t.Error("served a range starting after its stop block")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// secrets of hash time-locked contracts are 32 random bytes
+const htlcSecretSize = 32
+
+// HTLC is a hash time-locked contract. Recipient can take the coins paid to
+// the contract by revealing the preimage of SecretHash, after LockTime Refund
+// can take them back instead.
+type HTLC struct {
+	SecretHash []byte
+	Recipient  []byte
+	Refund     []byte
+	LockTime   int64
+}
+
+// Script is the redeem script of the contract:
+//
+//	OP_IF
+//	    OP_SIZE 32 OP_EQUALVERIFY
+//	    OP_SHA256 <secret hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipient>
+//	OP_ELSE
+//	    <lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <refund>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+//
+// The size check keeps the recipient from redeeming with a secret the other
+// chain of a swap won't take.
+func (c *HTLC) Script() []byte {
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt(htlcSecretSize).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(c.SecretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(c.Recipient).
+		AddOp(OP_ELSE).
+		AddInt(c.LockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(c.Refund).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// ParseHTLC reads a contract back from its redeem script
+func ParseHTLC(script []byte) (*HTLC, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+	
+	pattern := []byte{
+		OP_IF, OP_SIZE, 0, OP_EQUALVERIFY, OP_SHA256, 0, OP_EQUALVERIFY, OP_DUP, OP_HASH160, 0,
+		OP_ELSE, 0, OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_DUP, OP_HASH160, 0,
+		OP_ENDIF, OP_EQUALVERIFY, OP_CHECKSIG,
+	}
+	if len(ops) != len(pattern) {
+		return nil, errors.New("not a hash time-locked contract")
+	}
+	for i, opcode := range pattern {
+		// 0 marks the pushes
+		if opcode != 0 && ops[i].opcode != opcode {
+			return nil, errors.New("not a hash time-locked contract")
+		}
+	}
+	
+	lockTime, err := decodeScriptNum(ops[11].data, maxLockTimeSize)
+	if err != nil {
+		return nil, err
+	}
+	// rebuilding the script also checks the secret size it requires
+	c := &HTLC{ops[5].data, ops[9].data, ops[16].data, lockTime}
+	if len(c.SecretHash) != sha256.Size || bytes.Compare(c.Script(), script) != 0 {
+		return nil, errors.New("not a hash time-locked contract")
+	}
+	
+	return c, nil
+}
+
+// Address is the script hash address the contract is funded through
+func (c *HTLC) Address() string {
+	return ScriptAddress(c.Script())
+}
+
+// Funds returns the total value paid to the contract and not spent yet
+func (c *HTLC) Funds(UTXOSet *UTXOSet) int {
+	total := 0
+	for _, out := range UTXOSet.FindUTXO(HashPubKey(c.Script())) {
+		total += out.Value
+	}
+	
+	return total
+}
+
+// NewHTLCSpend takes every output paid to the contract and sends it, less fee,
+// to the address of wallet. With secret it redeems as the recipient, without
+// it refunds as the sender, which only works after the lock time.
+func NewHTLCSpend(c *HTLC, wallet *Wallet, secret []byte, fee int, UTXOSet *UTXOSet) (*Transaction, error) {
+	script := c.Script()
+	
+	owner := c.Refund
+	if secret != nil {
+		owner = c.Recipient
+		hash := sha256.Sum256(secret)
+		if len(secret) != htlcSecretSize || bytes.Compare(hash[:], c.SecretHash) != 0 {
+			return nil, errors.New("the secret doesn't match the contract")
+		}
+	}
+	if bytes.Compare(HashPubKey(wallet.PublicKey), owner) != 0 {
+		return nil, errors.New("the wallet key can't spend this branch of the contract")
+	}
+	
+	var inputs []TxInput
+	amount, spendable := UTXOSet.FindSpendableOutputs(HashPubKey(script), math.MaxInt, nil)
+	for txid, outs := range spendable {
+		txID, err := hex.DecodeString(txid)
+		if err != nil {
+			return nil, err
+		}
+		
+		for _, out := range outs {
+			inputs = append(inputs, TxInput{txID, out, nil, nil, nil, 0})
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, errors.New("the contract is not funded")
+	}
+	if fee < 0 {
+		return nil, errors.New("the fee can't be negative")
+	}
+	if fee >= amount {
+		return nil, fmt.Errorf("a fee of %d doesn't leave anything of the %d locked in the contract", fee, amount)
+	}
+	
+	tx := Transaction{nil, inputs, []TxOutput{*NewTxOutput(amount-fee, string(wallet.GetAddress()))}, 0}
+	if secret == nil {
+		tx.LockTime = c.LockTime
+	}
+	tx.ID = tx.Hash()
+	
+	for inID := range tx.Vin {
+		signature := signHash(wallet.PrivateKey, tx.sigHash(inID, script))
+		builder := NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey)
+		if secret != nil {
+			builder.AddData(secret).AddInt(1)
+		} else {
+			builder.AddInt(0)
+		}
+		tx.Vin[inID].ScriptSig = builder.AddData(script).Script()
+	}
+	
+	return &tx, nil
+}
+
+// FindHTLCSecret looks through the chain for a redeem of the contract and
+// returns the secret it revealed
+func (bc *BlockChain) FindHTLCSecret(c *HTLC) ([]byte, error) {
+	script := c.Script()
+	bci := bc.Iterator()
+	
+	for {
+		block := bci.Next()
+		
+		for _, tx := range block.Transactions {
+			for _, vin := range tx.Vin {
+				ops, err := parseScript(vin.ScriptSig)
+				if err != nil || len(ops) != 5 || bytes.Compare(ops[4].data, script) != 0 {
+					continue
+				}
+				
+				secret := ops[2].data
+				hash := sha256.Sum256(secret)
+				if bytes.Compare(hash[:], c.SecretHash) == 0 {
+					return secret, nil
+				}
+			}
+		}
+		
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	
+	return nil, fmt.Errorf("no redeem of contract %s found", c.Address())
+}
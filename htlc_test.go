@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+// fundHTLC mines a transaction paying amount from wallet to the contract
+func fundHTLC(bc *BlockChain, wallet *Wallet, c *HTLC, amount int) {
+	tx := NewUTXOTransaction(wallet, c.Address(), amount, &UTXOSet{bc}, nil)
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(address(wallet), ""), tx})
+}
+
+func TestRedeemHTLC(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	recipient := NewWallet()
+	secret := bytes.Repeat([]byte{7}, htlcSecretSize)
+	hash := sha256.Sum256(secret)
+	c := &HTLC{hash[:], HashPubKey(recipient.PublicKey), HashPubKey(wallet.PublicKey), 1000}
+	fundHTLC(bc, wallet, c, 5)
+	
+	if c.Funds(&UTXOSet{bc}) != 5 {
+		t.Fatalf("contract holds %d, want 5", c.Funds(&UTXOSet{bc}))
+	}
+	if _, err := NewHTLCSpend(c, recipient, bytes.Repeat([]byte{8}, htlcSecretSize), 1, &UTXOSet{bc}); err == nil {
+		t.Error("redeemed with the wrong secret")
+	}
+	if _, err := NewHTLCSpend(c, wallet, secret, 1, &UTXOSet{bc}); err == nil {
+		t.Error("the sender redeemed with the secret")
+	}
+	
+	tx, err := NewHTLCSpend(c, recipient, secret, 1, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mempool.Accept(bc, *tx); err != nil {
+		t.Fatal(err)
+	}
+	
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(address(wallet), ""), tx})
+	if found, err := bc.FindHTLCSecret(c); err != nil || bytes.Compare(found, secret) != 0 {
+		t.Errorf("found secret %x, want %x", found, secret)
+	}
+}
+
+func TestRedeemHTLCPaysFee(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	secret := bytes.Repeat([]byte{7}, htlcSecretSize)
+	hash := sha256.Sum256(secret)
+	c := &HTLC{hash[:], HashPubKey(wallet.PublicKey), HashPubKey(wallet.PublicKey), time.Now().Unix()}
+	fundHTLC(bc, wallet, c, 5)
+	
+	if _, err := NewHTLCSpend(c, wallet, secret, 5, &UTXOSet{bc}); err == nil {
+		t.Error("the fee took every coin of the contract")
+	}
+	tx, err := NewHTLCSpend(c, wallet, secret, 2, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Vout[0].Value != 3 {
+		t.Errorf("redeemed %d, want 3 after the fee", tx.Vout[0].Value)
+	}
+	if err := mempool.Accept(bc, *tx); err != nil {
+		t.Fatal(err)
+	}
+	
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(address(wallet), ""), tx})
+	if found, err := bc.FindHTLCSecret(c); err != nil || bytes.Compare(found, secret) != 0 {
+		t.Errorf("found secret %x, want %x", found, secret)
+	}
+}
+
+func TestHTLCRequiresSecretSize(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	secret := bytes.Repeat([]byte{7}, htlcSecretSize+1)
+	hash := sha256.Sum256(secret)
+	c := &HTLC{hash[:], HashPubKey(wallet.PublicKey), HashPubKey(wallet.PublicKey), time.Now().Unix()}
+	fundHTLC(bc, wallet, c, 5)
+	
+	if _, err := NewHTLCSpend(c, wallet, secret, 0, &UTXOSet{bc}); err == nil {
+		t.Fatal("spent with a secret of the wrong size")
+	}
+	
+	// the script itself refuses it too
+	prevOut := TxOutput{5, HashPubKey(c.Script()), PayToScriptHashScript(HashPubKey(c.Script()))}
+	tx := Transaction{nil, []TxInput{{make([]byte, 32), 0, nil, nil, nil, 0}}, []TxOutput{*NewTxOutput(5, address(wallet))}, 0}
+	signature := signHash(wallet.PrivateKey, tx.sigHash(0, c.Script()))
+	tx.Vin[0].ScriptSig = NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey).AddData(secret).AddInt(1).AddData(c.Script()).Script()
+	if err := VerifyInput(&tx, 0, prevOut); err == nil {
+		t.Error("the contract took a secret of the wrong size")
+	}
+}
+
+func TestRefundHTLC(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	secret := bytes.Repeat([]byte{7}, htlcSecretSize)
+	hash := sha256.Sum256(secret)
+	c := &HTLC{hash[:], HashPubKey(NewWallet().PublicKey), HashPubKey(wallet.PublicKey), 3}
+	fundHTLC(bc, wallet, c, 5)
+	
+	tx, err := NewHTLCSpend(c, wallet, nil, 1, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.LockTime != c.LockTime {
+		t.Fatalf("refund has lock time %d, want the one of the contract", tx.LockTime)
+	}
+	if err := mempool.Accept(bc, *tx); err == nil {
+		t.Fatal("the refund was accepted before the lock time")
+	}
+	
+	bc.Generate(2, address(wallet))
+	if err := mempool.Accept(bc, *tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.FindHTLCSecret(c); err == nil {
+		t.Error("found a secret without a redeem")
+	}
+}
+
+func TestParseHTLC(t *testing.T) {
+	c := &HTLC{make([]byte, sha256.Size), make([]byte, 20), bytes.Repeat([]byte{1}, 20), 1700000000}
+	parsed, err := ParseHTLC(c.Script())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.LockTime != c.LockTime || bytes.Compare(parsed.Refund, c.Refund) != 0 {
+		t.Errorf("parsed %+v, want %+v", parsed, c)
+	}
+	
+	// the old contracts without the size check aren't taken
+	script := c.Script()
+	if _, err := ParseHTLC(append([]byte{OP_IF}, script[5:]...)); err == nil {
+		t.Error("parsed a contract without the secret size check")
+	}
+	if _, err := ParseHTLC(PayToPubKeyHashScript(c.Recipient)); err == nil {
+		t.Error("parsed a key hash script as a contract")
+	}
+	short := &HTLC{make([]byte, 20), c.Recipient, c.Refund, c.LockTime}
+	if _, err := ParseHTLC(short.Script()); err == nil {
+		t.Error("parsed a contract with a short secret hash")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// lock times below this are block heights, the others unix timestamps
+const lockTimeThreshold = 500000000
+
+// relative locks in TxInput.Sequence. 0 means no lock, the low 16 bits hold
+// the lock and the type flag tells blocks from units of 512 seconds.
+const (
+	sequenceLockTimeIsSeconds   = 1 << 22
+	sequenceLockTimeMask        = 0x0000ffff
+	sequenceLockTimeGranularity = 9
+)
+
+// number of blocks whose median timestamp is the time locks are checked against
+const medianTimeBlocks = 11
+
+// IsFinal tells whether tx may go into a block at height whose previous blocks
+// have the median time mtp
+func (tx *Transaction) IsFinal(height int, mtp int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	if tx.LockTime < lockTimeThreshold {
+		return tx.LockTime < int64(height)
+	}
+	
+	return tx.LockTime < mtp
+}
+
+// MedianTimePast is the median timestamp of the block hash and the ones before it
+func (bc *BlockChain) MedianTimePast(hash []byte) int64 {
+	var timestamps []int64
+	
+	for len(hash) > 0 && len(timestamps) < medianTimeBlocks {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		
+		timestamps = append(timestamps, block.Timestamp)
+		hash = block.PrevBlockHash
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	
+	return timestamps[len(timestamps)/2]
+}
+
+// CheckLocks applies the lock time of tx and the relative locks of its inputs
+// to a block at height whose previous blocks have the median time mtp. Inputs
+// spending outputs that are not in the UTXO set yet count as confirmed by that
+// block.
+func (bc *BlockChain) CheckLocks(tx *Transaction, height int, mtp int64) error {
+	if !tx.IsFinal(height, mtp) {
+		return fmt.Errorf("transaction %x is locked until after %d", tx.ID, tx.LockTime)
+	}
+	if tx.IsCoinbase() {
+		return nil
+	}
+	
+	UTXOSet := UTXOSet{bc}
+	for _, vin := range tx.Vin {
+		if vin.Sequence == 0 {
+			continue
+		}
+		
+		confHeight, confTime := height, mtp
+		if outs, ok := UTXOSet.FindOutputs(vin.Txid); ok {
+			confHeight, confTime = outs.Height, outs.Time
+		}
+		
+		lock := int64(vin.Sequence & sequenceLockTimeMask)
+		if vin.Sequence&sequenceLockTimeIsSeconds != 0 {
+			if mtp < confTime+lock<<sequenceLockTimeGranularity {
+				return fmt.Errorf("transaction %x spends an output locked for %d seconds", tx.ID, lock<<sequenceLockTimeGranularity)
+			}
+		} else if int64(height) < int64(confHeight)+lock {
+			return fmt.Errorf("transaction %x spends an output locked for %d blocks", tx.ID, lock)
+		}
+	}
+	
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// lockedSpend spends output vout of prev, locked to w, with the given locks
+func lockedSpend(w *Wallet, prev *Transaction, vout int, lockTime int64, sequence uint32) *Transaction {
+	tx := &Transaction{
+		Vin:      []TxInput{{Txid: prev.ID, Vout: vout, PubKey: w.PublicKey, Sequence: sequence}},
+		Vout:     []TxOutput{*NewTxOutput(prev.Vout[vout].Value, address(w))},
+		LockTime: lockTime,
+	}
+	tx.ID = tx.Hash()
+	tx.Sign(w.PrivateKey, poolOf(prev))
+	
+	return tx
+}
+
+func TestIsFinal(t *testing.T) {
+	tests := []struct {
+		lockTime int64
+		height   int
+		mtp      int64
+		final    bool
+	}{
+		{0, 0, 0, true},
+		{5, 5, 0, false},
+		{5, 6, 0, true},
+		{lockTimeThreshold + 100, 1000, lockTimeThreshold + 100, false},
+		{lockTimeThreshold + 100, 0, lockTimeThreshold + 101, true},
+	}
+	
+	for _, test := range tests {
+		tx := &Transaction{LockTime: test.lockTime}
+		if tx.IsFinal(test.height, test.mtp) != test.final {
+			t.Errorf("lock time %d at height %d and time %d: final %v, want %v", test.lockTime, test.height, test.mtp, !test.final, test.final)
+		}
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	start := activeNet.GenesisTimestamp
+	
+	for _, offset := range []int64{50, 10, 30} {
+		addTestBlockAt(bc, start+offset, NewCoinbaseTx(address(wallet), ""))
+	}
+	if mtp := bc.MedianTimePast(bc.Tip()); mtp != start+30 {
+		t.Errorf("median time %d, want %d", mtp-start, 30)
+	}
+	
+	// only the last blocks count
+	for i := int64(0); i < medianTimeBlocks; i++ {
+		addTestBlockAt(bc, start+1000+i, NewCoinbaseTx(address(wallet), ""))
+	}
+	if mtp := bc.MedianTimePast(bc.Tip()); mtp != start+1000+medianTimeBlocks/2 {
+		t.Errorf("median time %d, want %d", mtp-start, 1000+medianTimeBlocks/2)
+	}
+}
+
+func TestCheckLocks(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	start := activeNet.GenesisTimestamp
+	funding := NewCoinbaseTx(address(wallet), "")
+	addTestBlockAt(bc, start+1000, funding)
+	
+	// the funding output was confirmed at height 1 with the median time of the genesis block
+	tests := []struct {
+		name     string
+		lockTime int64
+		sequence uint32
+		height   int
+		mtp      int64
+		ok       bool
+	}{
+		{"height lock", 3, 0, 3, start, false},
+		{"height lock over", 3, 0, 4, start, true},
+		{"time lock", start + 10, 0, 10, start + 10, false},
+		{"time lock over", start + 10, 0, 10, start + 11, true},
+		{"blocks", 0, 3, 3, start, false},
+		{"blocks over", 0, 3, 4, start, true},
+		{"seconds", 0, sequenceLockTimeIsSeconds | 2, 10, start + 1023, false},
+		{"seconds over", 0, sequenceLockTimeIsSeconds | 2, 10, start + 1024, true},
+	}
+	
+	for _, test := range tests {
+		tx := lockedSpend(wallet, funding, 0, test.lockTime, test.sequence)
+		err := bc.CheckLocks(tx, test.height, test.mtp)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+	
+	// an output confirmed in the same block can't satisfy a relative lock
+	parent := lockedSpend(wallet, funding, 0, 0, 0)
+	child := lockedSpend(wallet, parent, 0, 0, 1)
+	if err := bc.CheckLocks(child, 100, start+100); err == nil {
+		t.Error("spent an unconfirmed output with a relative lock")
+	}
+}
+
+func TestBlockWithLockedTransaction(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	tx := lockedSpend(wallet, genesis.Transactions[0], 0, 1, 0)
+	block, err := NewBlockContext(context.Background(), bc.engine, []*Transaction{NewCoinbaseTx(address(wallet), ""), tx}, &genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.ConnectBlock(block); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("got %v connecting a block with a transaction locked until after its height", err)
+	}
+	
+	if err := mempool.Accept(bc, *tx); err == nil {
+		t.Error("the mempool accepted a transaction that can't go into the next block")
+	}
+	if _, err := bc.MineBlockContext(context.Background(), []*Transaction{NewCoinbaseTx(address(wallet), ""), tx}); err == nil {
+		t.Error("mined a block with a transaction locked until after its height")
+	}
+}
+
+func TestLockTimeOpcodes(t *testing.T) {
+	cltv := NewScriptBuilder().AddInt(10).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).AddInt(1).Script()
+	csv := NewScriptBuilder().AddInt(5).AddOp(OP_CHECKSEQUENCEVERIFY).AddOp(OP_DROP).AddInt(1).Script()
+	
+	tests := []struct {
+		name     string
+		locking  []byte
+		lockTime int64
+		sequence uint32
+		ok       bool
+	}{
+		{"cltv", cltv, 10, 0, true},
+		{"cltv early", cltv, 9, 0, false},
+		{"cltv time lock", cltv, lockTimeThreshold + 10, 0, false},
+		{"csv", csv, 0, 5, true},
+		{"csv early", csv, 0, 4, false},
+		{"csv seconds", csv, 0, sequenceLockTimeIsSeconds | 5, false},
+	}
+	
+	for _, test := range tests {
+		tx := &Transaction{
+			Vin:      []TxInput{{Txid: make([]byte, 32), ScriptSig: NewScriptBuilder().AddInt(1).Script(), Sequence: test.sequence}},
+			LockTime: test.lockTime,
+		}
+		err := VerifyInput(tx, 0, TxOutput{Script: test.locking})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// TxPool holds the transactions waiting to be mined. Connection handlers and
+// the miner use it concurrently.
+type TxPool struct {
+	mu  sync.RWMutex
+	txs map[string]Transaction
+	// held while a transaction is checked against the pool and added to it
+	accept sync.Mutex
+}
+
+// mined transactions leave the pool, and so do the ones the block made invalid.
+// The transactions of a block a reorganization took out come back unless the
+// new chain spends their inputs already.
+func init() {
+	events.OnBlockConnected(func(e BlockConnected) {
+		mempool.RemoveBlock(e.Block)
+	})
+	events.OnBlockDisconnected(func(e BlockDisconnected) {
+		for _, tx := range e.Block.Transactions {
+			if !tx.IsCoinbase() {
+				mempool.Accept(e.Chain, *tx)
+			}
+		}
+	})
+}
+
+func NewTxPool() *TxPool {
+	return &TxPool{txs: make(map[string]Transaction)}
+}
+
+func (p *TxPool) Add(tx Transaction) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	
+	p.txs[hex.EncodeToString(tx.ID)] = tx
+}
+
+// Accept adds tx to the pool if it could go into the next block of bc
+func (p *TxPool) Accept(bc *BlockChain, tx Transaction) error {
+	p.accept.Lock()
+	defer p.accept.Unlock()
+	
+	pool := p.Snapshot()
+	if _, ok := pool[hex.EncodeToString(tx.ID)]; ok {
+		return errors.New("transaction is already in the mempool")
+	}
+	if !bc.VerifyTransactionWith(&tx, pool) {
+		return errors.New("invalid transaction")
+	}
+	
+	err := tx.CheckDataOutputs()
+	if err != nil {
+		return err
+	}
+	
+	err = tx.CheckOutputLocks()
+	if err != nil {
+		return err
+	}
+	
+	err = checkConflicts(bc, &tx, pool)
+	if err != nil {
+		return err
+	}
+	
+	err = bc.CheckLocks(&tx, bc.GetBestHeight()+1, bc.MedianTimePast(bc.Tip()))
+	if err != nil {
+		return err
+	}
+	
+	p.Add(tx)
+	events.Publish(TxAccepted{&tx})
+	return nil
+}
+
+// checkConflicts makes sure every input of tx spends an output that is either
+// unspent in the UTXO set or created by a transaction of pool, and that no
+// transaction of pool spends it already
+func checkConflicts(bc *BlockChain, tx *Transaction, pool map[string]Transaction) error {
+	spent := make(map[string]bool)
+	for _, ptx := range pool {
+		for _, vin := range ptx.Vin {
+			spent[outpointKey(vin.Txid, vin.Vout)] = true
+		}
+	}
+	
+	UTXOSet := UTXOSet{bc}
+	for _, vin := range tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		if spent[key] {
+			return fmt.Errorf("output %s is already spent by a transaction in the mempool", key)
+		}
+		spent[key] = true
+		
+		if _, ok := pool[hex.EncodeToString(vin.Txid)]; ok {
+			continue
+		}
+		if _, ok := UTXOSet.FindOutput(vin.Txid, vin.Vout); !ok {
+			return fmt.Errorf("output %s is spent or doesn't exist", key)
+		}
+	}
+	
+	return nil
+}
+
+func (p *TxPool) Get(txid string) (Transaction, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	tx, ok := p.txs[txid]
+	return tx, ok
+}
+
+func (p *TxPool) Has(txid string) bool {
+	_, ok := p.Get(txid)
+	return ok
+}
+
+// RemoveBlock takes out the transactions of block, the ones spending an output
+// a transaction of block spends and the descendants of those
+func (p *TxPool) RemoveBlock(block *Block) {
+	mined := make(map[string]bool)
+	spent := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		mined[hex.EncodeToString(tx.ID)] = true
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			spent[outpointKey(vin.Txid, vin.Vout)] = true
+		}
+	}
+	
+	var removed []*Transaction
+	evicted := make(map[string]bool)
+	
+	p.mu.Lock()
+	for txid, tx := range p.txs {
+		if mined[txid] {
+			tx := tx
+			delete(p.txs, txid)
+			removed = append(removed, &tx)
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if spent[outpointKey(vin.Txid, vin.Vout)] {
+				evicted[txid] = true
+				break
+			}
+		}
+	}
+	// children of evicted transactions spend outputs that will never exist
+	for changed := true; changed; {
+		changed = false
+		for txid, tx := range p.txs {
+			if evicted[txid] {
+				continue
+			}
+			for _, vin := range tx.Vin {
+				if evicted[hex.EncodeToString(vin.Txid)] {
+					evicted[txid] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	for txid := range evicted {
+		tx := p.txs[txid]
+		delete(p.txs, txid)
+		removed = append(removed, &tx)
+	}
+	p.mu.Unlock()
+	
+	for _, tx := range removed {
+		events.Publish(TxRemoved{tx})
+	}
+}
+
+func (p *TxPool) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	return len(p.txs)
+}
+
+// Snapshot returns a copy of the pool that is safe to use without locking
+func (p *TxPool) Snapshot() map[string]Transaction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	txs := make(map[string]Transaction, len(p.txs))
+	for txid, tx := range p.txs {
+		txs[txid] = tx
+	}
+	
+	return txs
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestTxPoolSnapshotIsACopy(t *testing.T) {
+	wallet := NewWallet()
+	first := NewCoinbaseTx(address(wallet), "first")
+	second := NewCoinbaseTx(address(wallet), "second")
+	
+	pool := NewTxPool()
+	pool.Add(*first)
+	snapshot := pool.Snapshot()
+	pool.Add(*second)
+	
+	if len(snapshot) != 1 || pool.Count() != 2 {
+		t.Fatalf("snapshot has %d and pool %d transactions, want 1 and 2", len(snapshot), pool.Count())
+	}
+	
+	pool.RemoveBlock(&Block{Transactions: []*Transaction{first}})
+	if pool.Has(hex.EncodeToString(first.ID)) || !pool.Has(hex.EncodeToString(second.ID)) {
+		t.Error("RemoveBlock dropped the wrong transactions")
+	}
+	if _, ok := snapshot[hex.EncodeToString(first.ID)]; !ok {
+		t.Error("RemoveBlock changed an earlier snapshot")
+	}
+}
+
+func TestMiningServiceNotificationsNeverBlock(t *testing.T) {
+	s := NewMiningService(nil, "", false)
+	
+	for i := 0; i < 3; i++ {
+		s.NotifyTx()
+		s.NotifyTip()
+	}
+	if len(s.newTx) != 1 || len(s.newTip) != 1 {
+		t.Errorf("%d transaction and %d tip notifications queued, want them coalesced into one", len(s.newTx), len(s.newTip))
+	}
+}
+
+func TestAcceptRejectsConflicts(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, _ := bc.GetBlock(bc.Tip())
+	funding := genesis.Transactions[0]
+	
+	tx := newTestTx(wallet, funding, []int{0}, activeNet.Subsidy)
+	if err := mempool.Accept(bc, *tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := mempool.Accept(bc, *tx); err == nil {
+		t.Error("accepted a transaction twice")
+	}
+	if err := mempool.Accept(bc, *newTestTx(wallet, funding, []int{0}, 1, activeNet.Subsidy-1)); err == nil {
+		t.Error("accepted a second spend of an output the pool spends")
+	}
+	if err := mempool.Accept(bc, *newTestTx(wallet, tx, []int{0}, activeNet.Subsidy)); err != nil {
+		t.Errorf("rejected a spend of a pool transaction: %v", err)
+	}
+	
+	mined := bc.Generate(1, address(wallet))[0].Transactions[0]
+	spend := newTestTx(wallet, mined, []int{0}, activeNet.Subsidy)
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(address(wallet), ""), spend})
+	if err := mempool.Accept(bc, *newTestTx(wallet, mined, []int{0}, 1, activeNet.Subsidy-1)); err == nil {
+		t.Error("accepted a spend of an output spent in the chain")
+	}
+}
@@ -1,9 +1,17 @@
 package main
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
+	// number of data items the tree was built from
+	Leaves int
+	// set when two sibling nodes have the same hash, see MerkleBuilder
+	Mutated bool
 }
 
 type MerkleNode struct {
@@ -16,12 +24,9 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
 	
 	if left == nil && right == nil {
-		hash := sha256.Sum256(data)
-		node.Data = hash[:]
+		node.Data = hashMerkleLeaf(data)
 	} else {
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		node.Data = hash[:]
+		node.Data = hashMerklePair(left.Data, right.Data)
 	}
 	
 	node.Left = left
@@ -30,31 +35,181 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
+// NewMerkleTree hashes data into a tree. A level with an odd number of nodes
+// pairs its last node with itself, including the leaves, so a single leaf is
+// hashed with itself too.
 func NewMerkleTree(data [][]byte) *MerkleTree {
-	var nodes []MerkleNode
-	
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+	tree := MerkleTree{Leaves: len(data)}
+	if len(data) == 0 {
+		return &tree
 	}
 	
+	var nodes []*MerkleNode
 	for _, datum := range data {
-		node := NewMerkleNode(nil, nil, datum)
-		nodes = append(nodes, *node)
+		nodes = append(nodes, NewMerkleNode(nil, nil, datum))
 	}
 	
-	for i:=0; i<len(data)/2; i++ {
-		var newLevel []MerkleNode
-		for j:=0; j<len(nodes); j+=2 {
-			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-			newLevel = append(newLevel, *node)
+	for {
+		paired := len(nodes)
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+		
+		var level []*MerkleNode
+		for i := 0; i < len(nodes); i += 2 {
+			if i+1 < paired && bytes.Compare(nodes[i].Data, nodes[i+1].Data) == 0 {
+				tree.Mutated = true
+			}
+			level = append(level, NewMerkleNode(nodes[i], nodes[i+1], nil))
 		}
+		nodes = level
 		
-		nodes = newLevel
+		if len(nodes) == 1 {
+			break
+		}
+	}
+	tree.RootNode = nodes[0]
+	
+	return &tree
+}
+
+// MerkleBuilder computes the root of the tree NewMerkleTree would build from
+// data added one item at a time. It only keeps the root of the last complete
+// subtree of each height, so memory grows with the height of the tree rather
+// than the number of leaves.
+//
+// Because odd levels repeat their last node, a list of transactions ending in
+// a repeated run, like [a b c] and [a b c c], has the same root as the list
+// without it. Such trees are reported as mutated: a block carrying one must be
+// rejected without blaming the block hash, which honest blocks share.
+type MerkleBuilder struct {
+	count   int
+	pending [][]byte
+	mutated bool
+}
+
+func NewMerkleBuilder() *MerkleBuilder {
+	return &MerkleBuilder{}
+}
+
+// Add hashes datum into the next leaf
+func (b *MerkleBuilder) Add(datum []byte) {
+	b.AddHash(hashMerkleLeaf(datum))
+}
+
+// AddHash adds a leaf that is hashed already
+func (b *MerkleBuilder) AddHash(hash []byte) {
+	b.count++
+	
+	// every trailing zero bit of count completes a subtree one level higher
+	level := 0
+	for b.count>>uint(level)&1 == 0 {
+		if bytes.Compare(b.pending[level], hash) == 0 {
+			b.mutated = true
+		}
+		hash = hashMerklePair(b.pending[level], hash)
+		b.pending[level] = nil
+		level++
 	}
 	
-	tree := MerkleTree{
-		&nodes[0],
+	if level == len(b.pending) {
+		b.pending = append(b.pending, nil)
+	}
+	b.pending[level] = hash
+}
+
+// Root is the merkle root of the leaves added so far, nil when there are none
+func (b *MerkleBuilder) Root() []byte {
+	if b.count == 0 {
+		return nil
 	}
 	
-	return &tree
-}
\ No newline at end of file
+	count, level := b.count, 0
+	for count>>uint(level)&1 == 0 {
+		level++
+	}
+	hash := b.pending[level]
+	if count == 1 {
+		return hashMerklePair(hash, hash)
+	}
+	
+	// pair the lowest incomplete subtree with itself until it completes and
+	// merge it with the pending subtrees it meets on the way up
+	for count != 1<<uint(level) {
+		hash = hashMerklePair(hash, hash)
+		count += 1 << uint(level)
+		level++
+		for count>>uint(level)&1 == 0 {
+			hash = hashMerklePair(b.pending[level], hash)
+			level++
+		}
+	}
+	
+	return hash
+}
+
+// Mutated tells whether two sibling subtrees had the same hash
+func (b *MerkleBuilder) Mutated() bool {
+	return b.mutated
+}
+
+// MerkleStep is a sibling hash on the way from a leaf up to the root
+type MerkleStep struct {
+	Hash []byte
+	// whether Hash goes on the left when the pair is hashed
+	Left bool
+}
+
+// Proof collects the siblings on the way from leaf index up to the root
+func (t *MerkleTree) Proof(index int) ([]MerkleStep, error) {
+	if index < 0 || index >= t.Leaves {
+		return nil, fmt.Errorf("the tree has no leaf %d", index)
+	}
+	
+	depth := 0
+	for node := t.RootNode; node.Left != nil; node = node.Left {
+		depth++
+	}
+	
+	// walk down following the bits of index and record the other child at each level
+	proof := make([]MerkleStep, depth)
+	node := t.RootNode
+	for level := depth - 1; level >= 0; level-- {
+		if index>>uint(level)&1 == 0 {
+			proof[level] = MerkleStep{node.Right.Data, false}
+			node = node.Left
+		} else {
+			proof[level] = MerkleStep{node.Left.Data, true}
+			node = node.Right
+		}
+	}
+	
+	return proof, nil
+}
+
+// VerifyMerkleProof checks that proof links the leaf hash to root
+func VerifyMerkleProof(root, leaf []byte, proof []MerkleStep) bool {
+	hash := leaf
+	for _, step := range proof {
+		if step.Left {
+			hash = hashMerklePair(step.Hash, hash)
+		} else {
+			hash = hashMerklePair(hash, step.Hash)
+		}
+	}
+	
+	return bytes.Compare(hash, root) == 0
+}
+
+// hashMerkleLeaf is the hash data goes into the tree with
+func hashMerkleLeaf(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	
+	return hash[:]
+}
+
+func hashMerklePair(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+	
+	return hash[:]
+}
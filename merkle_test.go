@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// largest number of leaves the properties are checked for, enough to cover a
+// few complete and many ragged trees
+const maxTestLeaves = 70
+
+func testLeaves(n int) [][]byte {
+	var data [][]byte
+	for i := 0; i < n; i++ {
+		data = append(data, []byte(fmt.Sprintf("transaction %d", i)))
+	}
+	
+	return data
+}
+
+func builderFor(data [][]byte) *MerkleBuilder {
+	builder := NewMerkleBuilder()
+	for _, datum := range data {
+		builder.Add(datum)
+	}
+	
+	return builder
+}
+
+func TestMerkleBuilderMatchesTree(t *testing.T) {
+	for n := 1; n <= maxTestLeaves; n++ {
+		data := testLeaves(n)
+		tree := NewMerkleTree(data)
+		builder := builderFor(data)
+		
+		if bytes.Compare(tree.RootNode.Data, builder.Root()) != 0 {
+			t.Errorf("%d leaves: tree root %x, builder root %x", n, tree.RootNode.Data, builder.Root())
+		}
+		if tree.Mutated || builder.Mutated() {
+			t.Errorf("%d distinct leaves reported as mutated", n)
+		}
+	}
+}
+
+func TestMerkleProofRoundTrip(t *testing.T) {
+	for n := 1; n <= maxTestLeaves; n++ {
+		data := testLeaves(n)
+		tree := NewMerkleTree(data)
+		
+		for i := range data {
+			proof, err := tree.Proof(i)
+			if err != nil {
+				t.Fatalf("%d leaves: proof of %d: %s", n, i, err)
+			}
+			if !VerifyMerkleProof(tree.RootNode.Data, hashMerkleLeaf(data[i]), proof) {
+				t.Errorf("%d leaves: proof of %d doesn't verify", n, i)
+			}
+			
+			// the proof of one leaf doesn't prove another
+			other := hashMerkleLeaf(data[(i+1)%n])
+			if n > 1 && VerifyMerkleProof(tree.RootNode.Data, other, proof) {
+				t.Errorf("%d leaves: proof of %d verifies leaf %d", n, i, (i+1)%n)
+			}
+		}
+		
+		if _, err := tree.Proof(n); err == nil {
+			t.Errorf("%d leaves: proof of a missing leaf", n)
+		}
+	}
+}
+
+// Repeating the trailing subtree an odd level pairs with itself keeps the
+// root, like [a b c] and [a b c c]. Both the tree and the builder must see it.
+func TestMerkleMutated(t *testing.T) {
+	for n := 1; n <= maxTestLeaves; n++ {
+		// leaves of the lowest incomplete subtree
+		tail := n & -n
+		if tail == n && n != 1 {
+			continue
+		}
+		
+		data := testLeaves(n)
+		mutated := append(append([][]byte{}, data...), data[n-tail:]...)
+		tree := NewMerkleTree(mutated)
+		builder := builderFor(mutated)
+		
+		if bytes.Compare(tree.RootNode.Data, NewMerkleTree(data).RootNode.Data) != 0 {
+			t.Errorf("%d leaves: repeating the last %d changed the root", n, tail)
+		}
+		if bytes.Compare(builder.Root(), tree.RootNode.Data) != 0 {
+			t.Errorf("%d leaves: builder root differs from the tree", len(mutated))
+		}
+		if !tree.Mutated {
+			t.Errorf("%d leaves: tree of %d leaves isn't marked mutated", n, len(mutated))
+		}
+		if !builder.Mutated() {
+			t.Errorf("%d leaves: builder of %d leaves isn't marked mutated", n, len(mutated))
+		}
+	}
+}
+
+func TestMerkleEmpty(t *testing.T) {
+	if tree := NewMerkleTree(nil); tree.RootNode != nil {
+		t.Errorf("empty tree has root %x", tree.RootNode.Data)
+	}
+	if root := NewMerkleBuilder().Root(); root != nil {
+		t.Errorf("empty builder has root %x", root)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// PartialMerkleTree is the part of a block's merkle tree needed to prove that
+// some of its transactions are in it. The tree is walked depth first, Flags
+// tells for every node visited whether it is above a matched leaf and Hashes
+// holds the hashes of the subtrees that are not descended into, matched
+// leaves included.
+type PartialMerkleTree struct {
+	Total  int
+	Hashes [][]byte
+	Flags  []bool
+}
+
+// merkleWidth is the number of nodes at height above the leaves of a tree over total leaves
+func merkleWidth(total, height int) int {
+	return (total + (1 << uint(height)) - 1) >> uint(height)
+}
+
+func merkleHeight(total int) int {
+	// a single leaf is still hashed with itself
+	height := 1
+	for merkleWidth(total, height) > 1 {
+		height++
+	}
+	
+	return height
+}
+
+// NewPartialMerkleTree keeps the leaf hashes for which matches is true
+func NewPartialMerkleTree(leaves [][]byte, matches []bool) *PartialMerkleTree {
+	t := &PartialMerkleTree{Total: len(leaves)}
+	t.build(merkleHeight(len(leaves)), 0, leaves, matches)
+	
+	return t
+}
+
+func (t *PartialMerkleTree) build(height, pos int, leaves [][]byte, matches []bool) {
+	matched := false
+	for i := pos << uint(height); i < (pos+1)<<uint(height) && i < len(leaves); i++ {
+		matched = matched || matches[i]
+	}
+	t.Flags = append(t.Flags, matched)
+	
+	if height == 0 || !matched {
+		t.Hashes = append(t.Hashes, subtreeHash(height, pos, leaves))
+		return
+	}
+	
+	t.build(height-1, pos*2, leaves, matches)
+	if pos*2+1 < merkleWidth(len(leaves), height-1) {
+		t.build(height-1, pos*2+1, leaves, matches)
+	}
+}
+
+func subtreeHash(height, pos int, leaves [][]byte) []byte {
+	if height == 0 {
+		return leaves[pos]
+	}
+	
+	left := subtreeHash(height-1, pos*2, leaves)
+	right := left
+	if pos*2+1 < merkleWidth(len(leaves), height-1) {
+		right = subtreeHash(height-1, pos*2+1, leaves)
+	}
+	
+	return hashMerklePair(left, right)
+}
+
+// ExtractMatches rebuilds the merkle root and returns it with the matched leaf
+// hashes and their positions
+func (t *PartialMerkleTree) ExtractMatches() ([]byte, [][]byte, []int, error) {
+	if t.Total == 0 {
+		return nil, nil, nil, errors.New("empty merkle tree")
+	}
+	if len(t.Hashes) > t.Total || len(t.Flags) < len(t.Hashes) {
+		return nil, nil, nil, errors.New("malformed merkle tree")
+	}
+	
+	var matches [][]byte
+	var indexes []int
+	flagsUsed, hashesUsed := 0, 0
+	
+	var extract func(height, pos int) ([]byte, error)
+	extract = func(height, pos int) ([]byte, error) {
+		if flagsUsed >= len(t.Flags) {
+			return nil, errors.New("merkle tree is missing flags")
+		}
+		matched := t.Flags[flagsUsed]
+		flagsUsed++
+		
+		if height == 0 || !matched {
+			if hashesUsed >= len(t.Hashes) {
+				return nil, errors.New("merkle tree is missing hashes")
+			}
+			hash := t.Hashes[hashesUsed]
+			hashesUsed++
+			if height == 0 && matched {
+				matches = append(matches, hash)
+				indexes = append(indexes, pos)
+			}
+			return hash, nil
+		}
+		
+		left, err := extract(height-1, pos*2)
+		if err != nil {
+			return nil, err
+		}
+		right := left
+		if pos*2+1 < merkleWidth(t.Total, height-1) {
+			right, err = extract(height-1, pos*2+1)
+			if err != nil {
+				return nil, err
+			}
+			// two equal subtrees can stand in for one duplicated and would
+			// let the same root prove a different list of transactions
+			if bytes.Compare(left, right) == 0 {
+				return nil, errors.New("merkle tree has duplicate subtrees")
+			}
+		}
+		
+		return hashMerklePair(left, right), nil
+	}
+	
+	root, err := extract(merkleHeight(t.Total), 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if flagsUsed != len(t.Flags) || hashesUsed != len(t.Hashes) {
+		return nil, nil, nil, errors.New("merkle tree has unused entries")
+	}
+	
+	return root, matches, indexes, nil
+}
+
+// MerkleBlock is a block header with the proof that some of its transactions
+// are in it
+type MerkleBlock struct {
+	Header BlockHeader
+	Tree   PartialMerkleTree
+}
+
+// NewMerkleBlock proves the transactions of b that match and returns them
+func NewMerkleBlock(b *Block, match func(tx *Transaction) bool) (*MerkleBlock, []*Transaction) {
+	var leaves [][]byte
+	var matches []bool
+	var matched []*Transaction
+	
+	for _, tx := range b.Transactions {
+		ok := match(tx)
+		leaves = append(leaves, hashMerkleLeaf(tx.Serialize()))
+		matches = append(matches, ok)
+		if ok {
+			matched = append(matched, tx)
+		}
+	}
+	
+	return &MerkleBlock{b.Header(), *NewPartialMerkleTree(leaves, matches)}, matched
+}
+
+// Verify checks the partial tree against the merkle root of the header and
+// returns the matched leaf hashes
+func (mb *MerkleBlock) Verify() ([][]byte, error) {
+	root, matches, _, err := mb.Tree.ExtractMatches()
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Compare(root, mb.Header.MerkleRoot) != 0 {
+		return nil, errors.New("merkle tree doesn't match the block header")
+	}
+	
+	return matches, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testLeafHashes are the leaf hashes of testLeaves(n)
+func testLeafHashes(n int) [][]byte {
+	var leaves [][]byte
+	for _, datum := range testLeaves(n) {
+		leaves = append(leaves, hashMerkleLeaf(datum))
+	}
+	
+	return leaves
+}
+
+func TestPartialMerkleTree(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := testLeafHashes(n)
+		root := NewMerkleTree(testLeaves(n)).RootNode.Data
+		
+		// nothing, every single leaf and everything
+		patterns := [][]int{nil}
+		all := []int{}
+		for i := 0; i < n; i++ {
+			patterns = append(patterns, []int{i})
+			all = append(all, i)
+		}
+		patterns = append(patterns, all)
+		
+		for _, pattern := range patterns {
+			matches := make([]bool, n)
+			var want [][]byte
+			for _, i := range pattern {
+				matches[i] = true
+				want = append(want, leaves[i])
+			}
+			
+			tree := NewPartialMerkleTree(leaves, matches)
+			gotRoot, got, indexes, err := tree.ExtractMatches()
+			if err != nil {
+				t.Fatalf("%d leaves matching %v: %s", n, pattern, err)
+			}
+			if !bytes.Equal(gotRoot, root) || !reflect.DeepEqual(got, want) || (len(pattern) > 0 && !reflect.DeepEqual(indexes, pattern)) {
+				t.Errorf("%d leaves matching %v: extracted %v at %v", n, pattern, got, indexes)
+			}
+		}
+	}
+}
+
+func TestPartialMerkleTreeRejectsMalformed(t *testing.T) {
+	leaves := testLeafHashes(5)
+	matches := []bool{false, true, false, false, true}
+	
+	tests := []struct {
+		name   string
+		change func(tree *PartialMerkleTree)
+	}{
+		{"empty", func(tree *PartialMerkleTree) { tree.Total = 0 }},
+		{"missing flags", func(tree *PartialMerkleTree) { tree.Flags = tree.Flags[:len(tree.Flags)-1] }},
+		{"missing hashes", func(tree *PartialMerkleTree) { tree.Hashes = tree.Hashes[:len(tree.Hashes)-1] }},
+		{"extra flags", func(tree *PartialMerkleTree) { tree.Flags = append(tree.Flags, false) }},
+		{"too many hashes", func(tree *PartialMerkleTree) { tree.Total = 2 }},
+	}
+	
+	for _, test := range tests {
+		tree := NewPartialMerkleTree(leaves, matches)
+		test.change(tree)
+		if _, _, _, err := tree.ExtractMatches(); err == nil {
+			t.Errorf("%s: extracted the matches of a malformed tree", test.name)
+		}
+	}
+	
+	// [a b c c] has the root of [a b c] with a duplicated leaf
+	duplicated := append(testLeafHashes(3), testLeafHashes(3)[2])
+	tree := NewPartialMerkleTree(duplicated, []bool{false, false, false, true})
+	if _, _, _, err := tree.ExtractMatches(); err == nil {
+		t.Error("extracted the matches of a tree with a duplicated leaf")
+	}
+}
+
+func TestMerkleBlock(t *testing.T) {
+	wallet := NewWallet()
+	block := &Block{}
+	for i := 0; i < 4; i++ {
+		block.Transactions = append(block.Transactions, NewCoinbaseTx(address(wallet), ""))
+	}
+	wanted := block.Transactions[2]
+	
+	mb, matched := NewMerkleBlock(block, func(tx *Transaction) bool { return bytes.Equal(tx.ID, wanted.ID) })
+	if len(matched) != 1 || matched[0] != wanted {
+		t.Fatalf("matched %d transactions, want the third", len(matched))
+	}
+	hashes, err := mb.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || !bytes.Equal(hashes[0], hashMerkleLeaf(wanted.Serialize())) {
+		t.Errorf("verified %x, want the leaf of the third transaction", hashes)
+	}
+	
+	mb.Header.MerkleRoot = hashMerkleLeaf([]byte("other"))
+	if _, err := mb.Verify(); err == nil {
+		t.Error("verified a merkle block against another root")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	
+	"github.com/boltdb/bolt"
+)
+
+// upper bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// Metrics counts what the node does, for Prometheus to scrape
+type Metrics struct {
+	mu              sync.Mutex
+	messagesIn      map[string]uint64
+	messagesOut     map[string]uint64
+	bytesIn         map[string]uint64
+	bytesOut        map[string]uint64
+	blockValidation *histogram
+	// by view or update
+	boltTxs map[string]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		messagesIn:      make(map[string]uint64),
+		messagesOut:     make(map[string]uint64),
+		bytesIn:         make(map[string]uint64),
+		bytesOut:        make(map[string]uint64),
+		blockValidation: newHistogram(),
+		boltTxs:         map[string]*histogram{"view": newHistogram(), "update": newHistogram()},
+	}
+}
+
+var metrics = NewMetrics()
+
+// commands handled by the node, the rest are counted as unknown so peers can't
+// make up series
+var knownCommands = map[string]bool{
+	"addr": true, "block": true, "blocktxn": true, "cmpctblock": true, "inv": true,
+	"getblocks": true, "filterload": true, "getcfheaders": true, "getcfilters": true,
+	"getblocktxn": true, "getdata": true, "getheaders": true, "gettxproof": true,
+	"merkleblock": true, "tx": true, "version": true,
+}
+
+// labelEscaper escapes label values as the text format wants them
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *Metrics) MessageReceived(command string, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	if !knownCommands[command] {
+		command = "unknown"
+	}
+	m.messagesIn[command]++
+	m.bytesIn[command] += uint64(size)
+}
+
+func (m *Metrics) MessageSent(command string, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	m.messagesOut[command]++
+	m.bytesOut[command] += uint64(size)
+}
+
+func (m *Metrics) BlockValidated(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	m.blockValidation.observe(d)
+}
+
+func (m *Metrics) BoltTx(kind string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	m.boltTxs[kind].observe(d)
+}
+
+// timedDB is the bolt database of the chain, timing its transactions
+type timedDB struct {
+	*bolt.DB
+}
+
+func (db *timedDB) View(fn func(*bolt.Tx) error) error {
+	start := time.Now()
+	defer func() { metrics.BoltTx("view", time.Since(start)) }()
+	
+	return db.DB.View(fn)
+}
+
+func (db *timedDB) Update(fn func(*bolt.Tx) error) error {
+	start := time.Now()
+	defer func() { metrics.BoltTx("update", time.Since(start)) }()
+	
+	return db.DB.Update(fn)
+}
+
+// StartMetricsServer serves /metrics in the Prometheus text format on address
+func StartMetricsServer(address string, bc *BlockChain) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteTo(w, bc)
+	})
+	
+	fmt.Printf("Metrics server listening on %s\n", address)
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+}
+
+// WriteTo writes the metrics, the gauges read from bc and the mempool now
+func (m *Metrics) WriteTo(w io.Writer, bc *BlockChain) {
+	mempoolBytes := 0
+	pool := mempool.Snapshot()
+	for _, tx := range pool {
+		mempoolBytes += len(tx.Serialize())
+	}
+	
+	peers := 0
+	for _, node := range knownPeers() {
+		if node != nodeAddress {
+			peers++
+		}
+	}
+	
+	utxos := 0
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(utxoBucket)); b != nil {
+			utxos = b.Stats().KeyN
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	writeGauge(w, "cyain_chain_height", "Height of the best block", float64(bc.GetBestHeight()))
+	writeGauge(w, "cyain_mempool_transactions", "Transactions in the mempool", float64(len(pool)))
+	writeGauge(w, "cyain_mempool_bytes", "Serialized size of the mempool", float64(mempoolBytes))
+	writeGauge(w, "cyain_peers", "Known peers", float64(peers))
+	writeGauge(w, "cyain_hashrate", "Hashes per second of the last search", defaultMiner.HashRate())
+	writeGauge(w, "cyain_utxo_set_transactions", "Transactions with unspent outputs", float64(utxos))
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	writeCounters(w, "cyain_messages_received_total", "Messages received by command", m.messagesIn)
+	writeCounters(w, "cyain_messages_sent_total", "Messages sent by command", m.messagesOut)
+	writeCounters(w, "cyain_bytes_received_total", "Bytes received by command", m.bytesIn)
+	writeCounters(w, "cyain_bytes_sent_total", "Bytes sent by command", m.bytesOut)
+	
+	fmt.Fprintf(w, "# HELP cyain_block_validation_seconds Time taken to validate a block\n")
+	fmt.Fprintf(w, "# TYPE cyain_block_validation_seconds histogram\n")
+	writeHistogram(w, "cyain_block_validation_seconds", "", m.blockValidation)
+	
+	fmt.Fprintf(w, "# HELP cyain_bolt_tx_seconds Duration of the database transactions\n")
+	fmt.Fprintf(w, "# TYPE cyain_bolt_tx_seconds histogram\n")
+	for _, kind := range []string{"update", "view"} {
+		writeHistogram(w, "cyain_bolt_tx_seconds", fmt.Sprintf(`type="%s",`, kind), m.boltTxs[kind])
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+}
+
+func writeCounters(w io.Writer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	
+	var commands []string
+	for command := range values {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	
+	for _, command := range commands {
+		fmt.Fprintf(w, "%s{command=\"%s\"} %d\n", name, labelEscaper.Replace(command), values[command])
+	}
+}
+
+// writeHistogram writes the series of h, labels go before the le label
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	
+	labels = trimLabels(labels)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// trimLabels turns `a="b",` into {a="b"}
+func trimLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	
+	return "{" + labels[:len(labels)-1] + "}"
+}
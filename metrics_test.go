@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramIsCumulative(t *testing.T) {
+	h := newHistogram()
+	h.observe(2 * time.Millisecond)
+	h.observe(time.Minute)
+	
+	var buff bytes.Buffer
+	writeHistogram(&buff, "h", `type="view",`, h)
+	for _, want := range []string{
+		"h_bucket{type=\"view\",le=\"0.001\"} 0\n",
+		"h_bucket{type=\"view\",le=\"0.0025\"} 1\n",
+		"h_bucket{type=\"view\",le=\"5\"} 1\n",
+		"h_bucket{type=\"view\",le=\"+Inf\"} 2\n",
+		"h_sum{type=\"view\"} 60.002\n",
+		"h_count{type=\"view\"} 2\n",
+	} {
+		if !strings.Contains(buff.String(), want) {
+			t.Errorf("no line %q in\n%s", want, buff.String())
+		}
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	bc.Generate(2, address(wallet))
+	m := NewMetrics()
+	m.MessageReceived("inv", 10)
+	m.MessageReceived("inv", 5)
+	m.MessageSent("block", 100)
+	m.BlockValidated(time.Millisecond)
+	
+	var buff bytes.Buffer
+	m.WriteTo(&buff, bc)
+	for _, want := range []string{
+		"# TYPE cyain_chain_height gauge\ncyain_chain_height 2\n",
+		"cyain_utxo_set_transactions 3\n",
+		"cyain_messages_received_total{command=\"inv\"} 2\n",
+		"cyain_bytes_received_total{command=\"inv\"} 15\n",
+		"cyain_bytes_sent_total{command=\"block\"} 100\n",
+		"cyain_block_validation_seconds_count 1\n",
+	} {
+		if !strings.Contains(buff.String(), want) {
+			t.Errorf("no line %q in\n%s", want, buff.String())
+		}
+	}
+}
+
+func TestTimedDBIsMeasured(t *testing.T) {
+	bc, _ := newTestChain(t)
+	before := metrics.boltTxs["view"].count
+	bc.GetBestHeight()
+	if metrics.boltTxs["view"].count <= before {
+		t.Error("a view of the chain database wasn't timed")
+	}
+}
+
+func TestUnknownCommandsShareASeries(t *testing.T) {
+	m := NewMetrics()
+	m.MessageReceived("inv", 10)
+	m.MessageReceived("x\"} 1\n", 20)
+	m.MessageReceived("bogus", 30)
+	
+	var buff bytes.Buffer
+	writeCounters(&buff, "received", "Received", m.messagesIn)
+	want := "# HELP received Received\n# TYPE received counter\n" +
+		"received{command=\"inv\"} 1\nreceived{command=\"unknown\"} 2\n"
+	if buff.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buff.String(), want)
+	}
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	var buff bytes.Buffer
+	writeCounters(&buff, "sent", "Sent", map[string]uint64{"a\"b\\c\nd": 1})
+	if want := "sent{command=\"a\\\"b\\\\c\\nd\"} 1\n"; !bytes.HasSuffix(buff.Bytes(), []byte(want)) {
+		t.Errorf("got\n%s\nwant a line %q", buff.String(), want)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// nonces tried by a worker before it moves on to the next timestamp
+const maxNonce = math.MaxInt32
+
+// hashes between two checks for cancellation
+const hashBatch = 1 << 12
+
+type Miner struct {
+	workers int
+	hashes  uint64
+	rate    uint64
+}
+
+var defaultMiner = NewMiner(0)
+
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	
+	return &Miner{workers: workers}
+}
+
+type solution struct {
+	timestamp int64
+	nonce     int
+	hash      []byte
+}
+
+// Solve searches a nonce meeting the target of pow. Worker i tries the nonces
+// i, i+n, i+2n... and when its share of the nonce space is used up it bumps its
+// own copy of the timestamp, which works as an extra nonce. The block timestamp
+// is updated to the one of the solution.
+func (m *Miner) Solve(ctx context.Context, pow *ProofOfWork) (int, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	
+	found := make(chan solution, m.workers)
+	var wg sync.WaitGroup
+	
+	fmt.Printf("Mining a new block with %d workers\n", m.workers)
+	start := time.Now()
+	startHashes := atomic.LoadUint64(&m.hashes)
+	
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			m.work(ctx, pow, worker, found)
+		}(i)
+	}
+	
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	
+	var result solution
+	var err error
+
+Loop:
+	for {
+		select {
+		case result = <-found:
+			break Loop
+		case <-ctx.Done():
+			err = ctx.Err()
+			break Loop
+		case <-ticker.C:
+			m.updateRate(start, startHashes)
+		}
+	}
+	
+	cancel()
+	wg.Wait()
+	m.updateRate(start, startHashes)
+	
+	if err != nil {
+		fmt.Println("Mining cancelled")
+		return 0, nil, err
+	}
+	
+	pow.block.Timestamp = result.timestamp
+	fmt.Printf("%x\n%.0f H/s\n\n", result.hash, m.HashRate())
+	
+	return result.nonce, result.hash, nil
+}
+
+func (m *Miner) work(ctx context.Context, pow *ProofOfWork, worker int, found chan<- solution) {
+	var hashInt big.Int
+	timestamp := pow.block.Timestamp
+	
+	for {
+		data := pow.prepareData(timestamp, 0)
+		nonceBytes := data[len(data)-8:]
+		
+		for nonce := worker; nonce < maxNonce; nonce += m.workers {
+			if (nonce/m.workers)%hashBatch == 0 {
+				atomic.AddUint64(&m.hashes, hashBatch)
+				if ctx.Err() != nil {
+					return
+				}
+			}
+			
+			binary.BigEndian.PutUint64(nonceBytes, uint64(nonce))
+			hash := sha256.Sum256(data)
+			hashInt.SetBytes(hash[:])
+			
+			if hashInt.Cmp(pow.target) == -1 {
+				found <- solution{timestamp, nonce, hash[:]}
+				return
+			}
+		}
+		
+		timestamp++
+	}
+}
+
+func (m *Miner) updateRate(start time.Time, startHashes uint64) {
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	
+	rate := float64(atomic.LoadUint64(&m.hashes)-startHashes) / elapsed
+	atomic.StoreUint64(&m.rate, math.Float64bits(rate))
+}
+
+// HashRate is the number of hashes per second measured during the last search
+func (m *Miner) HashRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&m.rate))
+}
+
+// MiningService keeps mining blocks on its own goroutine so message handling
+// never waits for proof of work
+type MiningService struct {
+	bc        *BlockChain
+	address   string
+	mineEmpty bool
+	newTx     chan struct{}
+	newTip    chan struct{}
+}
+
+func NewMiningService(bc *BlockChain, address string, mineEmpty bool) *MiningService {
+	return &MiningService{
+		bc:        bc,
+		address:   address,
+		mineEmpty: mineEmpty,
+		newTx:     make(chan struct{}, 1),
+		newTip:    make(chan struct{}, 1),
+	}
+}
+
+func (s *MiningService) Start() {
+	events.OnTxAccepted(func(TxAccepted) { s.NotifyTx() })
+	events.OnTipChanged(func(TipChanged) { s.NotifyTip() })
+	
+	go s.loop()
+}
+
+// NotifyTx tells the service the mempool got a new transaction
+func (s *MiningService) NotifyTx() {
+	select {
+	case s.newTx <- struct{}{}:
+	default:
+	}
+}
+
+// NotifyTip aborts the current work, it is built on a stale tip
+func (s *MiningService) NotifyTip() {
+	select {
+	case s.newTip <- struct{}{}:
+	default:
+	}
+}
+
+func (s *MiningService) loop() {
+	for {
+		var txs []*Transaction
+		if mempool.Count() > 0 {
+			txs = s.bc.NewBlockTemplate(mempool.Snapshot(), maxBlockSize)
+		}
+		
+		if len(txs) == 0 && !s.mineEmpty {
+			if mempool.Count() > 0 {
+				fmt.Println("All transactions are invalid! Waiting for new ones...")
+			}
+			select {
+			case <-s.newTx:
+			case <-s.newTip:
+			}
+			continue
+		}
+		
+		err := s.mine(txs)
+		if errors.Is(err, errNotInTurn) {
+			// another signer seals the next block
+			<-s.newTip
+		}
+	}
+}
+
+func (s *MiningService) mine(txs []*Transaction) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	done := make(chan struct{})
+	defer close(done)
+	
+	go func() {
+		select {
+		case <-s.newTip:
+			cancel()
+		case <-done:
+		}
+	}()
+	
+	cbTx := NewCoinbaseTx(s.address, "")
+	txs = append([]*Transaction{cbTx}, txs...)
+	
+	newBlock, err := s.bc.MineBlockContext(ctx, txs)
+	if err != nil {
+		fmt.Printf("Mining stopped: %s\n", err)
+		return err
+	}
+	
+	fmt.Println("New block is mined!")
+	
+	announceBlock(newBlock.Hash)
+	
+	return nil
+}
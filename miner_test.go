@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// easyWork is a proof of work on block whose target takes a few hundred hashes
+func easyWork(block *Block) *ProofOfWork {
+	target := big.NewInt(1)
+	target.Lsh(target, 256-8)
+	
+	return &ProofOfWork{block, target}
+}
+
+func TestMinerSolvesWithEveryWorker(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		block := &Block{Timestamp: time.Now().Unix(), Transactions: []*Transaction{NewCoinbaseTx(address(NewWallet()), "")}}
+		pow := easyWork(block)
+		
+		nonce, hash, err := NewMiner(workers).Solve(context.Background(), pow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		sum := sha256.Sum256(pow.prepareData(block.Timestamp, nonce))
+		if !bytes.Equal(sum[:], hash) || new(big.Int).SetBytes(hash).Cmp(pow.target) != -1 {
+			t.Errorf("%d workers: nonce %d and hash %x do not meet the target", workers, nonce, hash)
+		}
+	}
+}
+
+func TestMinerStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	
+	block := &Block{Timestamp: time.Now().Unix(), Transactions: []*Transaction{NewCoinbaseTx(address(NewWallet()), "")}}
+	pow := NewProofOfWork(block)
+	pow.target = big.NewInt(0)
+	
+	_, _, err := NewMiner(2).Solve(ctx, pow)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+}
+
+func TestMineBlockContextCancelledKeepsTip(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	tip := bc.Tip()
+	
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	
+	_, err := bc.MineBlockContext(ctx, []*Transaction{NewCoinbaseTx(address(wallet), "")})
+	if err == nil {
+		t.Fatal("mined a block with a cancelled context")
+	}
+	if bc.GetBestHeight() != 0 || !bytes.Equal(bc.Tip(), tip) {
+		t.Error("cancelled mining moved the tip")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// maximum number of keys in a multisig script
+const maxMultisigKeys = 16
+
+// MultisigScript locks an output to any m of pubKeys
+func MultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > maxMultisigKeys {
+		return nil, fmt.Errorf("need between 1 and %d keys", maxMultisigKeys)
+	}
+	if m <= 0 || m > len(pubKeys) {
+		return nil, fmt.Errorf("can't require %d of %d signatures", m, len(pubKeys))
+	}
+	
+	builder := NewScriptBuilder().AddInt(int64(m))
+	for _, pubKey := range pubKeys {
+		builder.AddData(pubKey)
+	}
+	builder.AddInt(int64(len(pubKeys))).AddOp(OP_CHECKMULTISIG)
+	
+	// the script is pushed whole when it is redeemed
+	if len(builder.Script()) > maxElementSize {
+		return nil, fmt.Errorf("a script of %d keys is too big to redeem", len(pubKeys))
+	}
+	
+	return builder.Script(), nil
+}
+
+// parseMultisigScript returns m and the keys of a script built by MultisigScript
+func parseMultisigScript(script []byte) (int, [][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, errors.New("not a multisig script")
+	}
+	
+	m := int(ops[0].opcode) - OP_1 + 1
+	n := int(ops[len(ops)-2].opcode) - OP_1 + 1
+	if n != len(ops)-3 || m < 1 || m > n {
+		return 0, nil, errors.New("not a multisig script")
+	}
+	
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		pubKeys = append(pubKeys, op.data)
+	}
+	
+	return m, pubKeys, nil
+}
+
+// PayToScriptHashScript locks an output to the script hashing to scriptHash
+func PayToScriptHashScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(OP_HASH160).
+		AddData(scriptHash).
+		AddOp(OP_EQUAL).
+		Script()
+}
+
+func isPayToScriptHash(script []byte) bool {
+	return len(script) == 23 &&
+		script[0] == OP_HASH160 &&
+		script[1] == 20 &&
+		script[22] == OP_EQUAL
+}
+
+func containsKey(pubKeys [][]byte, pubKey []byte) bool {
+	for _, key := range pubKeys {
+		if bytes.Compare(key, pubKey) == 0 {
+			return true
+		}
+	}
+	
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// newMultisigFunds pays the genesis reward of bc to a 2 of 3 multisig address
+// and returns its redeem script and key holders
+func newMultisigFunds(t *testing.T) (*BlockChain, []byte, []*Wallet) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	holders := []*Wallet{NewWallet(), NewWallet(), NewWallet()}
+	redeemScript, err := MultisigScript(2, [][]byte{holders[0].PublicKey, holders[1].PublicKey, holders[2].PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	prev := genesis.Transactions[0]
+	funding := &Transaction{
+		Vin:  []TxInput{{Txid: prev.ID, Vout: 0, PubKey: wallet.PublicKey}},
+		Vout: []TxOutput{*NewTxOutput(activeNet.Subsidy, ScriptAddress(redeemScript))},
+	}
+	funding.ID = funding.Hash()
+	funding.Sign(wallet.PrivateKey, poolOf(prev))
+	addTestBlock(bc, NewCoinbaseTx(address(wallet), "funding"), funding)
+	
+	return bc, redeemScript, holders
+}
+
+func TestMultisigScriptChecks(t *testing.T) {
+	bc, redeemScript, holders := newMultisigFunds(t)
+	psbt := newMultisigPSBT(t, bc, redeemScript, address(NewWallet()), 4)
+	psbt.Sign(holders[0])
+	psbt.Sign(holders[1])
+	
+	signatures := psbt.Inputs[0].Signatures
+	first := signatures[hex.EncodeToString(holders[0].PublicKey)]
+	second := signatures[hex.EncodeToString(holders[1].PublicKey)]
+	otherScript, _ := MultisigScript(1, [][]byte{holders[0].PublicKey})
+	
+	tests := []struct {
+		name      string
+		scriptSig []byte
+		ok        bool
+	}{
+		{"key order", NewScriptBuilder().AddData(first).AddData(second).AddData(redeemScript).Script(), true},
+		{"reversed", NewScriptBuilder().AddData(second).AddData(first).AddData(redeemScript).Script(), false},
+		{"same signature twice", NewScriptBuilder().AddData(first).AddData(first).AddData(redeemScript).Script(), false},
+		{"other redeem script", NewScriptBuilder().AddData(first).AddData(otherScript).Script(), false},
+		{"no redeem script", NewScriptBuilder().AddData(first).AddData(second).Script(), false},
+	}
+	
+	for _, test := range tests {
+		tx := psbt.Tx
+		tx.Vin = []TxInput{tx.Vin[0]}
+		tx.Vin[0].ScriptSig = test.scriptSig
+		if bc.VerifyTransaction(&tx) != test.ok {
+			t.Errorf("%s: verified %v, want %v", test.name, !test.ok, test.ok)
+		}
+	}
+}
+
+func TestMultisigScript(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 3; i++ {
+		keys = append(keys, NewWallet().PublicKey)
+	}
+	
+	script, err := MultisigScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, parsed, err := parseMultisigScript(script)
+	if err != nil || m != 2 || len(parsed) != 3 || !containsKey(parsed, keys[2]) {
+		t.Errorf("parsed %d of %d keys, %v", m, len(parsed), err)
+	}
+	
+	for _, bad := range []struct{ m, n int }{{0, 3}, {4, 3}, {1, 0}, {1, maxMultisigKeys + 1}} {
+		for len(keys) < bad.n {
+			keys = append(keys, NewWallet().PublicKey)
+		}
+		if _, err := MultisigScript(bad.m, keys[:bad.n]); err == nil {
+			t.Errorf("built a %d of %d script", bad.m, bad.n)
+		}
+	}
+	
+	if !IsScriptAddress(ScriptAddress(script)) || !ValidateAddress(ScriptAddress(script)) || IsScriptAddress(address(NewWallet())) {
+		t.Error("script addresses are not told apart from key addresses")
+	}
+}
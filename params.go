@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ChainParams bundles everything that tells one cyain network from another
+type ChainParams struct {
+	Name string
+	// first bytes of every message between nodes
+	Magic       [4]byte
+	DefaultPort string
+	Seeds       []string
+	
+	GenesisCoinbaseData string
+	// fixed genesis time, 0 uses the time the chain is created
+	GenesisTimestamp int64
+	
+	// reward for mining
+	Subsidy    int
+	TargetBits int
+	
+	AddressVersion byte
+	// version of pay-to-script-hash addresses
+	ScriptHashVersion byte
+	
+	// file name patterns, formatted with the node ID
+	DBFile     string
+	WalletFile string
+	// headers and wallet transactions of a light client
+	HeadersFile string
+	// where a running node leaves its RPC address and credentials
+	CookieFile string
+}
+
+var MainNetParams = ChainParams{
+	Name:                "main",
+	Magic:               [4]byte{0xc7, 0x1a, 0x19, 0x0e},
+	DefaultPort:         "3000",
+	Seeds:               []string{"localhost:3000"},
+	GenesisCoinbaseData: "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks",
+	Subsidy:             10,
+	TargetBits:          24,
+	AddressVersion:      0x01,
+	ScriptHashVersion:   0x05,
+	DBFile:              "blockchain_%s.db",
+	WalletFile:          "wallet_%s.db",
+	HeadersFile:         "headers_%s.db",
+	CookieFile:          "rpc_%s.cookie",
+}
+
+var TestNetParams = ChainParams{
+	Name:                "testnet",
+	Magic:               [4]byte{0x0b, 0x1a, 0x19, 0x07},
+	DefaultPort:         "13000",
+	Seeds:               []string{"localhost:13000"},
+	GenesisCoinbaseData: "cyain test network",
+	Subsidy:             10,
+	TargetBits:          20,
+	AddressVersion:      0x42,
+	ScriptHashVersion:   0xc4,
+	DBFile:              "blockchain_testnet_%s.db",
+	WalletFile:          "wallet_testnet_%s.db",
+	HeadersFile:         "headers_testnet_%s.db",
+	CookieFile:          "rpc_testnet_%s.cookie",
+}
+
+// RegtestParams use the minimum difficulty so every block is found right away
+var RegtestParams = ChainParams{
+	Name:                "regtest",
+	Magic:               [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+	DefaultPort:         "18444",
+	Seeds:               []string{"localhost:18444"},
+	GenesisCoinbaseData: "cyain regression test network",
+	GenesisTimestamp:    1650000000,
+	Subsidy:             10,
+	TargetBits:          1,
+	AddressVersion:      0x6f,
+	ScriptHashVersion:   0xc5,
+	DBFile:              "blockchain_regtest_%s.db",
+	WalletFile:          "wallet_regtest_%s.db",
+	HeadersFile:         "headers_regtest_%s.db",
+	CookieFile:          "rpc_regtest_%s.cookie",
+}
+
+// network the node and the wallet work on
+var activeNet = &MainNetParams
+
+// UseChainParams switches the package to params, custom ones included
+func UseChainParams(params *ChainParams) {
+	activeNet = params
+	knownNodes = append([]string{}, params.Seeds...)
+}
+
+func ParamsByName(name string) (*ChainParams, error) {
+	switch name {
+	case "", MainNetParams.Name:
+		return &MainNetParams, nil
+	case TestNetParams.Name:
+		return &TestNetParams, nil
+	case RegtestParams.Name:
+		return &RegtestParams, nil
+	default:
+		return nil, fmt.Errorf("unknown network %s", name)
+	}
+}
+
+// networkFromEnv picks the network named by the NETWORK env. var
+func networkFromEnv() {
+	params, err := ParamsByName(os.Getenv("NETWORK"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	
+	UseChainParams(params)
+}
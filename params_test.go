@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestAddressesBelongToOneNetwork(t *testing.T) {
+	defer UseChainParams(&MainNetParams)
+	wallet := NewWallet()
+	
+	UseChainParams(&RegtestParams)
+	regtest := address(wallet)
+	if !ValidateAddress(regtest) {
+		t.Fatal("regtest address is not valid on regtest")
+	}
+	
+	UseChainParams(&TestNetParams)
+	if ValidateAddress(regtest) {
+		t.Error("regtest address is valid on testnet")
+	}
+	if address(wallet) == regtest {
+		t.Error("the same key has the same address on two networks")
+	}
+}
+
+func TestParamsByName(t *testing.T) {
+	for name, want := range map[string]*ChainParams{"": &MainNetParams, "testnet": &TestNetParams, "regtest": &RegtestParams} {
+		params, err := ParamsByName(name)
+		if err != nil || params != want {
+			t.Errorf("%q: got %v, %v", name, params, err)
+		}
+	}
+	if _, err := ParamsByName("simnet"); err == nil {
+		t.Error("found params for an unknown network")
+	}
+}
+
+func TestChainAndWalletOfAnotherNetwork(t *testing.T) {
+	bc, _ := newTestChain(t)
+	
+	UseChainParams(&TestNetParams)
+	err := bc.db.View(checkNetwork)
+	if err == nil {
+		t.Error("opened a regtest chain on testnet")
+	}
+	
+	UseChainParams(&RegtestParams)
+	if err := bc.db.View(checkNetwork); err != nil {
+		t.Fatal(err)
+	}
+	
+	Wallets{Network: MainNetParams.Name}.SaveToFile("test")
+	if _, err := NewWallets("test"); err == nil {
+		t.Error("loaded a main network wallet on regtest")
+	}
+}
@@ -2,16 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"math"
+	"log"
 	"math/big"
 	
 	"cyain/utils"
 )
 
-const targetBits = 24
-
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
@@ -19,7 +19,7 @@ type ProofOfWork struct {
 
 func NewProofOfWork(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target.Lsh(target, uint(256-b.Bits))
 	
 	pow := &ProofOfWork{
 		b,
@@ -29,48 +29,74 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 	return pow
 }
 
-func (pow *ProofOfWork) prepareData(nonce int) []byte {
+func (pow *ProofOfWork) prepareData(timestamp int64, nonce int) []byte {
 	s := [][]byte{
 		pow.block.PrevBlockHash,
 		pow.block.HashTransaction(),
-		utils.IntToHex(pow.block.Timestamp),
-		utils.IntToHex(int64(targetBits)),
+		utils.IntToHex(timestamp),
+		utils.IntToHex(int64(pow.block.Bits)),
 		utils.IntToHex(int64(nonce)),
 	}
 	return bytes.Join(s, []byte{})
 }
 
 func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
-	nonce := 0
-	
-	maxNonce := math.MaxInt64
-	
-	fmt.Printf("Mining a new block")
-	for nonce < maxNonce {
-		data := pow.prepareData(nonce)
-		hash = sha256.Sum256(data)
-		hashInt.SetBytes(hash[:])
-		
-		if hashInt.Cmp(pow.target) == -1 {
-			fmt.Printf("\r%x", hash)
-			break
-		} else {
-			nonce++
-		}
+	nonce, hash, err := defaultMiner.Solve(context.Background(), pow)
+	if err != nil {
+		log.Panic(err)
 	}
-	fmt.Print("\n\n")
 	
-	return nonce, hash[:]
+	return nonce, hash
 }
 
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int
 	
-	data := pow.prepareData(pow.block.Nonce)
+	data := pow.prepareData(pow.block.Timestamp, pow.block.Nonce)
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 	
 	return hashInt.Cmp(pow.target) == -1
 }
+
+// PowEngine seals blocks with SHA-256 proof of work
+type PowEngine struct {
+	miner *Miner
+}
+
+func NewPowEngine(miner *Miner) *PowEngine {
+	return &PowEngine{miner}
+}
+
+func (e *PowEngine) Seal(ctx context.Context, b *Block) error {
+	pow := NewProofOfWork(b)
+	nonce, hash, err := e.miner.Solve(ctx, pow)
+	if err != nil {
+		return err
+	}
+	
+	b.Hash = hash
+	b.Nonce = nonce
+	return nil
+}
+
+func (e *PowEngine) VerifyHeader(b *Block, prev *Block) error {
+	if b.Bits != e.Difficulty(prev) {
+		return fmt.Errorf("bad difficulty %d", b.Bits)
+	}
+	
+	pow := NewProofOfWork(b)
+	hash := sha256.Sum256(pow.prepareData(b.Timestamp, b.Nonce))
+	if bytes.Compare(hash[:], b.Hash) != 0 {
+		return errors.New("block hash does not match its header")
+	}
+	if !pow.Validate() {
+		return errors.New("block hash does not meet the target")
+	}
+	
+	return nil
+}
+
+func (e *PowEngine) Difficulty(prev *Block) int {
+	return activeNet.TargetBits
+}
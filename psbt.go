@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// PSBT is a partially signed transaction. It carries everything signers need
+// besides their keys, so it can be built on a node, signed on machines that
+// have no blockchain and combined and broadcast wherever enough signatures
+// come together.
+type PSBT struct {
+	Tx     Transaction
+	Inputs []PSBTInput
+}
+
+type PSBTInput struct {
+	// the output spent by the input
+	PrevOut TxOutput
+	// script behind a pay-to-script-hash PrevOut
+	RedeemScript []byte
+	// hex encoded public keys to their signature of the input
+	Signatures map[string][]byte
+}
+
+// NewPSBT wraps the unsigned tx, looking up the outputs it spends in the
+// chain and in pending. scripts holds redeem scripts by address.
+func NewPSBT(tx *Transaction, bc *BlockChain, pending map[string]Transaction, scripts map[string][]byte) (*PSBT, error) {
+	prevTXs, err := bc.prevTransactions(tx, pending)
+	if err != nil {
+		return nil, err
+	}
+	
+	psbt := &PSBT{Tx: *tx}
+	for _, vin := range tx.Vin {
+		prevOut := prevTXs[hex.EncodeToString(vin.Txid)].Vout[vin.Vout]
+		input := PSBTInput{prevOut, nil, make(map[string][]byte)}
+		
+		if isPayToScriptHash(prevOut.Script) {
+			for _, script := range scripts {
+				if bytes.Compare(HashPubKey(script), prevOut.PubKeyHash) == 0 {
+					input.RedeemScript = script
+				}
+			}
+			if input.RedeemScript == nil {
+				return nil, errors.New("the redeem script of a script hash input is unknown")
+			}
+		}
+		
+		psbt.Inputs = append(psbt.Inputs, input)
+	}
+	
+	return psbt, nil
+}
+
+// NewPSBTTransaction builds the PSBT of a transaction paying amount from from
+// to to, with its lock time and the sequence of its inputs set
+func NewPSBTTransaction(bc *BlockChain, from, to string, amount int, lockTime int64, sequence uint32, scripts map[string][]byte) (*PSBT, error) {
+	tx, err := NewUnsignedTransaction(from, to, amount, &UTXOSet{bc}, nil)
+	if err != nil {
+		return nil, err
+	}
+	tx.LockTime = lockTime
+	for i := range tx.Vin {
+		tx.Vin[i].Sequence = sequence
+	}
+	tx.ID = tx.Hash()
+	
+	return NewPSBT(tx, bc, nil, scripts)
+}
+
+// prevTransactions rebuilds just enough of the spent transactions for Verify
+func (psbt *PSBT) prevTransactions() map[string]Transaction {
+	prevTXs := make(map[string]Transaction)
+	
+	for i, vin := range psbt.Tx.Vin {
+		txID := hex.EncodeToString(vin.Txid)
+		prevTX := prevTXs[txID]
+		prevTX.ID = vin.Txid
+		for len(prevTX.Vout) <= vin.Vout {
+			prevTX.Vout = append(prevTX.Vout, TxOutput{})
+		}
+		prevTX.Vout[vin.Vout] = psbt.Inputs[i].PrevOut
+		prevTXs[txID] = prevTX
+	}
+	
+	return prevTXs
+}
+
+// Sign adds signatures by wallet to every input it can sign and returns how many it signed
+func (psbt *PSBT) Sign(wallet *Wallet) int {
+	signed := 0
+	pubKey := hex.EncodeToString(wallet.PublicKey)
+	
+	for inID, input := range psbt.Inputs {
+		var scriptCode []byte
+		
+		switch {
+		case input.RedeemScript != nil:
+			_, pubKeys, err := parseMultisigScript(input.RedeemScript)
+			if err != nil || !containsKey(pubKeys, wallet.PublicKey) {
+				continue
+			}
+			scriptCode = input.RedeemScript
+		case len(input.PrevOut.Script) == 0:
+			if !input.PrevOut.IsLockedWithKey(HashPubKey(wallet.PublicKey)) {
+				continue
+			}
+			scriptCode = input.PrevOut.scriptCode()
+		default:
+			continue
+		}
+		
+		if input.Signatures == nil {
+			psbt.Inputs[inID].Signatures = make(map[string][]byte)
+		}
+		psbt.Inputs[inID].Signatures[pubKey] = signHash(wallet.PrivateKey, psbt.Tx.sigHash(inID, scriptCode))
+		signed++
+	}
+	
+	return signed
+}
+
+// Combine merges the signatures of other copies of the same transaction
+func (psbt *PSBT) Combine(other *PSBT) error {
+	if bytes.Compare(psbt.Tx.ID, other.Tx.ID) != 0 || len(psbt.Inputs) != len(other.Inputs) {
+		return errors.New("the partially signed transactions spend differently")
+	}
+	
+	for inID, input := range other.Inputs {
+		if psbt.Inputs[inID].Signatures == nil {
+			psbt.Inputs[inID].Signatures = make(map[string][]byte)
+		}
+		for pubKey, signature := range input.Signatures {
+			psbt.Inputs[inID].Signatures[pubKey] = signature
+		}
+	}
+	
+	return nil
+}
+
+// Finalize fills in the unlocking data of every input and checks the result
+func (psbt *PSBT) Finalize() (*Transaction, error) {
+	tx := psbt.Tx
+	tx.Vin = append([]TxInput{}, psbt.Tx.Vin...)
+	
+	for inID, input := range psbt.Inputs {
+		switch {
+		case input.RedeemScript != nil:
+			m, pubKeys, err := parseMultisigScript(input.RedeemScript)
+			if err != nil {
+				return nil, err
+			}
+			
+			builder := NewScriptBuilder()
+			signed := 0
+			for _, pubKey := range pubKeys {
+				signature, ok := input.Signatures[hex.EncodeToString(pubKey)]
+				if ok && signed < m {
+					builder.AddData(signature)
+					signed++
+				}
+			}
+			if signed < m {
+				return nil, fmt.Errorf("input %d needs %d more signatures", inID, m-signed)
+			}
+			tx.Vin[inID].ScriptSig = builder.AddData(input.RedeemScript).Script()
+		
+		case len(input.PrevOut.Script) == 0:
+			for hexKey, signature := range input.Signatures {
+				pubKey, err := hex.DecodeString(hexKey)
+				if err == nil && input.PrevOut.IsLockedWithKey(HashPubKey(pubKey)) {
+					tx.Vin[inID].PubKey = pubKey
+					tx.Vin[inID].Signature = signature
+				}
+			}
+			if tx.Vin[inID].Signature == nil {
+				return nil, fmt.Errorf("input %d is not signed", inID)
+			}
+		
+		default:
+			return nil, fmt.Errorf("don't know how to finalize input %d", inID)
+		}
+	}
+	
+	if !tx.Verify(psbt.prevTransactions()) {
+		return nil, errors.New("the finalized transaction doesn't verify")
+	}
+	
+	return &tx, nil
+}
+
+// Serialize encodes psbt as base64 text that is easy to pass around
+func (psbt *PSBT) Serialize() string {
+	var content bytes.Buffer
+	
+	err := gob.NewEncoder(&content).Encode(psbt)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	return base64.StdEncoding.EncodeToString(content.Bytes())
+}
+
+func DeserializePSBT(data string) (*PSBT, error) {
+	content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, err
+	}
+	
+	var psbt PSBT
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&psbt)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &psbt, nil
+}
+
+func (psbt *PSBT) SaveToFile(file string) {
+	err := ioutil.WriteFile(file, []byte(psbt.Serialize()+"\n"), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func LoadPSBT(file string) (*PSBT, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	
+	return DeserializePSBT(string(content))
+}
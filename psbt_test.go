@@ -0,0 +1,123 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newMultisigPSBT sends amount from the multisig address of redeemScript to to
+func newMultisigPSBT(t *testing.T, bc *BlockChain, redeemScript []byte, to string, amount int) *PSBT {
+	from := ScriptAddress(redeemScript)
+	tx, err := NewUnsignedTransaction(from, to, amount, &UTXOSet{bc}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psbt, err := NewPSBT(tx, bc, nil, map[string][]byte{from: redeemScript})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	return psbt
+}
+
+func TestPSBTMultisigSpend(t *testing.T) {
+	bc, redeemScript, holders := newMultisigFunds(t)
+	
+	psbt := newMultisigPSBT(t, bc, redeemScript, address(NewWallet()), 4)
+	out := psbt.Tx.Vout[1]
+	if len(psbt.Tx.Vout) != 2 || out.Value != activeNet.Subsidy-4 || !out.IsLockedWithKey(HashPubKey(redeemScript)) {
+		t.Fatalf("outputs %v, want the change back to the multisig address", psbt.Tx.Vout)
+	}
+	
+	// the holders sign their own copies
+	copies := make([]*PSBT, 2)
+	for i, holder := range []*Wallet{holders[2], holders[0]} {
+		var err error
+		copies[i], err = DeserializePSBT(psbt.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copies[i].Sign(holder) != 1 {
+			t.Fatalf("holder %d signed no input", i)
+		}
+	}
+	if psbt.Sign(NewWallet()) != 0 {
+		t.Error("signed with a key outside the script")
+	}
+	if _, err := copies[0].Finalize(); err == nil {
+		t.Fatal("finalized with a single signature")
+	}
+	
+	file := filepath.Join(t.TempDir(), "spend.psbt")
+	copies[1].SaveToFile(file)
+	loaded, err := LoadPSBT(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = copies[0].Combine(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	tx, err := copies[0].Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bc.VerifyTransaction(tx) {
+		t.Error("finalized spend does not verify against the chain")
+	}
+}
+
+func TestPSBTKeyHashSpend(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	
+	tx, err := NewUnsignedTransaction(address(wallet), address(NewWallet()), 3, &UTXOSet{bc}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psbt, err := NewPSBT(tx, bc, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	if psbt.Sign(NewWallet()) != 0 {
+		t.Error("another key signed the input")
+	}
+	if _, err := psbt.Finalize(); err == nil {
+		t.Fatal("finalized an unsigned input")
+	}
+	if psbt.Sign(wallet) != 1 {
+		t.Fatal("the owner could not sign")
+	}
+	
+	signed, err := psbt.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bc.VerifyTransaction(signed) {
+		t.Error("finalized spend does not verify against the chain")
+	}
+}
+
+func TestPSBTChecks(t *testing.T) {
+	bc, redeemScript, _ := newMultisigFunds(t)
+	from := ScriptAddress(redeemScript)
+	
+	tx, err := NewUnsignedTransaction(from, address(NewWallet()), 4, &UTXOSet{bc}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPSBT(tx, bc, nil, nil); err == nil {
+		t.Error("created a script hash spend without its redeem script")
+	}
+	
+	psbt := newMultisigPSBT(t, bc, redeemScript, address(NewWallet()), 4)
+	other := newMultisigPSBT(t, bc, redeemScript, address(NewWallet()), 5)
+	if err := psbt.Combine(other); err == nil {
+		t.Error("combined two different transactions")
+	}
+	
+	if _, err := DeserializePSBT("not base64!"); err == nil {
+		t.Error("decoded garbage")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// mean delay before queued transactions are announced to a peer
+	invTrickleInterval = 2 * time.Second
+	// most items announced in one inv
+	maxInvItems = 1000
+	// inventory remembered per peer, the oldest is forgotten first
+	maxKnownInventory = 10000
+	// how long a requested transaction isn't asked of other peers
+	txRequestTimeout = time.Minute
+)
+
+// peerInventory is what a peer is known to have and what is waiting to be
+// announced to it
+type peerInventory struct {
+	known  map[string]bool
+	order  []string
+	queued [][]byte
+	// a trickle is scheduled
+	pending bool
+}
+
+func (p *peerInventory) add(id string) {
+	if p.known[id] {
+		return
+	}
+	if len(p.order) >= maxKnownInventory {
+		delete(p.known, p.order[0])
+		p.order = p.order[1:]
+	}
+	p.known[id] = true
+	p.order = append(p.order, id)
+}
+
+// InvRelay batches inventory announcements. Transactions are queued per peer
+// and announced together after a random delay, so a peer can't tell from the
+// timing which node a transaction came from. Nothing is announced to a peer
+// that already has it.
+type InvRelay struct {
+	mu        sync.Mutex
+	peers     map[string]*peerInventory
+	requested map[string]time.Time
+	rand      *rand.Rand
+}
+
+func NewInvRelay() *InvRelay {
+	return &InvRelay{
+		peers:     make(map[string]*peerInventory),
+		requested: make(map[string]time.Time),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (r *InvRelay) peer(addr string) *peerInventory {
+	p := r.peers[addr]
+	if p == nil {
+		p = &peerInventory{known: make(map[string]bool)}
+		r.peers[addr] = p
+	}
+	
+	return p
+}
+
+// MarkKnown records that addr has the items, because it announced or sent them
+func (r *InvRelay) MarkKnown(addr string, items [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	p := r.peer(addr)
+	for _, item := range items {
+		p.add(hex.EncodeToString(item))
+	}
+}
+
+// Knows tells whether addr is known to have item
+func (r *InvRelay) Knows(addr string, item []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	return r.peer(addr).known[hex.EncodeToString(item)]
+}
+
+// KnownCount is the number of items addr is known to have
+func (r *InvRelay) KnownCount(addr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	return len(r.peer(addr).known)
+}
+
+// QueueTx announces txid to addr with the next trickle
+func (r *InvRelay) QueueTx(addr string, txid []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	p := r.peer(addr)
+	id := hex.EncodeToString(txid)
+	if p.known[id] {
+		return
+	}
+	p.add(id)
+	p.queued = append(p.queued, txid)
+	
+	if !p.pending {
+		p.pending = true
+		time.AfterFunc(r.trickleDelay(), func() { r.flush(addr) })
+	}
+}
+
+// trickleDelay is exponentially distributed, as the gaps between independent
+// events are, and capped so nothing waits too long
+func (r *InvRelay) trickleDelay() time.Duration {
+	delay := time.Duration(r.rand.ExpFloat64() * float64(invTrickleInterval))
+	if delay > 4*invTrickleInterval {
+		delay = 4 * invTrickleInterval
+	}
+	
+	return delay
+}
+
+func (r *InvRelay) flush(addr string) {
+	r.mu.Lock()
+	p := r.peer(addr)
+	queued := p.queued
+	p.queued = nil
+	p.pending = false
+	r.mu.Unlock()
+	
+	for len(queued) > 0 {
+		n := len(queued)
+		if n > maxInvItems {
+			n = maxInvItems
+		}
+		sendInv(addr, "tx", queued[:n])
+		queued = queued[n:]
+	}
+}
+
+// RequestTx tells whether txid should be asked of a peer, it isn't if
+// another one was asked recently
+func (r *InvRelay) RequestTx(txid []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	now := time.Now()
+	for id, at := range r.requested {
+		if now.Sub(at) > txRequestTimeout {
+			delete(r.requested, id)
+		}
+	}
+	
+	id := hex.EncodeToString(txid)
+	if _, ok := r.requested[id]; ok {
+		return false
+	}
+	r.requested[id] = now
+	
+	return true
+}
+
+// TxReceived clears the request for txid
+func (r *InvRelay) TxReceived(txid []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	delete(r.requested, hex.EncodeToString(txid))
+}
+
+// announceBlock sends the new block to every peer that doesn't have it yet.
+// Blocks aren't trickled, they should spread as fast as possible.
+func announceBlock(hash []byte) {
+	for _, node := range knownPeers() {
+		if node != nodeAddress && !invRelay.Knows(node, hash) {
+			sendInv(node, "block", [][]byte{hash})
+		}
+	}
+}
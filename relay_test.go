@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInvRelayKnownInventory(t *testing.T) {
+	r := NewInvRelay()
+	r.MarkKnown("peer", [][]byte{[]byte("a")})
+	if !r.Knows("peer", []byte("a")) || r.Knows("other", []byte("a")) {
+		t.Fatal("inventory isn't tracked per peer")
+	}
+	
+	// a trickle already pending keeps the test off the network
+	r.peer("peer").pending = true
+	r.QueueTx("peer", []byte("a"))
+	r.QueueTx("peer", []byte("b"))
+	r.QueueTx("peer", []byte("b"))
+	if queued := r.peer("peer").queued; len(queued) != 1 || string(queued[0]) != "b" {
+		t.Errorf("queued %q, want only what the peer doesn't have", queued)
+	}
+	
+	for i := 0; i < maxKnownInventory; i++ {
+		r.MarkKnown("peer", [][]byte{[]byte(fmt.Sprint(i))})
+	}
+	if r.Knows("peer", []byte("a")) || !r.Knows("peer", []byte(fmt.Sprint(maxKnownInventory-1))) {
+		t.Error("the oldest inventory wasn't forgotten first")
+	}
+	if len(r.peer("peer").known) != maxKnownInventory {
+		t.Errorf("%d items known, want at most %d", len(r.peer("peer").known), maxKnownInventory)
+	}
+}
+
+func TestInvRelayRequestTx(t *testing.T) {
+	r := NewInvRelay()
+	if !r.RequestTx([]byte("a")) || r.RequestTx([]byte("a")) {
+		t.Fatal("a transaction was asked of two peers at once")
+	}
+	
+	r.TxReceived([]byte("a"))
+	if !r.RequestTx([]byte("a")) {
+		t.Error("a received transaction can't be asked for again")
+	}
+	
+	r.requested[hex.EncodeToString([]byte("a"))] = time.Now().Add(-2 * txRequestTimeout)
+	if !r.RequestTx([]byte("a")) {
+		t.Error("a timed out request still blocks asking another peer")
+	}
+}
+
+func TestTrickleDelayIsCapped(t *testing.T) {
+	r := NewInvRelay()
+	for i := 0; i < 1000; i++ {
+		if delay := r.trickleDelay(); delay < 0 || delay > 4*invTrickleInterval {
+			t.Fatalf("delay %s out of range", delay)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// page sizes of the list endpoints
+const (
+	defaultRESTLimit = 100
+	maxRESTLimit     = 1000
+	
+	// events an event stream client may fall behind by
+	eventStreamBuffer = 256
+	eventKeepAlive    = 30 * time.Second
+)
+
+// Page is a slice of a list endpoint, offset and limit come from the query
+type Page struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+type UTXOInfo struct {
+	Txid   string       `json:"txid"`
+	Vout   int          `json:"vout"`
+	Height int          `json:"height"`
+	Output TxOutputInfo `json:"output"`
+}
+
+type ChainInfo struct {
+	Chain         string `json:"chain"`
+	Blocks        int    `json:"blocks"`
+	BestBlockHash string `json:"bestblockhash"`
+	Bits          int    `json:"bits"`
+	MedianTime    int64  `json:"mediantime"`
+	Mempool       int    `json:"mempool"`
+}
+
+// StartRESTServer serves read-only chain data as JSON on address. It needs no
+// credentials and never touches the wallet.
+func StartRESTServer(address string, bc *BlockChain) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/block/", func(w http.ResponseWriter, r *http.Request) { restBlock(w, r, bc) })
+	mux.HandleFunc("/tx/", func(w http.ResponseWriter, r *http.Request) { restTx(w, r, bc) })
+	mux.HandleFunc("/address/", func(w http.ResponseWriter, r *http.Request) { restAddress(w, r, bc) })
+	mux.HandleFunc("/mempool", func(w http.ResponseWriter, r *http.Request) { restMempool(w, r) })
+	mux.HandleFunc("/chaininfo", func(w http.ResponseWriter, r *http.Request) { restChainInfo(w, r, bc) })
+	mux.HandleFunc("/events", restEvents)
+	
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			restError(w, http.StatusMethodNotAllowed, "only GET is supported")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}
+	
+	fmt.Printf("REST server listening on %s\n", address)
+	go func() {
+		err := http.ListenAndServe(address, http.HandlerFunc(handler))
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+}
+
+// restJSON writes v with an ETag of its content, or just 304 Not Modified
+// when the client has it already
+func restJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		restError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	
+	hash := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimSpace(match)
+		if match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+func restError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// restPage reads offset and limit from the query and bounds them to total
+func restPage(r *http.Request, total int) (int, int, error) {
+	offset, limit := 0, defaultRESTLimit
+	
+	var err error
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("bad offset %s", v)
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxRESTLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxRESTLimit)
+		}
+	}
+	if offset > total {
+		offset = total
+	}
+	
+	return offset, limit, nil
+}
+
+func pageEnd(offset, limit, total int) int {
+	if offset+limit > total {
+		return total
+	}
+	
+	return offset + limit
+}
+
+// restBlock serves /block/{hash} and /block/height/{n}
+func restBlock(w http.ResponseWriter, r *http.Request, bc *BlockChain) {
+	path := strings.TrimPrefix(r.URL.Path, "/block/")
+	
+	var block *Block
+	if strings.HasPrefix(path, "height/") {
+		height, err := strconv.Atoi(strings.TrimPrefix(path, "height/"))
+		if err != nil {
+			restError(w, http.StatusBadRequest, "height is not a number")
+			return
+		}
+		block, err = bc.GetBlockByHeight(height)
+		if err != nil {
+			restError(w, http.StatusNotFound, err.Error())
+			return
+		}
+	} else {
+		hash, err := hex.DecodeString(path)
+		if err != nil {
+			restError(w, http.StatusBadRequest, "hash is not hex")
+			return
+		}
+		b, err := bc.GetBlock(hash)
+		if err != nil {
+			restError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		block = &b
+	}
+	
+	restJSON(w, r, NewBlockInfo(block, bc.GetBestHeight()))
+}
+
+func restTx(w http.ResponseWriter, r *http.Request, bc *BlockChain) {
+	txid, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/tx/"))
+	if err != nil {
+		restError(w, http.StatusBadRequest, "transaction ID is not hex")
+		return
+	}
+	
+	info, err := lookupTransaction(bc, txid)
+	if err != nil {
+		restError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	
+	restJSON(w, r, info)
+}
+
+// restAddress serves /address/{addr}/utxos
+func restAddress(w http.ResponseWriter, r *http.Request, bc *BlockChain) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/address/"), "/")
+	if len(parts) != 2 || parts[1] != "utxos" {
+		restError(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+	if !ValidateAddress(parts[0]) {
+		restError(w, http.StatusBadRequest, "invalid address")
+		return
+	}
+	
+	UTXOSet := UTXOSet{bc}
+	UTXOs := UTXOSet.FindUnspent(AddressToPubKeyHash(parts[0]))
+	offset, limit, err := restPage(r, len(UTXOs))
+	if err != nil {
+		restError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	items := []UTXOInfo{}
+	for _, utxo := range UTXOs[offset:pageEnd(offset, limit, len(UTXOs))] {
+		items = append(items, UTXOInfo{hex.EncodeToString(utxo.Txid), utxo.Vout, utxo.Height, NewTxOutputInfo(utxo.Output)})
+	}
+	
+	restJSON(w, r, Page{len(UTXOs), offset, limit, items})
+}
+
+func restMempool(w http.ResponseWriter, r *http.Request) {
+	txids := []string{}
+	for txid := range mempool.Snapshot() {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+	
+	offset, limit, err := restPage(r, len(txids))
+	if err != nil {
+		restError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	restJSON(w, r, Page{len(txids), offset, limit, txids[offset:pageEnd(offset, limit, len(txids))]})
+}
+
+func restChainInfo(w http.ResponseWriter, r *http.Request, bc *BlockChain) {
+	tip, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		restError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	
+	restJSON(w, r, ChainInfo{
+		Chain:         activeNet.Name,
+		Blocks:        tip.Height,
+		BestBlockHash: hex.EncodeToString(tip.Hash),
+		Bits:          tip.Bits,
+		MedianTime:    bc.MedianTimePast(tip.Hash),
+		Mempool:       mempool.Count(),
+	})
+}
+
+// PaymentInfo is an output paying one of the addresses an event stream
+// watches, Confirmed once its block connects
+type PaymentInfo struct {
+	Txid      string `json:"txid"`
+	Vout      int    `json:"vout"`
+	Address   string `json:"address"`
+	Value     int    `json:"value"`
+	Confirmed bool   `json:"confirmed"`
+	BlockHash string `json:"blockhash,omitempty"`
+}
+
+// restEvents streams events as server-sent events. Every address in the
+// query adds payment events for the outputs paying it. A lagged event counts
+// the events a client too slow to keep up missed.
+func restEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		restError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	
+	watched := make(map[string]string)
+	for _, address := range r.URL.Query()["address"] {
+		if !ValidateAddress(address) {
+			restError(w, http.StatusBadRequest, "invalid address "+address)
+			return
+		}
+		watched[hex.EncodeToString(AddressToPubKeyHash(address))] = address
+	}
+	
+	ch, unsubscribe := events.Stream(eventStreamBuffer)
+	defer unsubscribe()
+	
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	
+	send := func(kind string, data interface{}) bool {
+		body, err := json.Marshal(data)
+		if err != nil {
+			log.Panic(err)
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, body)
+		return err == nil
+	}
+	
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case e := <-ch:
+			ok := true
+			var txs []*Transaction
+			var blockHash []byte
+			
+			switch e := e.(type) {
+			case BlockConnected:
+				ok = send("blockconnected", NewBlockInfo(e.Block, e.Block.Height))
+				txs, blockHash = e.Block.Transactions, e.Block.Hash
+			case BlockDisconnected:
+				info := NewBlockInfo(e.Block, e.Block.Height)
+				info.Confirmations = 0
+				ok = send("blockdisconnected", info)
+			case TipChanged:
+				ok = send("tipchanged", map[string]interface{}{"hash": hex.EncodeToString(e.Tip.Hash), "height": e.Tip.Height})
+			case TxAccepted:
+				ok = send("txaccepted", NewTxInfo(e.Tx))
+				txs = []*Transaction{e.Tx}
+			case TxRemoved:
+				ok = send("txremoved", map[string]string{"txid": hex.EncodeToString(e.Tx.ID)})
+			case Lagged:
+				ok = send("lagged", map[string]int{"missed": e.Missed})
+			}
+			
+			for _, tx := range txs {
+				for i, out := range tx.Vout {
+					address, watching := watched[hex.EncodeToString(out.PubKeyHash)]
+					if !ok || !watching || len(out.PubKeyHash) == 0 {
+						continue
+					}
+					payment := PaymentInfo{hex.EncodeToString(tx.ID), i, address, out.Value, blockHash != nil, hex.EncodeToString(blockHash)}
+					ok = send("payment", payment)
+				}
+			}
+			if !ok {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// restGet runs handler on a GET of path and decodes the JSON body into v
+func restGet(t *testing.T, handler http.HandlerFunc, path string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	
+	return w
+}
+
+func TestRESTBlock(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	blocks := bc.Generate(2, address(wallet))
+	handler := func(w http.ResponseWriter, r *http.Request) { restBlock(w, r, bc) }
+	
+	var byHash, byHeight BlockInfo
+	restGet(t, handler, "/block/"+hex.EncodeToString(blocks[0].Hash), &byHash)
+	restGet(t, handler, "/block/height/1", &byHeight)
+	if byHash.Height != 1 || byHash.Confirmations != 2 || byHeight.Hash != byHash.Hash {
+		t.Errorf("got %+v and %+v, want block 1 both ways", byHash, byHeight)
+	}
+	
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/block/nothex", http.StatusBadRequest},
+		{"/block/00", http.StatusNotFound},
+		{"/block/height/x", http.StatusBadRequest},
+		{"/block/height/3", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w := restGet(t, handler, test.path, nil); w.Code != test.code {
+			t.Errorf("%s: status %d, want %d", test.path, w.Code, test.code)
+		}
+	}
+}
+
+func TestRESTETag(t *testing.T) {
+	bc, _ := newTestChain(t)
+	handler := func(w http.ResponseWriter, r *http.Request) { restChainInfo(w, r, bc) }
+	
+	var info ChainInfo
+	w := restGet(t, handler, "/chaininfo", &info)
+	if info.Chain != RegtestParams.Name || info.BestBlockHash != hex.EncodeToString(bc.Tip()) {
+		t.Errorf("chain info %+v does not describe the test chain", info)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	
+	r := httptest.NewRequest(http.MethodGet, "/chaininfo", nil)
+	r.Header.Set("If-None-Match", `"other", `+etag)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("status %d with a matching ETag, want 304 and no body", w.Code)
+	}
+	
+	bc.Generate(1, address(NewWallet()))
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d after the chain changed, want 200", w.Code)
+	}
+}
+
+func TestRESTAddressPaging(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	bc.Generate(3, address(wallet))
+	handler := func(w http.ResponseWriter, r *http.Request) { restAddress(w, r, bc) }
+	path := "/address/" + address(wallet) + "/utxos"
+	
+	var page struct {
+		Total  int
+		Offset int
+		Limit  int
+		Items  []UTXOInfo
+	}
+	restGet(t, handler, path+"?offset=1&limit=2", &page)
+	if page.Total != 4 || page.Offset != 1 || page.Limit != 2 || len(page.Items) != 2 {
+		t.Errorf("page %+v, want 2 of the 4 coinbases from the second on", page)
+	}
+	restGet(t, handler, path+"?offset=9", &page)
+	if page.Total != 4 || len(page.Items) != 0 {
+		t.Errorf("page %+v, want no items past the end", page)
+	}
+	
+	for _, bad := range []string{path + "?limit=0", path + "?limit=1001", path + "?offset=-1", "/address/x/utxos"} {
+		if w := restGet(t, handler, bad, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", bad, w.Code)
+		}
+	}
+	if w := restGet(t, handler, "/address/"+address(wallet), nil); w.Code != http.StatusNotFound {
+		t.Errorf("status %d for an unknown endpoint, want 404", w.Code)
+	}
+}
+
+func TestRESTTxAndMempool(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, _ := bc.GetBlock(bc.Tip())
+	tx := newTestTx(wallet, genesis.Transactions[0], []int{0}, activeNet.Subsidy)
+	if err := mempool.Accept(bc, *tx); err != nil {
+		t.Fatal(err)
+	}
+	txHandler := func(w http.ResponseWriter, r *http.Request) { restTx(w, r, bc) }
+	
+	var mined, pending TxInfo
+	restGet(t, txHandler, "/tx/"+hex.EncodeToString(genesis.Transactions[0].ID), &mined)
+	restGet(t, txHandler, "/tx/"+hex.EncodeToString(tx.ID), &pending)
+	if mined.BlockHash != hex.EncodeToString(genesis.Hash) || pending.Txid != hex.EncodeToString(tx.ID) || pending.BlockHash != "" {
+		t.Errorf("got %+v and %+v, want the genesis coinbase and the mempool transaction", mined, pending)
+	}
+	if w := restGet(t, txHandler, "/tx/00", nil); w.Code != http.StatusNotFound {
+		t.Errorf("status %d for an unknown transaction, want 404", w.Code)
+	}
+	
+	var page struct {
+		Total int
+		Items []string
+	}
+	restGet(t, restMempool, "/mempool", &page)
+	if page.Total != 1 || len(page.Items) != 1 || page.Items[0] != hex.EncodeToString(tx.ID) {
+		t.Errorf("mempool page %+v, want the pending transaction", page)
+	}
+}
+
+func TestRESTEventsStream(t *testing.T) {
+	wallet := NewWallet()
+	server := httptest.NewServer(http.HandlerFunc(restEvents))
+	defer server.Close()
+	
+	if resp, err := http.Get(server.URL + "/events?address=x"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("watching an invalid address: %v", err)
+	}
+	
+	resp, err := http.Get(server.URL + "/events?address=" + address(wallet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("content type %s, want an event stream", resp.Header.Get("Content-Type"))
+	}
+	
+	tx := NewCoinbaseTx(address(wallet), "")
+	events.Publish(TxAccepted{tx})
+	
+	reader := bufio.NewReader(resp.Body)
+	for _, want := range []string{"txaccepted", "payment"} {
+		kind, _ := reader.ReadString('\n')
+		data, _ := reader.ReadString('\n')
+		reader.ReadString('\n')
+		if kind != "event: "+want+"\n" {
+			t.Fatalf("got %q, want a %s event", kind, want)
+		}
+		if want == "payment" {
+			var payment PaymentInfo
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &payment); err != nil {
+				t.Fatal(err)
+			}
+			if payment.Txid != hex.EncodeToString(tx.ID) || payment.Address != address(wallet) || payment.Confirmed {
+				t.Errorf("payment %+v, want the unconfirmed coinbase", payment)
+			}
+		}
+	}
+}
@@ -0,0 +1,1245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcMiscError      = -1
+	rpcWalletError    = -4
+	rpcNotFound       = -5
+)
+
+// user name of the credentials in the cookie file
+const cookieUser = "__cookie__"
+
+// RPCConfig tells where the node serves JSON-RPC and who may call it. The
+// node writes a random cookie for local clients either way, User and
+// Password are accepted on top of it when set.
+type RPCConfig struct {
+	Port     string
+	User     string
+	Password string
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+type rpcHandler func(bc *BlockChain, params json.RawMessage) (interface{}, error)
+
+var rpcHandlers map[string]rpcHandler
+
+func init() {
+	rpcHandlers = map[string]rpcHandler{
+		"auditcontract":      rpcAuditContract,
+		"createpsbt":         rpcCreatePSBT,
+		"fundcontract":       rpcFundContract,
+		"generate":           rpcGenerate,
+		"getbalance":         rpcGetBalance,
+		"getbestblockhash":   rpcGetBestBlockHash,
+		"getblock":           rpcGetBlock,
+		"getblockcount":      rpcGetBlockCount,
+		"getblockhash":       rpcGetBlockHash,
+		"getblocktemplate":   rpcGetBlockTemplate,
+		"getmempoolinfo":     rpcGetMempoolInfo,
+		"getnewaddress":      rpcGetNewAddress,
+		"getpeerinfo":        rpcGetPeerInfo,
+		"getrawmempool":      rpcGetRawMempool,
+		"gettransaction":     rpcGetTransaction,
+		"gettxproof":         rpcGetTxProof,
+		"listaddresses":      rpcListAddresses,
+		"reindexutxo":        rpcReindexUTXO,
+		"sendrawtransaction": rpcSendRawTransaction,
+		"sendtoaddress":      rpcSendToAddress,
+		"spendcontract":      rpcSpendContract,
+		"submitblock":        rpcSubmitBlock,
+		"timestamp":          rpcTimestamp,
+		"verifytimestamp":    rpcVerifyTimestamp,
+	}
+}
+
+// the wallet file of the node, RPC calls load and save it under walletsLock
+var (
+	rpcNodeID   string
+	walletsLock sync.Mutex
+)
+
+// StartRPCServer serves JSON-RPC 2.0 requests posted to / on localhost:Port
+// and writes the cookie file local clients authenticate with
+func StartRPCServer(config RPCConfig, nodeID string, bc *BlockChain) {
+	address := fmt.Sprintf("localhost:%s", config.Port)
+	rpcNodeID = nodeID
+	
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.Panic(err)
+	}
+	cookie := hex.EncodeToString(secret)
+	
+	cookieFile := fmt.Sprintf(activeNet.CookieFile, nodeID)
+	err = ioutil.WriteFile(cookieFile, []byte(fmt.Sprintf("%s\n%s:%s\n", address, cookieUser, cookie)), 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	authorized := func(r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return false
+		}
+		if secureCompare(user, cookieUser) && secureCompare(password, cookie) {
+			return true
+		}
+		
+		return config.Password != "" && secureCompare(user, config.User) && secureCompare(password, config.Password)
+	}
+	
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cyain"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		
+		var request rpcRequest
+		response := rpcResponse{JSONRPC: "2.0"}
+		
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			response.Error = &rpcError{rpcParseError, err.Error()}
+		} else {
+			response.ID = request.ID
+			response.Result, response.Error = callRPC(bc, &request)
+		}
+		
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(response)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	
+	// the wallet forgets the pending transactions that got mined
+	events.OnUTXOSetChanged(func(e UTXOSetChanged) {
+		// the handler publishing this may hold the wallet already
+		go syncWallet(e.Chain)
+	})
+	
+	fmt.Printf("RPC server listening on %s, cookie in %s\n", address, cookieFile)
+	go func() {
+		err := http.ListenAndServe(address, http.HandlerFunc(handler))
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+}
+
+// callRPC runs the handler of request. Chain and wallet code panics on what
+// it can't go on with, the caller gets that as an error.
+func callRPC(bc *BlockChain, request *rpcRequest) (result interface{}, rerr *rpcError) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, rerr = nil, &rpcError{rpcMiscError, fmt.Sprint(r)}
+		}
+	}()
+	
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return nil, &rpcError{rpcInvalidRequest, "invalid JSON-RPC 2.0 request"}
+	}
+	
+	handler, ok := rpcHandlers[request.Method]
+	if !ok {
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method %s not found", request.Method)}
+	}
+	
+	result, err := handler(bc, request.Params)
+	if err != nil {
+		if errors.As(err, &rerr) {
+			return nil, rerr
+		}
+		return nil, &rpcError{rpcMiscError, err.Error()}
+	}
+	
+	return result, nil
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func parseParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return &rpcError{rpcInvalidParams, "missing params"}
+	}
+	
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return &rpcError{rpcInvalidParams, err.Error()}
+	}
+	
+	return nil
+}
+
+// =========
+// chain
+// =========
+
+// BlockInfo is the JSON view of a block
+type BlockInfo struct {
+	Hash          string   `json:"hash"`
+	Height        int      `json:"height"`
+	Confirmations int      `json:"confirmations"`
+	PrevBlockHash string   `json:"previousblockhash,omitempty"`
+	MerkleRoot    string   `json:"merkleroot"`
+	Time          int64    `json:"time"`
+	Bits          int      `json:"bits"`
+	Nonce         int      `json:"nonce"`
+	Transactions  []string `json:"tx"`
+}
+
+func NewBlockInfo(b *Block, bestHeight int) BlockInfo {
+	info := BlockInfo{
+		Hash:          hex.EncodeToString(b.Hash),
+		Height:        b.Height,
+		Confirmations: bestHeight - b.Height + 1,
+		PrevBlockHash: hex.EncodeToString(b.PrevBlockHash),
+		MerkleRoot:    hex.EncodeToString(b.HashTransaction()),
+		Time:          b.Timestamp,
+		Bits:          b.Bits,
+		Nonce:         b.Nonce,
+	}
+	for _, tx := range b.Transactions {
+		info.Transactions = append(info.Transactions, hex.EncodeToString(tx.ID))
+	}
+	
+	return info
+}
+
+type TxInputInfo struct {
+	Txid string `json:"txid,omitempty"`
+	Vout int    `json:"vout"`
+}
+
+type TxOutputInfo struct {
+	Value   int    `json:"value"`
+	Address string `json:"address,omitempty"`
+	Script  string `json:"script,omitempty"`
+}
+
+// TxInfo is the JSON view of a transaction, with the block holding it if it
+// is mined
+type TxInfo struct {
+	Txid          string         `json:"txid"`
+	Hex           string         `json:"hex"`
+	Coinbase      bool           `json:"coinbase,omitempty"`
+	Vin           []TxInputInfo  `json:"vin"`
+	Vout          []TxOutputInfo `json:"vout"`
+	BlockHash     string         `json:"blockhash,omitempty"`
+	Height        int            `json:"height,omitempty"`
+	Confirmations int            `json:"confirmations"`
+}
+
+func NewTxInfo(tx *Transaction) TxInfo {
+	info := TxInfo{
+		Txid:     hex.EncodeToString(tx.ID),
+		Hex:      hex.EncodeToString(tx.Serialize()),
+		Coinbase: tx.IsCoinbase(),
+	}
+	for _, vin := range tx.Vin {
+		info.Vin = append(info.Vin, TxInputInfo{hex.EncodeToString(vin.Txid), vin.Vout})
+	}
+	for _, out := range tx.Vout {
+		info.Vout = append(info.Vout, NewTxOutputInfo(out))
+	}
+	
+	return info
+}
+
+func NewTxOutputInfo(out TxOutput) TxOutputInfo {
+	info := TxOutputInfo{Value: out.Value, Script: hex.EncodeToString(out.Script)}
+	if isPayToScriptHash(out.Script) {
+		info.Address = string(encodeAddress(activeNet.ScriptHashVersion, out.PubKeyHash))
+	} else if len(out.PubKeyHash) > 0 {
+		info.Address = string(encodeAddress(activeNet.AddressVersion, out.PubKeyHash))
+	}
+	
+	return info
+}
+
+// blockHashParam decodes the hex hash param of getblock and friends
+func blockHashParam(params json.RawMessage) ([]byte, error) {
+	var args struct {
+		Hash string `json:"hash"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	
+	hash, err := hex.DecodeString(args.Hash)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "hash is not hex"}
+	}
+	
+	return hash, nil
+}
+
+func rpcGetBlockCount(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	return bc.GetBestHeight(), nil
+}
+
+func rpcGetBestBlockHash(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	return hex.EncodeToString(bc.Tip()), nil
+}
+
+func rpcGetBlockHash(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Height int `json:"height"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	
+	block, err := bc.GetBlockByHeight(args.Height)
+	if err != nil {
+		return nil, &rpcError{rpcNotFound, err.Error()}
+	}
+	
+	return hex.EncodeToString(block.Hash), nil
+}
+
+func rpcGetBlock(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	hash, err := blockHashParam(params)
+	if err != nil {
+		return nil, err
+	}
+	
+	block, err := bc.GetBlock(hash)
+	if err != nil {
+		return nil, &rpcError{rpcNotFound, err.Error()}
+	}
+	
+	return NewBlockInfo(&block, bc.GetBestHeight()), nil
+}
+
+func rpcGetTransaction(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Txid string `json:"txid"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	txid, err := hex.DecodeString(args.Txid)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "txid is not hex"}
+	}
+	
+	info, err := lookupTransaction(bc, txid)
+	if err != nil {
+		return nil, &rpcError{rpcNotFound, err.Error()}
+	}
+	
+	return info, nil
+}
+
+// lookupTransaction finds txid in the mempool or the chain
+func lookupTransaction(bc *BlockChain, txid []byte) (TxInfo, error) {
+	if tx, ok := mempool.Get(hex.EncodeToString(txid)); ok {
+		return NewTxInfo(&tx), nil
+	}
+	
+	block, index, err := bc.FindTransactionBlock(txid)
+	if err != nil {
+		return TxInfo{}, err
+	}
+	info := NewTxInfo(block.Transactions[index])
+	info.BlockHash = hex.EncodeToString(block.Hash)
+	info.Height = block.Height
+	info.Confirmations = bc.GetBestHeight() - block.Height + 1
+	
+	return info, nil
+}
+
+type MempoolInfo struct {
+	Size  int `json:"size"`
+	Bytes int `json:"bytes"`
+}
+
+func rpcGetMempoolInfo(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	info := MempoolInfo{}
+	for _, tx := range mempool.Snapshot() {
+		info.Size++
+		info.Bytes += len(tx.Serialize())
+	}
+	
+	return info, nil
+}
+
+func rpcGetRawMempool(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	txids := []string{}
+	for txid := range mempool.Snapshot() {
+		txids = append(txids, txid)
+	}
+	
+	return txids, nil
+}
+
+// MerkleStepInfo is the JSON view of a MerkleStep
+type MerkleStepInfo struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// TxProofInfo is the JSON view of the merkle proof of the transaction at Index
+// of a block
+type TxProofInfo struct {
+	Txid       string           `json:"txid"`
+	BlockHash  string           `json:"blockhash"`
+	Height     int              `json:"height"`
+	Time       int64            `json:"time"`
+	Index      int              `json:"index"`
+	MerkleRoot string           `json:"merkleroot"`
+	Leaf       string           `json:"leaf"`
+	Proof      []MerkleStepInfo `json:"proof"`
+}
+
+func NewTxProofInfo(block *Block, index int, proof []MerkleStep) TxProofInfo {
+	info := TxProofInfo{
+		Txid:       hex.EncodeToString(block.Transactions[index].ID),
+		BlockHash:  hex.EncodeToString(block.Hash),
+		Height:     block.Height,
+		Time:       block.Timestamp,
+		Index:      index,
+		MerkleRoot: hex.EncodeToString(block.HashTransaction()),
+		Leaf:       hex.EncodeToString(hashMerkleLeaf(block.Transactions[index].Serialize())),
+		Proof:      []MerkleStepInfo{},
+	}
+	for _, step := range proof {
+		info.Proof = append(info.Proof, MerkleStepInfo{hex.EncodeToString(step.Hash), step.Left})
+	}
+	
+	return info
+}
+
+// TxProof proves that the transaction txid is in the chain
+func (bc *BlockChain) TxProof(txid []byte) (TxProofInfo, error) {
+	block, index, err := bc.FindTransactionBlock(txid)
+	if err != nil {
+		return TxProofInfo{}, err
+	}
+	proof, err := block.MerkleTree().Proof(index)
+	if err != nil {
+		return TxProofInfo{}, err
+	}
+	
+	return NewTxProofInfo(block, index, proof), nil
+}
+
+func rpcGetTxProof(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Txid string `json:"txid"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	txid, err := hex.DecodeString(args.Txid)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "txid is not hex"}
+	}
+	
+	info, err := bc.TxProof(txid)
+	if err != nil {
+		return nil, &rpcError{rpcNotFound, err.Error()}
+	}
+	
+	return info, nil
+}
+
+func rpcVerifyTimestamp(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Hash string `json:"hash"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(args.Hash)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "hash is not hex"}
+	}
+	
+	proof, err := bc.FindTimestamp(hash)
+	if err != nil {
+		return nil, &rpcError{rpcNotFound, err.Error()}
+	}
+	
+	return NewTxProofInfo(proof.Block, proof.Index, proof.Path), nil
+}
+
+// ContractAudit is what the chain tells about a hash time-locked contract
+type ContractAudit struct {
+	Address    string `json:"address"`
+	Recipient  string `json:"recipient"`
+	Refund     string `json:"refund"`
+	SecretHash string `json:"secrethash"`
+	LockTime   int64  `json:"locktime"`
+	Funds      int    `json:"funds"`
+	// revealed once the recipient redeemed the contract
+	Secret string `json:"secret,omitempty"`
+}
+
+func NewContractAudit(bc *BlockChain, contract *HTLC) ContractAudit {
+	audit := ContractAudit{
+		Address:    contract.Address(),
+		Recipient:  string(encodeAddress(activeNet.AddressVersion, contract.Recipient)),
+		Refund:     string(encodeAddress(activeNet.AddressVersion, contract.Refund)),
+		SecretHash: hex.EncodeToString(contract.SecretHash),
+		LockTime:   contract.LockTime,
+		Funds:      contract.Funds(&UTXOSet{bc}),
+	}
+	if secret, err := bc.FindHTLCSecret(contract); err == nil {
+		audit.Secret = hex.EncodeToString(secret)
+	}
+	
+	return audit
+}
+
+// contractParam decodes the hex redeem script param of the contract calls
+func contractParam(contractHex string) (*HTLC, error) {
+	script, err := hex.DecodeString(contractHex)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "contract is not hex"}
+	}
+	contract, err := ParseHTLC(script)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	
+	return contract, nil
+}
+
+func rpcAuditContract(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Contract string `json:"contract"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	contract, err := contractParam(args.Contract)
+	if err != nil {
+		return nil, err
+	}
+	
+	return NewContractAudit(bc, contract), nil
+}
+
+// rpcSendRawTransaction puts a signed transaction in the mempool and relays
+// it, or with mineto set mines it right away with the reward going there
+func rpcSendRawTransaction(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Hex    string `json:"hex"`
+		MineTo string `json:"mineto"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(args.Hex)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "hex is not hex"}
+	}
+	if args.MineTo != "" && !ValidateAddress(args.MineTo) {
+		return nil, &rpcError{rpcInvalidParams, "invalid mineto address"}
+	}
+	tx := DeserializeTransaction(data)
+	
+	if args.MineTo != "" {
+		if !bc.VerifyTransaction(&tx) {
+			return nil, errors.New("invalid transaction")
+		}
+		err = bc.CheckLocks(&tx, bc.GetBestHeight()+1, bc.MedianTimePast(bc.Tip()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = submitTransaction(bc, &tx, nil, args.MineTo, args.MineTo != "")
+	if err != nil {
+		return nil, err
+	}
+	
+	return hex.EncodeToString(tx.ID), nil
+}
+
+func rpcReindexUTXO(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.Reindex()
+	
+	return UTXOSet.CountTransactions(), nil
+}
+
+// submitTransaction mines tx and pending right away with the reward going to
+// rewardAddress, or puts tx in the mempool and relays it
+func submitTransaction(bc *BlockChain, tx *Transaction, pending map[string]Transaction, rewardAddress string, mine bool) error {
+	if mine {
+		block := mineTransaction(bc, tx, pending, rewardAddress)
+		announceBlock(block.Hash)
+		
+		// the template leaves out transactions whose inputs are already spent
+		for _, blockTx := range block.Transactions {
+			if bytes.Equal(blockTx.ID, tx.ID) {
+				return nil
+			}
+		}
+		return errors.New("transaction conflicts with the chain and was not mined")
+	}
+	
+	err := mempool.Accept(bc, *tx)
+	if err != nil {
+		return err
+	}
+	relayTransaction(tx, "")
+	
+	return nil
+}
+
+// =========
+// wallet
+// =========
+
+func rpcGetBalance(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Address string `json:"address"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(args.Address) {
+		return nil, &rpcError{rpcInvalidParams, "invalid address"}
+	}
+	
+	UTXOSet := UTXOSet{bc}
+	balance := 0
+	for _, out := range UTXOSet.FindUTXO(AddressToPubKeyHash(args.Address)) {
+		balance += out.Value
+	}
+	
+	return balance, nil
+}
+
+func rpcListAddresses(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	walletsLock.Lock()
+	defer walletsLock.Unlock()
+	
+	wallets, err := NewWallets(rpcNodeID)
+	if err != nil {
+		return nil, &rpcError{rpcWalletError, err.Error()}
+	}
+	
+	return wallets.GetAddresses(), nil
+}
+
+func rpcGetNewAddress(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	walletsLock.Lock()
+	defer walletsLock.Unlock()
+	
+	wallets, err := NewWallets(rpcNodeID)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, &rpcError{rpcWalletError, err.Error()}
+	}
+	address := wallets.CreateWallet()
+	wallets.SaveToFile(rpcNodeID)
+	
+	return address, nil
+}
+
+// rpcSendToAddress pays amount from a key of the node's wallet, puts the
+// transaction in the mempool and relays it, or with mine set mines it right
+// away with the reward going to from. It returns the transaction ID.
+func rpcSendToAddress(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		From   string `json:"from"`
+		To     string `json:"to"`
+		Amount int    `json:"amount"`
+		Mine   bool   `json:"mine"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(args.From) || !ValidateAddress(args.To) || args.Amount <= 0 {
+		return nil, &rpcError{rpcInvalidParams, "need valid from and to addresses and a positive amount"}
+	}
+	
+	walletsLock.Lock()
+	defer walletsLock.Unlock()
+	
+	wallets, wallet, err := loadWallet(args.From)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := newWalletTransaction(bc, wallets, wallet, args.From, args.To, args.Amount)
+	if err != nil {
+		return nil, err
+	}
+	err = submitWalletTransaction(bc, wallets, tx, args.From, args.Mine)
+	if err != nil {
+		return nil, err
+	}
+	
+	return hex.EncodeToString(tx.ID), nil
+}
+
+func syncWallet(bc *BlockChain) {
+	walletsLock.Lock()
+	defer walletsLock.Unlock()
+	
+	wallets, err := NewWallets(rpcNodeID)
+	if err != nil {
+		return
+	}
+	UTXOSet := UTXOSet{bc}
+	wallets.SyncPending(&UTXOSet)
+	wallets.SaveToFile(rpcNodeID)
+}
+
+// loadWallet loads the wallet of the node and the key of address from it, the
+// caller holds walletsLock
+func loadWallet(address string) (*Wallets, *Wallet, error) {
+	wallets, err := NewWallets(rpcNodeID)
+	if err != nil {
+		return nil, nil, &rpcError{rpcWalletError, err.Error()}
+	}
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		return nil, nil, &rpcError{rpcWalletError, "the wallet has no key for " + address}
+	}
+	
+	return wallets, wallet, nil
+}
+
+// newWalletTransaction pays amount from the key wallet of address from to to,
+// spending unconfirmed change of the pending transactions too
+func newWalletTransaction(bc *BlockChain, wallets *Wallets, wallet *Wallet, from, to string, amount int) (*Transaction, error) {
+	UTXOSet := UTXOSet{bc}
+	wallets.SyncPending(&UTXOSet)
+	
+	tx, err := NewUnsignedTransaction(from, to, amount, &UTXOSet, wallets.Pending)
+	if err != nil {
+		return nil, &rpcError{rpcWalletError, err.Error()}
+	}
+	for i := range tx.Vin {
+		tx.Vin[i].PubKey = wallet.PublicKey
+	}
+	tx.ID = tx.Hash()
+	bc.SignTransactionWith(tx, wallet.PrivateKey, wallets.Pending)
+	
+	return tx, nil
+}
+
+// submitWalletTransaction submits tx of the wallet, which tracks it as
+// pending until it is mined
+func submitWalletTransaction(bc *BlockChain, wallets *Wallets, tx *Transaction, from string, mine bool) error {
+	err := submitTransaction(bc, tx, wallets.Pending, from, mine)
+	if err != nil {
+		return err
+	}
+	if !mine {
+		wallets.AddPending(tx)
+		wallets.SaveToFile(rpcNodeID)
+	}
+	
+	return nil
+}
+
+// rpcTimestamp records hash in a data output paid for by from and returns the
+// transaction ID
+func rpcTimestamp(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		From string `json:"from"`
+		Hash string `json:"hash"`
+		Mine bool   `json:"mine"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(args.Hash)
+	if err != nil || len(hash) == 0 || len(hash) > maxDataCarrierSize {
+		return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("hash must be hex of up to %d bytes", maxDataCarrierSize)}
+	}
+	if !ValidateAddress(args.From) || IsScriptAddress(args.From) {
+		return nil, &rpcError{rpcInvalidParams, "invalid from address"}
+	}
+	
+	walletsLock.Lock()
+	defer walletsLock.Unlock()
+	
+	wallets, wallet, err := loadWallet(args.From)
+	if err != nil {
+		return nil, err
+	}
+	UTXOSet := UTXOSet{bc}
+	wallets.SyncPending(&UTXOSet)
+	
+	tx := NewDataTransaction(wallet, hash, &UTXOSet, wallets.Pending)
+	err = submitWalletTransaction(bc, wallets, tx, args.From, args.Mine)
+	if err != nil {
+		return nil, err
+	}
+	
+	return hex.EncodeToString(tx.ID), nil
+}
+
+// ContractInfo describes a funded hash time-locked contract
+type ContractInfo struct {
+	Contract string `json:"contract"`
+	Address  string `json:"address"`
+	Txid     string `json:"txid"`
+	LockTime int64  `json:"locktime"`
+}
+
+// rpcFundContract pays amount into a contract that to can redeem with the
+// preimage of secrethash and from can refund after lockfor seconds
+func rpcFundContract(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		From       string `json:"from"`
+		To         string `json:"to"`
+		Amount     int    `json:"amount"`
+		SecretHash string `json:"secrethash"`
+		LockFor    int64  `json:"lockfor"`
+		Mine       bool   `json:"mine"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	secretHash, err := hex.DecodeString(args.SecretHash)
+	if err != nil || len(secretHash) != sha256.Size {
+		return nil, &rpcError{rpcInvalidParams, "secrethash is not a SHA-256 hash"}
+	}
+	if !ValidateAddress(args.From) || IsScriptAddress(args.From) || !ValidateAddress(args.To) || IsScriptAddress(args.To) || args.Amount <= 0 {
+		return nil, &rpcError{rpcInvalidParams, "need valid from and to addresses and a positive amount"}
+	}
+	
+	walletsLock.Lock()
+	defer walletsLock.Unlock()
+	
+	wallets, wallet, err := loadWallet(args.From)
+	if err != nil {
+		return nil, err
+	}
+	
+	contract := &HTLC{
+		SecretHash: secretHash,
+		Recipient:  AddressToPubKeyHash(args.To),
+		Refund:     AddressToPubKeyHash(args.From),
+		LockTime:   time.Now().Unix() + args.LockFor,
+	}
+	tx, err := newWalletTransaction(bc, wallets, wallet, args.From, contract.Address(), args.Amount)
+	if err != nil {
+		return nil, err
+	}
+	err = submitWalletTransaction(bc, wallets, tx, args.From, args.Mine)
+	if err != nil {
+		return nil, err
+	}
+	
+	return ContractInfo{hex.EncodeToString(contract.Script()), contract.Address(), hex.EncodeToString(tx.ID), contract.LockTime}, nil
+}
+
+// rpcSpendContract redeems a contract with secret, or refunds it when secret
+// is empty, paying fee out of its coins, and returns the transaction ID
+func rpcSpendContract(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Contract string `json:"contract"`
+		Secret   string `json:"secret"`
+		Fee      int    `json:"fee"`
+		Mine     bool   `json:"mine"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	contract, err := contractParam(args.Contract)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hex.DecodeString(args.Secret)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "secret is not hex"}
+	}
+	owner := contract.Refund
+	if len(secret) > 0 {
+		owner = contract.Recipient
+	}
+	
+	walletsLock.Lock()
+	defer walletsLock.Unlock()
+	
+	wallets, err := NewWallets(rpcNodeID)
+	if err != nil {
+		return nil, &rpcError{rpcWalletError, err.Error()}
+	}
+	wallet := wallets.FindWallet(owner)
+	if wallet == nil {
+		return nil, &rpcError{rpcWalletError, "the wallet has no key for this contract"}
+	}
+	
+	tx, err := NewHTLCSpend(contract, wallet, secret, args.Fee, &UTXOSet{bc})
+	if err != nil {
+		return nil, &rpcError{rpcWalletError, err.Error()}
+	}
+	err = bc.CheckLocks(tx, bc.GetBestHeight()+1, bc.MedianTimePast(bc.Tip()))
+	if err != nil {
+		return nil, err
+	}
+	err = submitTransaction(bc, tx, nil, string(wallet.GetAddress()), args.Mine)
+	if err != nil {
+		return nil, err
+	}
+	
+	return hex.EncodeToString(tx.ID), nil
+}
+
+// rpcCreatePSBT returns a partially signed transaction paying amount from
+// from to to, for the keys of from to sign wherever they are
+func rpcCreatePSBT(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		From     string `json:"from"`
+		To       string `json:"to"`
+		Amount   int    `json:"amount"`
+		LockTime int64  `json:"locktime"`
+		Sequence uint32 `json:"sequence"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(args.From) || !ValidateAddress(args.To) || args.Amount <= 0 {
+		return nil, &rpcError{rpcInvalidParams, "need valid from and to addresses and a positive amount"}
+	}
+	
+	walletsLock.Lock()
+	wallets, err := NewWallets(rpcNodeID)
+	walletsLock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, &rpcError{rpcWalletError, err.Error()}
+	}
+	
+	psbt, err := NewPSBTTransaction(bc, args.From, args.To, args.Amount, args.LockTime, args.Sequence, wallets.Scripts)
+	if err != nil {
+		return nil, &rpcError{rpcWalletError, err.Error()}
+	}
+	
+	return psbt.Serialize(), nil
+}
+
+// =========
+// network
+// =========
+
+type PeerInfo struct {
+	Address      string `json:"addr"`
+	KnownInvSize int    `json:"knowninv"`
+}
+
+func rpcGetPeerInfo(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	peers := []PeerInfo{}
+	for _, node := range knownPeers() {
+		if node != nodeAddress {
+			peers = append(peers, PeerInfo{node, invRelay.KnownCount(node)})
+		}
+	}
+	
+	return peers, nil
+}
+
+// =========
+// mining
+// =========
+
+// BlockTemplate is the work handed to external miners. Header is the block
+// header without the nonce, a miner appends the nonce as 8 big endian bytes
+// and hashes the result with SHA-256 until it is below Target.
+type BlockTemplate struct {
+	ID            string   `json:"id"`
+	Height        int      `json:"height"`
+	PrevBlockHash string   `json:"previousblockhash"`
+	Timestamp     int64    `json:"curtime"`
+	Bits          int      `json:"bits"`
+	Target        string   `json:"target"`
+	Header        string   `json:"header"`
+	Transactions  []string `json:"transactions"`
+}
+
+// most templates kept for submitblock, every getblocktemplate call makes a new
+// one with its own coinbase
+const maxTemplates = 32
+
+// templates handed out for the current tip, by ID, with their IDs oldest first
+var (
+	templatesMu   sync.Mutex
+	templates     = make(map[string]*Block)
+	templateOrder []string
+)
+
+func rpcGetBlockTemplate(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Address string `json:"address"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(args.Address) {
+		return nil, &rpcError{rpcInvalidParams, "invalid payout address"}
+	}
+	
+	if _, ok := bc.engine.(*PowEngine); !ok {
+		return nil, errors.New("external mining needs a proof-of-work chain")
+	}
+	
+	tip, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		return nil, err
+	}
+	
+	txs := bc.NewBlockTemplate(mempool.Snapshot(), maxBlockSize)
+	cbTx := NewCoinbaseTx(args.Address, "")
+	txs = append([]*Transaction{cbTx}, txs...)
+	
+	block := &Block{
+		Timestamp:     time.Now().Unix(),
+		Transactions:  txs,
+		PrevBlockHash: tip.Hash,
+		Height:        tip.Height + 1,
+		Bits:          bc.engine.Difficulty(&tip),
+	}
+	pow := NewProofOfWork(block)
+	header := pow.prepareData(block.Timestamp, 0)
+	id := hex.EncodeToString(block.HashTransaction())
+	
+	templatesMu.Lock()
+	order := []string{}
+	for _, templateID := range templateOrder {
+		if bytes.Compare(templates[templateID].PrevBlockHash, tip.Hash) != 0 {
+			delete(templates, templateID)
+		} else {
+			order = append(order, templateID)
+		}
+	}
+	for len(order) >= maxTemplates {
+		delete(templates, order[0])
+		order = order[1:]
+	}
+	templates[id] = block
+	templateOrder = append(order, id)
+	templatesMu.Unlock()
+	
+	template := BlockTemplate{
+		ID:            id,
+		Height:        block.Height,
+		PrevBlockHash: hex.EncodeToString(block.PrevBlockHash),
+		Timestamp:     block.Timestamp,
+		Bits:          block.Bits,
+		Target:        fmt.Sprintf("%064x", pow.target),
+		Header:        hex.EncodeToString(header[:len(header)-8]),
+	}
+	for _, tx := range txs {
+		template.Transactions = append(template.Transactions, hex.EncodeToString(tx.Serialize()))
+	}
+	
+	return template, nil
+}
+
+func rpcSubmitBlock(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		ID    string `json:"id"`
+		Nonce int    `json:"nonce"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	
+	templatesMu.Lock()
+	template, ok := templates[args.ID]
+	templatesMu.Unlock()
+	if !ok {
+		return nil, errors.New("unknown or stale template")
+	}
+	
+	block := *template
+	block.Nonce = args.Nonce
+	pow := NewProofOfWork(&block)
+	hash := sha256.Sum256(pow.prepareData(block.Timestamp, block.Nonce))
+	block.Hash = hash[:]
+	
+	err = bc.ConnectBlock(&block)
+	if err != nil {
+		return nil, err
+	}
+	
+	fmt.Printf("Accepted block %x from an external miner\n", block.Hash)
+	announceBlock(block.Hash)
+	
+	return hex.EncodeToString(block.Hash), nil
+}
+
+func rpcGenerate(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		N       int    `json:"n"`
+		Address string `json:"address"`
+	}
+	err := parseParams(params, &args)
+	if err != nil {
+		return nil, err
+	}
+	if activeNet != &RegtestParams {
+		return nil, errors.New("generate is only available on regtest")
+	}
+	if args.N <= 0 || !ValidateAddress(args.Address) {
+		return nil, &rpcError{rpcInvalidParams, "need a positive n and a valid address"}
+	}
+	
+	var hashes []string
+	for _, block := range bc.Generate(args.N, args.Address) {
+		hashes = append(hashes, hex.EncodeToString(block.Hash))
+		announceBlock(block.Hash)
+	}
+	
+	return hashes, nil
+}
+
+// =========
+// client
+// =========
+
+// RPCClient calls the JSON-RPC server of a running node
+type RPCClient struct {
+	URL      string
+	User     string
+	Password string
+	id       int64
+}
+
+// RunningNode returns a client for the node nodeID if it is running with RPC
+// on, using the cookie it left, or nil
+func RunningNode(nodeID string) *RPCClient {
+	data, err := ioutil.ReadFile(fmt.Sprintf(activeNet.CookieFile, nodeID))
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		return nil
+	}
+	credentials := strings.SplitN(lines[1], ":", 2)
+	if len(credentials) != 2 {
+		return nil
+	}
+	
+	// the cookie of a node that stopped stays behind
+	conn, err := net.DialTimeout("tcp", lines[0], time.Second)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	
+	return &RPCClient{URL: "http://" + lines[0], User: credentials[0], Password: credentials[1]}
+}
+
+// Call runs method with params and decodes its result into result
+func (c *RPCClient) Call(method string, params, result interface{}) error {
+	request := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      atomic.AddInt64(&c.id, 1),
+		"method":  method,
+		"params":  params,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.User, c.Password)
+	
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("the node refused the RPC credentials")
+	}
+	
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	
+	return json.Unmarshal(response.Result, result)
+}
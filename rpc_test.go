@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// rpcParams encodes params like a JSON-RPC request carries them
+func rpcParams(params interface{}) json.RawMessage {
+	data, err := json.Marshal(params)
+	if err != nil {
+		panic(err)
+	}
+	
+	return data
+}
+
+// submitTemplate tries nonces until the template with id meets its target
+func submitTemplate(bc *BlockChain, id string) error {
+	var err error
+	for nonce := 0; nonce < 64; nonce++ {
+		_, err = rpcSubmitBlock(bc, rpcParams(map[string]interface{}{"id": id, "nonce": nonce}))
+		if err == nil {
+			return nil
+		}
+	}
+	
+	return fmt.Errorf("no nonce found: %s", err)
+}
+
+func TestCallRPCRejectsUnknownMethods(t *testing.T) {
+	_, rerr := callRPC(nil, &rpcRequest{JSONRPC: "2.0", Method: "nosuchmethod"})
+	if rerr == nil || rerr.Code != rpcMethodNotFound {
+		t.Errorf("got %v, want a method not found error", rerr)
+	}
+	
+	_, rerr = callRPC(nil, &rpcRequest{Method: "getblocktemplate"})
+	if rerr == nil || rerr.Code != rpcInvalidRequest {
+		t.Errorf("got %v, want an invalid request error", rerr)
+	}
+}
+
+func TestBlockTemplateRoundTrip(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	
+	result, rerr := callRPC(bc, &rpcRequest{JSONRPC: "2.0", Method: "getblocktemplate", Params: rpcParams(map[string]string{"address": address(wallet)})})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	template := result.(BlockTemplate)
+	
+	block := templates[template.ID]
+	header := NewProofOfWork(block).prepareData(block.Timestamp, 0)
+	if template.Height != 1 || template.Header != hex.EncodeToString(header[:len(header)-8]) {
+		t.Fatalf("template %+v does not describe the next block", template)
+	}
+	cb, _ := hex.DecodeString(template.Transactions[0])
+	if !bytes.Equal(DeserializeTransaction(cb).ID, block.Transactions[0].ID) {
+		t.Error("template does not start with its coinbase")
+	}
+	
+	if err := submitTemplate(bc, "00"); err == nil {
+		t.Error("accepted a block for an unknown template")
+	}
+	if err := submitTemplate(bc, template.ID); err != nil {
+		t.Fatal(err)
+	}
+	if bc.GetBestHeight() != 1 {
+		t.Errorf("height %d after submitting the template, want 1", bc.GetBestHeight())
+	}
+}
+
+func TestGenerateOnlyOnRegtest(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	
+	result, err := rpcGenerate(bc, rpcParams(map[string]interface{}{"n": 2, "address": address(wallet)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes := result.([]string); len(hashes) != 2 || hashes[1] != hex.EncodeToString(bc.Tip()) {
+		t.Errorf("generate returned %v, want the hashes of the 2 new blocks", hashes)
+	}
+	
+	UseChainParams(&MainNetParams)
+	if _, err := rpcGenerate(bc, rpcParams(map[string]interface{}{"n": 1, "address": address(wallet)})); err == nil {
+		t.Error("generated blocks outside regtest")
+	}
+}
+
+// rpcCall runs method through callRPC and fails t on an error
+func rpcCall(t *testing.T, bc *BlockChain, method string, params interface{}) interface{} {
+	t.Helper()
+	
+	result, rerr := callRPC(bc, &rpcRequest{JSONRPC: "2.0", Method: method, Params: rpcParams(params)})
+	if rerr != nil {
+		t.Fatalf("%s: %v", method, rerr)
+	}
+	
+	return result
+}
+
+func TestRPCChainQueries(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	blocks := bc.Generate(2, address(wallet))
+	
+	if count := rpcCall(t, bc, "getblockcount", nil); count != 2 {
+		t.Errorf("block count %v, want 2", count)
+	}
+	best := hex.EncodeToString(blocks[1].Hash)
+	if hash := rpcCall(t, bc, "getbestblockhash", nil); hash != best {
+		t.Errorf("best block %v, want %s", hash, best)
+	}
+	hash := rpcCall(t, bc, "getblockhash", map[string]int{"height": 1})
+	if hash != hex.EncodeToString(blocks[0].Hash) {
+		t.Errorf("block 1 is %v, want %x", hash, blocks[0].Hash)
+	}
+	
+	info := rpcCall(t, bc, "getblock", map[string]interface{}{"hash": hash}).(BlockInfo)
+	if info.Height != 1 || info.Confirmations != 2 || info.PrevBlockHash != hex.EncodeToString(blocks[0].PrevBlockHash) || len(info.Transactions) != 1 {
+		t.Errorf("block info %+v does not describe block 1", info)
+	}
+	
+	txInfo := rpcCall(t, bc, "gettransaction", map[string]string{"txid": info.Transactions[0]}).(TxInfo)
+	if !txInfo.Coinbase || txInfo.BlockHash != hash || txInfo.Confirmations != 2 || txInfo.Vout[0].Address != address(wallet) {
+		t.Errorf("transaction info %+v does not describe the coinbase of block 1", txInfo)
+	}
+	
+	tests := []struct {
+		method string
+		params interface{}
+		code   int
+	}{
+		{"getblock", nil, rpcInvalidParams},
+		{"getblock", map[string]string{"hash": "not hex"}, rpcInvalidParams},
+		{"getblock", map[string]string{"hash": "00"}, rpcNotFound},
+		{"getblockhash", map[string]int{"height": 3}, rpcNotFound},
+		{"gettransaction", map[string]string{"txid": "00"}, rpcNotFound},
+	}
+	for _, test := range tests {
+		request := &rpcRequest{JSONRPC: "2.0", Method: test.method}
+		if test.params != nil {
+			request.Params = rpcParams(test.params)
+		}
+		if _, rerr := callRPC(bc, request); rerr == nil || rerr.Code != test.code {
+			t.Errorf("%s %v: got %v, want error code %d", test.method, test.params, rerr, test.code)
+		}
+	}
+}
+
+func TestRPCSendRawTransaction(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, _ := bc.GetBlock(bc.Tip())
+	funding := bc.Generate(1, address(wallet))[0].Transactions[0]
+	tx := newTestTx(wallet, genesis.Transactions[0], []int{0}, activeNet.Subsidy)
+	txid := hex.EncodeToString(tx.ID)
+	
+	if got := rpcCall(t, bc, "sendrawtransaction", map[string]string{"hex": hex.EncodeToString(tx.Serialize())}); got != txid {
+		t.Fatalf("sent %v, want %s", got, txid)
+	}
+	if pool := rpcCall(t, bc, "getrawmempool", nil).([]string); len(pool) != 1 || pool[0] != txid {
+		t.Errorf("mempool %v, want the sent transaction", pool)
+	}
+	if info := rpcCall(t, bc, "gettransaction", map[string]string{"txid": txid}).(TxInfo); info.BlockHash != "" || info.Confirmations != 0 {
+		t.Errorf("a mempool transaction shows as mined: %+v", info)
+	}
+	
+	mined := newTestTx(wallet, funding, []int{0}, activeNet.Subsidy)
+	rpcCall(t, bc, "sendrawtransaction", map[string]string{"hex": hex.EncodeToString(mined.Serialize()), "mineto": address(wallet)})
+	if info := rpcCall(t, bc, "gettransaction", map[string]string{"txid": hex.EncodeToString(mined.ID)}).(TxInfo); info.Height != 2 || info.Confirmations != 1 {
+		t.Errorf("transaction sent with mineto is not in the next block: %+v", info)
+	}
+	if pool := rpcCall(t, bc, "getrawmempool", nil).([]string); len(pool) != 1 || pool[0] != txid {
+		t.Errorf("mempool %v, want the transaction sent without mineto", pool)
+	}
+	
+	_, rerr := callRPC(bc, &rpcRequest{JSONRPC: "2.0", Method: "sendrawtransaction", Params: rpcParams(map[string]string{"hex": "not hex"})})
+	if rerr == nil || rerr.Code != rpcInvalidParams {
+		t.Errorf("got %v, want an invalid params error", rerr)
+	}
+}
+
+func TestCallRPCRecoversPanics(t *testing.T) {
+	rpcHandlers["panic"] = func(bc *BlockChain, params json.RawMessage) (interface{}, error) {
+		panic("broken")
+	}
+	defer delete(rpcHandlers, "panic")
+	
+	_, rerr := callRPC(nil, &rpcRequest{JSONRPC: "2.0", Method: "panic"})
+	if rerr == nil || rerr.Code != rpcMiscError || rerr.Message != "broken" {
+		t.Errorf("got %v, want the panic as an error", rerr)
+	}
+}
+
+func TestBlockTemplatesAreCapped(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	
+	var ids []string
+	for i := 0; i < maxTemplates+5; i++ {
+		result, err := rpcGetBlockTemplate(bc, rpcParams(map[string]string{"address": address(wallet)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, result.(BlockTemplate).ID)
+	}
+	
+	if len(templates) != maxTemplates || len(templateOrder) != maxTemplates {
+		t.Fatalf("%d templates kept, want %d", len(templates), maxTemplates)
+	}
+	if err := submitTemplate(bc, ids[0]); err == nil {
+		t.Error("the oldest template was still accepted")
+	}
+	if err := submitTemplate(bc, ids[len(ids)-1]); err != nil {
+		t.Fatal(err)
+	}
+	
+	// a new tip makes the templates of the old one stale
+	result, err := rpcGetBlockTemplate(bc, rpcParams(map[string]string{"address": address(wallet)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 1 || templates[result.(BlockTemplate).ID] == nil {
+		t.Errorf("%d templates kept after the tip moved, want 1", len(templates))
+	}
+}
+
+func TestOutputInfoAddress(t *testing.T) {
+	wallet := NewWallet()
+	script := NewScriptBuilder().AddOp(OP_1).Script()
+	
+	for _, to := range []string{address(wallet), ScriptAddress(script)} {
+		if info := NewTxOutputInfo(*NewTxOutput(1, to)); info.Address != to {
+			t.Errorf("output to %s shows address %s", to, info.Address)
+		}
+	}
+}
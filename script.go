@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// opcodes, numbered like their Bitcoin counterparts
+const (
+	OP_0         = 0x00
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_1NEGATE   = 0x4f
+	OP_1         = 0x51
+	OP_16        = 0x60
+	
+	OP_NOP    = 0x61
+	OP_IF     = 0x63
+	OP_NOTIF  = 0x64
+	OP_ELSE   = 0x67
+	OP_ENDIF  = 0x68
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+	
+	OP_DROP = 0x75
+	OP_DUP  = 0x76
+	OP_SWAP = 0x7c
+	OP_SIZE = 0x82
+	
+	OP_EQUAL       = 0x87
+	OP_EQUALVERIFY = 0x88
+	
+	OP_ADD                = 0x93
+	OP_SUB                = 0x94
+	OP_NOT                = 0x91
+	OP_NUMEQUAL           = 0x9c
+	OP_NUMEQUALVERIFY     = 0x9d
+	OP_LESSTHAN           = 0x9f
+	OP_GREATERTHAN        = 0xa0
+	OP_LESSTHANOREQUAL    = 0xa1
+	OP_GREATERTHANOREQUAL = 0xa2
+	OP_WITHIN             = 0xa5
+	
+	OP_SHA256  = 0xa8
+	OP_HASH160 = 0xa9
+	OP_HASH256 = 0xaa
+	
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+	
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+// limits that keep every script cheap to run
+const (
+	maxScriptSize   = 10000
+	maxOpsPerScript = 201
+	maxStackSize    = 1000
+	maxElementSize  = 520
+	// arithmetic works on numbers of at most 4 bytes, lock times may take 5
+	maxNumSize      = 4
+	maxLockTimeSize = 5
+)
+
+var errScriptFailed = errors.New("script evaluated to false")
+
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+// parseScript splits script into opcodes and the data they push
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+	
+	for i := 0; i < len(script); {
+		op := scriptOp{opcode: script[i]}
+		i++
+		
+		size := -1
+		switch {
+		case op.opcode > OP_0 && op.opcode < OP_PUSHDATA1:
+			size = int(op.opcode)
+		case op.opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errors.New("truncated OP_PUSHDATA1")
+			}
+			size = int(script[i])
+			i++
+		case op.opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errors.New("truncated OP_PUSHDATA2")
+			}
+			size = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+		
+		if size >= 0 {
+			if i+size > len(script) {
+				return nil, errors.New("push past the end of the script")
+			}
+			op.data = script[i : i+size]
+			i += size
+		}
+		
+		ops = append(ops, op)
+	}
+	
+	return ops, nil
+}
+
+func isPushOnly(script []byte) bool {
+	ops, err := parseScript(script)
+	if err != nil {
+		return false
+	}
+	
+	for _, op := range ops {
+		if op.opcode > OP_16 {
+			return false
+		}
+	}
+	
+	return true
+}
+
+// ScriptBuilder assembles scripts with minimal pushes
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(opcode byte) *ScriptBuilder {
+	b.script = append(b.script, opcode)
+	return b
+}
+
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch {
+	case len(data) == 0:
+		b.script = append(b.script, OP_0)
+	case len(data) < OP_PUSHDATA1:
+		b.script = append(b.script, byte(len(data)))
+	case len(data) <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		var size [2]byte
+		binary.LittleEndian.PutUint16(size[:], uint16(len(data)))
+		b.script = append(b.script, OP_PUSHDATA2)
+		b.script = append(b.script, size[:]...)
+	}
+	b.script = append(b.script, data...)
+	
+	return b
+}
+
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	if n == 0 {
+		return b.AddOp(OP_0)
+	}
+	if n == -1 || (n >= 1 && n <= 16) {
+		return b.AddOp(byte(OP_1 - 1 + n))
+	}
+	
+	return b.AddData(encodeScriptNum(n))
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// PayToPubKeyHashScript is the standard script locking an output to a key hash
+func PayToPubKeyHashScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(OP_DUP).
+		AddOp(OP_HASH160).
+		AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// script numbers are little endian with the sign in the top bit of the last byte
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	
+	negative := n < 0
+	abs := n
+	if negative {
+		abs = -n
+	}
+	
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+	
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	
+	return result
+}
+
+func decodeScriptNum(data []byte, maxSize int) (int64, error) {
+	if len(data) > maxSize {
+		return 0, fmt.Errorf("number of %d bytes is too long", len(data))
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	
+	var result int64
+	for i, b := range data {
+		result |= int64(b) << uint(8*i)
+	}
+	
+	if data[len(data)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -result, nil
+	}
+	
+	return result, nil
+}
+
+func asBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// negative zero is false too
+			if i == len(data)-1 && b == 0x80 {
+				return false
+			}
+			return true
+		}
+	}
+	
+	return false
+}
+
+func fromBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// scriptEngine runs the scripts of one transaction input
+type scriptEngine struct {
+	tx    *Transaction
+	inIdx int
+	// script the signatures commit to
+	scriptCode []byte
+	
+	stack     [][]byte
+	condStack []bool
+	ops       int
+}
+
+func (vm *scriptEngine) push(data []byte) error {
+	if len(data) > maxElementSize {
+		return fmt.Errorf("element of %d bytes is too big", len(data))
+	}
+	if len(vm.stack) >= maxStackSize {
+		return errors.New("stack overflow")
+	}
+	
+	vm.stack = append(vm.stack, data)
+	return nil
+}
+
+func (vm *scriptEngine) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	
+	top := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return top, nil
+}
+
+func (vm *scriptEngine) peek() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	
+	return vm.stack[len(vm.stack)-1], nil
+}
+
+func (vm *scriptEngine) popNum(maxSize int) (int64, error) {
+	data, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	
+	return decodeScriptNum(data, maxSize)
+}
+
+func (vm *scriptEngine) executing() bool {
+	for _, cond := range vm.condStack {
+		if !cond {
+			return false
+		}
+	}
+	
+	return true
+}
+
+func (vm *scriptEngine) verify() error {
+	top, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	if !asBool(top) {
+		return errScriptFailed
+	}
+	
+	return nil
+}
+
+// execute runs script on the current stack
+func (vm *scriptEngine) execute(script []byte) error {
+	if len(script) > maxScriptSize {
+		return fmt.Errorf("script of %d bytes is too big", len(script))
+	}
+	
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+	
+	vm.ops = 0
+	vm.condStack = nil
+	
+	for _, op := range ops {
+		if op.opcode > OP_16 {
+			vm.ops++
+			if vm.ops > maxOpsPerScript {
+				return errors.New("too many operations")
+			}
+		}
+		
+		isConditional := op.opcode == OP_IF || op.opcode == OP_NOTIF || op.opcode == OP_ELSE || op.opcode == OP_ENDIF
+		if !vm.executing() && !isConditional {
+			continue
+		}
+		
+		err = vm.step(op)
+		if err != nil {
+			return err
+		}
+	}
+	
+	if len(vm.condStack) != 0 {
+		return errors.New("unbalanced conditional")
+	}
+	
+	return nil
+}
+
+func (vm *scriptEngine) step(op scriptOp) error {
+	switch {
+	case op.opcode == OP_0:
+		return vm.push([]byte{})
+	case op.opcode <= OP_PUSHDATA2:
+		return vm.push(op.data)
+	case op.opcode == OP_1NEGATE:
+		return vm.push(encodeScriptNum(-1))
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		return vm.push(encodeScriptNum(int64(op.opcode - OP_1 + 1)))
+	}
+	
+	switch op.opcode {
+	case OP_NOP:
+		return nil
+	
+	case OP_IF, OP_NOTIF:
+		cond := false
+		if vm.executing() {
+			top, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			cond = asBool(top) == (op.opcode == OP_IF)
+		}
+		vm.condStack = append(vm.condStack, cond)
+		return nil
+	
+	case OP_ELSE:
+		if len(vm.condStack) == 0 {
+			return errors.New("OP_ELSE without OP_IF")
+		}
+		last := len(vm.condStack) - 1
+		vm.condStack[last] = !vm.condStack[last]
+		return nil
+	
+	case OP_ENDIF:
+		if len(vm.condStack) == 0 {
+			return errors.New("OP_ENDIF without OP_IF")
+		}
+		vm.condStack = vm.condStack[:len(vm.condStack)-1]
+		return nil
+	
+	case OP_VERIFY:
+		return vm.verify()
+	
+	case OP_RETURN:
+		return errors.New("OP_RETURN output is unspendable")
+	
+	case OP_DROP:
+		_, err := vm.pop()
+		return err
+	
+	case OP_DUP:
+		top, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		return vm.push(top)
+	
+	case OP_SWAP:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.stack = append(vm.stack, a, b)
+		return nil
+	
+	case OP_SIZE:
+		top, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		return vm.push(encodeScriptNum(int64(len(top))))
+	
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		err = vm.push(fromBool(bytes.Compare(a, b) == 0))
+		if err != nil || op.opcode == OP_EQUAL {
+			return err
+		}
+		return vm.verify()
+	
+	case OP_NOT:
+		n, err := vm.popNum(maxNumSize)
+		if err != nil {
+			return err
+		}
+		return vm.push(fromBool(n == 0))
+	
+	case OP_ADD, OP_SUB, OP_NUMEQUAL, OP_NUMEQUALVERIFY, OP_LESSTHAN,
+		OP_GREATERTHAN, OP_LESSTHANOREQUAL, OP_GREATERTHANOREQUAL:
+		b, err := vm.popNum(maxNumSize)
+		if err != nil {
+			return err
+		}
+		a, err := vm.popNum(maxNumSize)
+		if err != nil {
+			return err
+		}
+		return vm.arithmetic(op.opcode, a, b)
+	
+	case OP_WITHIN:
+		max, err := vm.popNum(maxNumSize)
+		if err != nil {
+			return err
+		}
+		min, err := vm.popNum(maxNumSize)
+		if err != nil {
+			return err
+		}
+		x, err := vm.popNum(maxNumSize)
+		if err != nil {
+			return err
+		}
+		return vm.push(fromBool(min <= x && x < max))
+	
+	case OP_SHA256, OP_HASH160, OP_HASH256:
+		data, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		var hash []byte
+		switch op.opcode {
+		case OP_SHA256:
+			sum := sha256.Sum256(data)
+			hash = sum[:]
+		case OP_HASH160:
+			hash = HashPubKey(data)
+		case OP_HASH256:
+			first := sha256.Sum256(data)
+			second := sha256.Sum256(first[:])
+			hash = second[:]
+		}
+		return vm.push(hash)
+	
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		valid := verifySignature(pubKey, vm.tx.sigHash(vm.inIdx, vm.scriptCode), signature)
+		err = vm.push(fromBool(valid))
+		if err != nil || op.opcode == OP_CHECKSIG {
+			return err
+		}
+		return vm.verify()
+	
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		valid, err := vm.checkMultisig()
+		if err != nil {
+			return err
+		}
+		err = vm.push(fromBool(valid))
+		if err != nil || op.opcode == OP_CHECKMULTISIG {
+			return err
+		}
+		return vm.verify()
+	
+	case OP_CHECKLOCKTIMEVERIFY:
+		// the lock time of the transaction has to be at least the one on the
+		// stack, the chain makes sure the transaction isn't mined before it
+		top, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		lockTime, err := decodeScriptNum(top, maxLockTimeSize)
+		if err != nil {
+			return err
+		}
+		txLockTime := vm.tx.LockTime
+		if lockTime < 0 || (lockTime < lockTimeThreshold) != (txLockTime < lockTimeThreshold) || txLockTime < lockTime {
+			return fmt.Errorf("output is locked until %d", lockTime)
+		}
+		return nil
+	
+	case OP_CHECKSEQUENCEVERIFY:
+		// same for the relative lock in the sequence of the input
+		top, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		lock, err := decodeScriptNum(top, maxLockTimeSize)
+		if err != nil {
+			return err
+		}
+		sequence := int64(vm.tx.Vin[vm.inIdx].Sequence)
+		if lock < 0 || lock&sequenceLockTimeIsSeconds != sequence&sequenceLockTimeIsSeconds ||
+			sequence&sequenceLockTimeMask < lock&sequenceLockTimeMask {
+			return fmt.Errorf("output is locked for %d", lock&sequenceLockTimeMask)
+		}
+		return nil
+	}
+	
+	return fmt.Errorf("unknown opcode 0x%02x", op.opcode)
+}
+
+// checkMultisig expects <sig>... <m> <pubkey>... <n> on the stack. Signatures
+// have to be in the same order as the keys they belong to.
+func (vm *scriptEngine) checkMultisig() (bool, error) {
+	n, err := vm.popNum(maxNumSize)
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxMultisigKeys {
+		return false, fmt.Errorf("bad key count %d", n)
+	}
+	vm.ops += int(n)
+	if vm.ops > maxOpsPerScript {
+		return false, errors.New("too many operations")
+	}
+	
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		pubKeys[i], err = vm.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+	
+	m, err := vm.popNum(maxNumSize)
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("bad signature count %d", m)
+	}
+	
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		signatures[i], err = vm.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+	
+	hash := vm.tx.sigHash(vm.inIdx, vm.scriptCode)
+	key := 0
+	for _, signature := range signatures {
+		for key < len(pubKeys) && !verifySignature(pubKeys[key], hash, signature) {
+			key++
+		}
+		if key == len(pubKeys) {
+			return false, nil
+		}
+		key++
+	}
+	
+	return true, nil
+}
+
+func (vm *scriptEngine) arithmetic(opcode byte, a, b int64) error {
+	switch opcode {
+	case OP_ADD:
+		return vm.push(encodeScriptNum(a + b))
+	case OP_SUB:
+		return vm.push(encodeScriptNum(a - b))
+	case OP_NUMEQUAL:
+		return vm.push(fromBool(a == b))
+	case OP_NUMEQUALVERIFY:
+		if a != b {
+			return errScriptFailed
+		}
+		return nil
+	case OP_LESSTHAN:
+		return vm.push(fromBool(a < b))
+	case OP_GREATERTHAN:
+		return vm.push(fromBool(a > b))
+	case OP_LESSTHANOREQUAL:
+		return vm.push(fromBool(a <= b))
+	default:
+		return vm.push(fromBool(a >= b))
+	}
+}
+
+func (vm *scriptEngine) result() error {
+	top, err := vm.peek()
+	if err != nil {
+		return err
+	}
+	if !asBool(top) {
+		return errScriptFailed
+	}
+	
+	return nil
+}
+
+// VerifyInput runs the unlocking script of input inIdx followed by the locking
+// script of prevOut, the output it spends. For pay-to-script-hash outputs the
+// last item the unlocking script pushed is then run as the redeem script.
+func VerifyInput(tx *Transaction, inIdx int, prevOut TxOutput) error {
+	unlocking := tx.Vin[inIdx].UnlockingScript()
+	if !isPushOnly(unlocking) {
+		return errors.New("unlocking script may only push data")
+	}
+	
+	vm := &scriptEngine{
+		tx:         tx,
+		inIdx:      inIdx,
+		scriptCode: prevOut.scriptCode(),
+	}
+	
+	err := vm.execute(unlocking)
+	if err != nil {
+		return err
+	}
+	unlocked := append([][]byte{}, vm.stack...)
+	
+	locking := prevOut.LockingScript()
+	err = vm.execute(locking)
+	if err != nil {
+		return err
+	}
+	err = vm.result()
+	if err != nil || !isPayToScriptHash(locking) {
+		return err
+	}
+	
+	if len(unlocked) == 0 {
+		return errors.New("missing redeem script")
+	}
+	redeemScript := unlocked[len(unlocked)-1]
+	vm.stack = unlocked[:len(unlocked)-1]
+	vm.scriptCode = redeemScript
+	
+	err = vm.execute(redeemScript)
+	if err != nil {
+		return err
+	}
+	
+	return vm.result()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// runScript runs scriptSig against the locking script of a made up output
+func runScript(scriptSig, locking []byte) error {
+	tx := &Transaction{Vin: []TxInput{{Txid: make([]byte, 32), ScriptSig: scriptSig}}}
+	
+	return VerifyInput(tx, 0, TxOutput{Script: locking})
+}
+
+func script() *ScriptBuilder {
+	return NewScriptBuilder()
+}
+
+func TestScriptNum(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 127, 128, -128, 255, 256, -32768, 1<<31 - 1, -(1<<31 - 1)} {
+		data := encodeScriptNum(n)
+		got, err := decodeScriptNum(data, maxNumSize)
+		if err != nil || got != n {
+			t.Errorf("%d encoded as %x decodes to %d, %v", n, data, got, err)
+		}
+	}
+	
+	if _, err := decodeScriptNum(encodeScriptNum(1<<32), maxNumSize); err == nil {
+		t.Error("decoded a 5 byte number as an arithmetic operand")
+	}
+	if asBool([]byte{0, 0, 0x80}) || asBool(nil) || !asBool([]byte{0, 1}) {
+		t.Error("asBool does not treat zero and negative zero as false")
+	}
+}
+
+func TestScriptEvaluation(t *testing.T) {
+	secret := []byte("secret")
+	hash := sha256.Sum256(secret)
+	hashLock := script().AddOp(OP_SHA256).AddData(hash[:]).AddOp(OP_EQUAL).Script()
+	tooManyOps := script()
+	for i := 0; i < maxOpsPerScript+1; i++ {
+		tooManyOps.AddOp(OP_NOP)
+	}
+	
+	tests := []struct {
+		name      string
+		scriptSig []byte
+		locking   []byte
+		ok        bool
+	}{
+		{"arithmetic", script().AddInt(2).AddInt(3).Script(), script().AddOp(OP_ADD).AddInt(5).AddOp(OP_NUMEQUAL).Script(), true},
+		{"wrong sum", script().AddInt(2).AddInt(2).Script(), script().AddOp(OP_ADD).AddInt(5).AddOp(OP_NUMEQUAL).Script(), false},
+		{"big numbers", script().AddInt(1000).Script(), script().AddInt(-1000).AddOp(OP_SUB).AddInt(2000).AddOp(OP_NUMEQUAL).Script(), true},
+		{"within", script().AddInt(7).Script(), script().AddInt(5).AddInt(10).AddOp(OP_WITHIN).Script(), true},
+		{"outside", script().AddInt(10).Script(), script().AddInt(5).AddInt(10).AddOp(OP_WITHIN).Script(), false},
+		{"else branch", script().AddInt(0).Script(), script().AddOp(OP_IF).AddInt(0).AddOp(OP_ELSE).AddInt(1).AddOp(OP_ENDIF).Script(), true},
+		{"if branch", script().AddInt(1).Script(), script().AddOp(OP_IF).AddInt(0).AddOp(OP_ELSE).AddInt(1).AddOp(OP_ENDIF).Script(), false},
+		{"notif", script().AddInt(0).Script(), script().AddOp(OP_NOTIF).AddInt(1).AddOp(OP_ENDIF).Script(), true},
+		{"unbalanced if", script().AddInt(1).Script(), script().AddOp(OP_IF).AddInt(1).Script(), false},
+		{"stray endif", script().AddInt(1).Script(), script().AddOp(OP_ENDIF).Script(), false},
+		{"skipped return", script().AddInt(0).Script(), script().AddOp(OP_IF).AddOp(OP_RETURN).AddOp(OP_ENDIF).AddInt(1).Script(), true},
+		{"return", script().AddInt(1).Script(), script().AddOp(OP_RETURN).Script(), false},
+		{"hash lock", script().AddData(secret).Script(), hashLock, true},
+		{"wrong preimage", script().AddData([]byte("guess")).Script(), hashLock, false},
+		{"size", script().AddData(secret).Script(), script().AddOp(OP_SIZE).AddInt(6).AddOp(OP_EQUALVERIFY).Script(), true},
+		{"swap", script().AddInt(1).AddInt(2).Script(), script().AddOp(OP_SWAP).AddInt(1).AddOp(OP_NUMEQUALVERIFY).AddInt(2).AddOp(OP_NUMEQUAL).Script(), true},
+		{"not push only", script().AddInt(1).AddOp(OP_DUP).Script(), script().AddOp(OP_EQUAL).Script(), false},
+		{"underflow", script().AddInt(1).Script(), script().AddOp(OP_DROP).AddOp(OP_DROP).AddInt(1).Script(), false},
+		{"empty stack", script().AddInt(1).Script(), script().AddOp(OP_DROP).Script(), false},
+		{"false on top", script().AddInt(1).Script(), script().AddInt(0).Script(), false},
+		{"too many ops", script().AddInt(1).Script(), tooManyOps.Script(), false},
+		{"big element", script().AddData(make([]byte, maxElementSize+1)).Script(), script().AddOp(OP_DROP).AddInt(1).Script(), false},
+		{"big operand", script().AddData(make([]byte, maxNumSize+1)).Script(), script().AddOp(OP_NOT).Script(), false},
+		{"truncated push", script().AddInt(1).Script(), []byte{OP_PUSHDATA1}, false},
+		{"push past end", script().AddInt(1).Script(), []byte{5, 1, 2}, false},
+		{"unknown opcode", script().AddInt(1).Script(), []byte{0xff}, false},
+	}
+	
+	for _, test := range tests {
+		err := runScript(test.scriptSig, test.locking)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	if err := runScript(script().AddInt(1).Script(), make([]byte, maxScriptSize+1)); err == nil {
+		t.Error("ran an oversized script")
+	}
+	
+	deep := script()
+	for i := 0; i < maxStackSize; i++ {
+		deep.AddInt(1)
+	}
+	if err := runScript(script().AddInt(1).Script(), deep.Script()); err == nil {
+		t.Error("pushed past the maximum stack size")
+	}
+}
+
+func TestPayToPubKeyHash(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := genesis.Transactions[0]
+	prevTXs := poolOf(prev)
+	
+	tx := newTestTx(wallet, prev, []int{0}, activeNet.Subsidy)
+	if !bytes.Equal(tx.Vin[0].UnlockingScript(), script().AddData(tx.Vin[0].Signature).AddData(wallet.PublicKey).Script()) {
+		t.Error("key hash inputs do not push their signature and key")
+	}
+	if !tx.Verify(prevTXs) {
+		t.Fatal("signed spend does not verify")
+	}
+	
+	changed := *tx
+	changed.Vout = []TxOutput{*NewTxOutput(activeNet.Subsidy, address(NewWallet()))}
+	if changed.Verify(prevTXs) {
+		t.Error("signature still verifies after the outputs changed")
+	}
+	
+	thief := NewWallet()
+	stolen := newTestTx(thief, prev, []int{0}, activeNet.Subsidy)
+	if stolen.Verify(prevTXs) {
+		t.Error("another key spent the output")
+	}
+}
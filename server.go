@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 type verzion struct {
@@ -25,19 +28,42 @@ const (
 	protocol      = "tcp"
 	nodeVersion   = 1
 	commandLength = 12
+	
+	maxHeadersPerMessage = 2000
+	
+	// compact blocks wait this long for their missing transactions, and only
+	// so many of them at once
+	compactBlockTimeout     = 30 * time.Second
+	maxPendingCompactBlocks = 16
 )
 
 var (
 	nodeAddress     string
 	miningAddress   string
-	knownNodes      = []string{"localhost:3000"}
+	knownNodes      = append([]string{}, activeNet.Seeds...)
 	blocksInTransit = [][]byte{}
-	mempool         = make(map[string]Transaction)
+	mempool         = NewTxPool()
+	
+	// connection handlers change the peers and the blocks being downloaded
+	// while the RPC, REST and metrics handlers read them
+	knownNodesLock      sync.Mutex
+	blocksInTransitLock sync.Mutex
+	
+	invRelay      = NewInvRelay()
+	miningService *MiningService
+	
+	// bloom filters loaded by light clients, by their address
+	peerFilters     = make(map[string]*BloomFilter)
+	peerFiltersLock sync.Mutex
+	
+	// compact blocks waiting for missing transactions, by block hash
+	compactBlocks     = make(map[string]*pendingCompactBlock)
+	compactBlocksLock sync.Mutex
 )
 
-func StartServer(nodeID, minerAddress string) {
+func StartServer(nodeID, minerAddress string, mineEmpty bool, rpc RPCConfig, restPort, metricsPort string) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	minerAddress = minerAddress
+	miningAddress = minerAddress
 	ln, err := net.Listen(protocol, nodeAddress)
 	if err != nil {
 		log.Panic(err)
@@ -48,6 +74,21 @@ func StartServer(nodeID, minerAddress string) {
 	if nodeAddress != knownNodes[0] {
 		sendVersion(knownNodes[0], bc)
 	}
+	
+	if rpc.Port != "" {
+		StartRPCServer(rpc, nodeID, bc)
+	}
+	if restPort != "" {
+		StartRESTServer(fmt.Sprintf("localhost:%s", restPort), bc)
+	}
+	if metricsPort != "" {
+		StartMetricsServer(fmt.Sprintf("localhost:%s", metricsPort), bc)
+	}
+	
+	if len(miningAddress) > 0 {
+		miningService = NewMiningService(bc, miningAddress, mineEmpty)
+		miningService.Start()
+	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -82,7 +123,7 @@ type addr struct {
 }
 
 func requestBlocks() {
-	for _, node := range knownNodes {
+	for _, node := range knownPeers() {
 		sendGetBlocks(node)
 	}
 }
@@ -98,8 +139,10 @@ func handleAddr(request []byte) {
 		log.Panic(err)
 	}
 	
+	knownNodesLock.Lock()
 	knownNodes = append(knownNodes, payload.AddrList...)
 	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
+	knownNodesLock.Unlock()
 	requestBlocks()
 }
 
@@ -108,20 +151,48 @@ func handleConnection(conn net.Conn, bc *BlockChain) {
 	if err != nil {
 		log.Panic(err)
 	}
+	
+	magic := activeNet.Magic[:]
+	if len(request) < len(magic)+commandLength || bytes.Compare(request[:len(magic)], magic) != 0 {
+		fmt.Printf("ignoring a message that is not from the %s network\n", activeNet.Name)
+		conn.Close()
+		return
+	}
+	size := len(request)
+	request = request[len(magic):]
 	command := bytesToCommand(request[:commandLength])
 	fmt.Printf("received %s command\n", command)
+	metrics.MessageReceived(command, size)
 	
 	switch command {
 	case "addr":
 		handleAddr(request)
 	case "block":
 		handleBlock(request, bc)
+	case "blocktxn":
+		handleBlockTxn(request, bc)
+	case "cmpctblock":
+		handleCmpctBlock(request, bc)
 	case "inv":
 		handleInv(request, bc)
 	case "getblocks":
 		handleGetBlocks(request, bc)
+	case "filterload":
+		handleFilterLoad(request)
+	case "getcfheaders":
+		handleGetCFHeaders(request, bc)
+	case "getcfilters":
+		handleGetCFilters(request, bc)
+	case "getblocktxn":
+		handleGetBlockTxn(request, bc)
 	case "getdata":
 		handleGetData(request, bc)
+	case "getheaders":
+		handleGetHeaders(request, bc)
+	case "gettxproof":
+		handleGetTxProof(request, bc)
+	case "merkleblock":
+		handleMerkleBlock(request, bc)
 	case "tx":
 		handleTx(request, bc)
 	case "version":
@@ -154,8 +225,8 @@ func handleVersion(request []byte, bc *BlockChain) {
 		sendVersion(payload.AddrFrom, bc)
 	}
 	
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	if addPeer(payload.AddrFrom) {
+		events.Publish(PeerConnected{payload.AddrFrom})
 	}
 }
 
@@ -192,26 +263,36 @@ func handleInv(request []byte, bc *BlockChain) {
 	}
 	
 	fmt.Printf("received inventory with %d %s \n", len(payload.Items), payload.Type)
+	invRelay.MarkKnown(payload.AddrFrom, payload.Items)
 	
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-		
-		blockhash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockhash)
-		
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockhash) != 0 {
-				newInTransit = append(newInTransit, b)
+		// the items start from the tip of the peer, blocks are connected
+		// oldest first
+		missing := [][]byte{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			hash := payload.Items[i]
+			if _, err := bc.GetBlock(hash); err != nil {
+				missing = append(missing, hash)
 			}
 		}
-		blocksInTransit = newInTransit
+		setBlocksInTransit(missing)
+		
+		blockhash, ok := nextBlockInTransit()
+		if !ok {
+			return
+		}
+		// a single new block is mostly made of transactions we have already
+		if len(payload.Items) == 1 {
+			sendGetData(payload.AddrFrom, "cmpctblock", blockhash)
+		} else {
+			sendGetData(payload.AddrFrom, "block", blockhash)
+		}
 	}
 	if payload.Type == "tx" {
-		txid := payload.Items[0]
-		
-		if mempool[hex.EncodeToString(txid)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txid)
+		for _, txid := range payload.Items {
+			if !mempool.Has(hex.EncodeToString(txid)) && invRelay.RequestTx(txid) {
+				sendGetData(payload.AddrFrom, "tx", txid)
+			}
 		}
 	}
 }
@@ -240,14 +321,269 @@ func handleGetData(request []byte, bc *BlockChain) {
 		sendBlock(payload.AddrFrom, &block)
 	}
 	
+	if payload.Type == "cmpctblock" {
+		block, err := bc.GetBlock(payload.ID)
+		if err != nil {
+			fmt.Printf("can't serve compact block %x to %s: %s\n", payload.ID, payload.AddrFrom, err)
+			return
+		}
+		sendCmpctBlock(payload.AddrFrom, NewCompactBlock(&block))
+	}
+	
+	if payload.Type == "merkleblock" {
+		block, err := bc.GetBlock(payload.ID)
+		if err != nil {
+			fmt.Printf("can't serve merkle block %x to %s: %s\n", payload.ID, payload.AddrFrom, err)
+			return
+		}
+		
+		// without a filter the header goes alone
+		match := func(tx *Transaction) bool { return false }
+		if filter := peerFilter(payload.AddrFrom); filter != nil {
+			match = filter.MatchesTx
+		}
+		merkleBlock, txs := NewMerkleBlock(&block, match)
+		sendMerkleBlock(payload.AddrFrom, merkleBlock, txs)
+	}
+	
 	if payload.Type == "tx" {
 		txid := hex.EncodeToString(payload.ID)
-		tx := mempool[txid]
+		tx, ok := mempool.Get(txid)
+		if !ok {
+			return
+		}
 		
 		sendTx(payload.AddrFrom, &tx)
 	}
 }
 
+type filterload struct {
+	AddrFrom string
+	Filter   BloomFilter
+}
+
+func handleFilterLoad(request []byte) {
+	var buff bytes.Buffer
+	var payload filterload
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	if !payload.Filter.IsValid() {
+		fmt.Printf("rejected the bloom filter of %s\n", payload.AddrFrom)
+		return
+	}
+	
+	peerFiltersLock.Lock()
+	peerFilters[payload.AddrFrom] = &payload.Filter
+	peerFiltersLock.Unlock()
+}
+
+func peerFilter(addr string) *BloomFilter {
+	peerFiltersLock.Lock()
+	defer peerFiltersLock.Unlock()
+	
+	return peerFilters[addr]
+}
+
+type getheaders struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+func handleGetHeaders(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload getheaders
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	sendHeaders(payload.AddrFrom, bc.GetHeaders(payload.Locator, maxHeadersPerMessage))
+}
+
+type headers struct {
+	AddrFrom string
+	Headers  []BlockHeader
+}
+
+type getcfilters struct {
+	AddrFrom    string
+	StartHeight int
+	StopHash    []byte
+}
+
+type cfilter struct {
+	AddrFrom  string
+	BlockHash []byte
+	Filter    []byte
+}
+
+func handleGetCFilters(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload getcfilters
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	hashes, err := bc.blockRange(payload.StartHeight, payload.StopHash, maxCFiltersPerRequest)
+	if err != nil {
+		fmt.Printf("can't serve filters to %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+	
+	for _, hash := range hashes {
+		filter, err := bc.GetCFilter(hash)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sendCFilter(payload.AddrFrom, hash, filter)
+	}
+}
+
+type getcfheaders struct {
+	AddrFrom    string
+	StartHeight int
+	StopHash    []byte
+}
+
+type cfheaders struct {
+	AddrFrom string
+	StopHash []byte
+	// header of the filter before StartHeight
+	PrevFilterHeader []byte
+	// hashes of the filters in the range, the headers follow from them
+	FilterHashes [][]byte
+}
+
+func handleGetCFHeaders(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload getcfheaders
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	hashes, err := bc.blockRange(payload.StartHeight, payload.StopHash, maxCFHeadersPerRequest)
+	if err != nil {
+		fmt.Printf("can't serve filter headers to %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+	if len(hashes) == 0 {
+		return
+	}
+	
+	data := cfheaders{nodeAddress, payload.StopHash, make([]byte, sha256.Size), nil}
+	if payload.StartHeight > 0 {
+		first, err := bc.GetBlock(hashes[0])
+		if err != nil {
+			log.Panic(err)
+		}
+		data.PrevFilterHeader, err = bc.GetCFHeader(first.PrevBlockHash)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	for _, hash := range hashes {
+		filter, err := bc.GetCFilter(hash)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		filterHash := sha256.Sum256(filter)
+		data.FilterHashes = append(data.FilterHashes, filterHash[:])
+	}
+	
+	sendCFHeaders(payload.AddrFrom, data)
+}
+
+type gettxproof struct {
+	AddrFrom string
+	Txid     []byte
+}
+
+func handleGetTxProof(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload gettxproof
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	block, _, err := bc.FindTransactionBlock(payload.Txid)
+	if err != nil {
+		fmt.Printf("no proof for transaction %x: %s\n", payload.Txid, err)
+		return
+	}
+	
+	merkleBlock, txs := NewMerkleBlock(block, func(tx *Transaction) bool {
+		return bytes.Compare(tx.ID, payload.Txid) == 0
+	})
+	sendMerkleBlock(payload.AddrFrom, merkleBlock, txs)
+}
+
+type merkleblock struct {
+	AddrFrom     string
+	MerkleBlock  MerkleBlock
+	Transactions [][]byte
+}
+
+func handleMerkleBlock(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload merkleblock
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	header := payload.MerkleBlock.Header
+	leaves, err := payload.MerkleBlock.Verify()
+	if err != nil {
+		fmt.Printf("rejected merkle block %x: %s\n", header.Hash, err)
+		return
+	}
+	if _, err := bc.GetBlock(header.Hash); err != nil {
+		fmt.Printf("merkle block %x is not in our chain\n", header.Hash)
+		return
+	}
+	
+	for _, txData := range payload.Transactions {
+		tx := DeserializeTransaction(txData)
+		leaf := hashMerkleLeaf(tx.Serialize())
+		
+		proven := false
+		for _, l := range leaves {
+			proven = proven || bytes.Compare(l, leaf) == 0
+		}
+		if proven {
+			fmt.Printf("transaction %x is in block %x\n", tx.ID, header.Hash)
+		} else {
+			fmt.Printf("transaction %x is not proven by merkle block %x\n", tx.ID, header.Hash)
+		}
+	}
+}
+
 type block struct {
 	AddrFrom string
 	Block    []byte
@@ -267,20 +603,205 @@ func handleBlock(request []byte, bc *BlockChain) {
 	blockData := payload.Block
 	block := DeserializeBlock(blockData)
 	
+	processBlock(block, payload.AddrFrom, bc)
+}
+
+func processBlock(block *Block, addrFrom string, bc *BlockChain) {
 	fmt.Println("Recevied a new block!")
-	bc.AddBlock(block)
+	invRelay.MarkKnown(addrFrom, [][]byte{block.Hash})
+	
+	// an invalid block is dropped but its hash isn't marked bad, a mutated copy
+	// has the same hash as the valid block
+	err := bc.ConnectBlock(block)
+	if err == errOrphanBlock {
+		// the peer is on a branch we haven't seen, its inventory has the rest
+		fmt.Printf("block %x doesn't connect, asking %s for its chain\n", block.Hash, addrFrom)
+		setBlocksInTransit(nil)
+		sendGetBlocks(addrFrom)
+		return
+	}
+	if err != nil && err != errStaleTip {
+		fmt.Printf("rejected block %x: %s\n", block.Hash, err)
+		setBlocksInTransit(nil)
+		return
+	}
 	
 	fmt.Printf("Added block %x\n", block.Hash)
 	
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	if blockHash, ok := nextBlockInTransit(); ok {
+		sendGetData(addrFrom, "block", blockHash)
+	}
+}
+
+func setBlocksInTransit(hashes [][]byte) {
+	blocksInTransitLock.Lock()
+	defer blocksInTransitLock.Unlock()
+	
+	blocksInTransit = hashes
+}
+
+// nextBlockInTransit takes the next block to download off the list
+func nextBlockInTransit() ([]byte, bool) {
+	blocksInTransitLock.Lock()
+	defer blocksInTransitLock.Unlock()
+	
+	if len(blocksInTransit) == 0 {
+		return nil, false
+	}
+	hash := blocksInTransit[0]
+	blocksInTransit = blocksInTransit[1:]
+	
+	return hash, true
+}
+
+type cmpctblock struct {
+	AddrFrom string
+	Block    CompactBlock
+}
+
+type pendingCompactBlock struct {
+	block    *CompactBlock
+	txs      []*Transaction
+	received time.Time
+}
+
+// addPendingCompactBlock keeps pending until its missing transactions come,
+// dropping expired compact blocks and the oldest one when there are too many
+func addPendingCompactBlock(pending *pendingCompactBlock) {
+	compactBlocksLock.Lock()
+	defer compactBlocksLock.Unlock()
+	
+	var oldest string
+	for hash, other := range compactBlocks {
+		if time.Since(other.received) > compactBlockTimeout {
+			delete(compactBlocks, hash)
+		} else if oldest == "" || other.received.Before(compactBlocks[oldest].received) {
+			oldest = hash
+		}
+	}
+	if len(compactBlocks) >= maxPendingCompactBlocks {
+		delete(compactBlocks, oldest)
+	}
+	compactBlocks[hex.EncodeToString(pending.block.Header.Hash)] = pending
+}
+
+// takePendingCompactBlock removes the compact block with hash, nil when there
+// is none or it expired
+func takePendingCompactBlock(hash string) *pendingCompactBlock {
+	compactBlocksLock.Lock()
+	defer compactBlocksLock.Unlock()
+	
+	pending := compactBlocks[hash]
+	delete(compactBlocks, hash)
+	if pending == nil || time.Since(pending.received) > compactBlockTimeout {
+		return nil
+	}
+	
+	return pending
+}
+
+func handleCmpctBlock(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload cmpctblock
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	cb := &payload.Block
+	txs, missing := cb.Fill(mempool.Snapshot())
+	if len(missing) > 0 {
+		fmt.Printf("compact block %x is missing %d of %d transactions\n", cb.Header.Hash, len(missing), len(txs))
 		
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+		addPendingCompactBlock(&pendingCompactBlock{cb, txs, time.Now()})
+		sendGetBlockTxn(payload.AddrFrom, cb.Header.Hash, missing)
+		return
+	}
+	
+	rebuildCompactBlock(cb, txs, payload.AddrFrom, bc)
+}
+
+// rebuildCompactBlock processes the block made of txs, falling back to
+// downloading it whole when they don't add up to it. Like any other block it
+// is only connected once ValidateBlock passes.
+func rebuildCompactBlock(cb *CompactBlock, txs []*Transaction, addrFrom string, bc *BlockChain) {
+	block, err := cb.Block(txs)
+	if err != nil {
+		fmt.Printf("can't rebuild compact block %x: %s\n", cb.Header.Hash, err)
+		sendGetData(addrFrom, "block", cb.Header.Hash)
+		return
+	}
+	
+	processBlock(block, addrFrom, bc)
+}
+
+type getblocktxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+func handleGetBlockTxn(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload getblocktxn
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	block, err := bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	
+	var txs []Transaction
+	for _, index := range payload.Indexes {
+		if index < 0 || index >= len(block.Transactions) {
+			fmt.Printf("block %x has no transaction %d\n", block.Hash, index)
+			return
+		}
+		txs = append(txs, *block.Transactions[index])
+	}
+	sendBlockTxn(payload.AddrFrom, block.Hash, payload.Indexes, txs)
+}
+
+type blocktxn struct {
+	AddrFrom     string
+	BlockHash    []byte
+	Indexes      []int
+	Transactions []Transaction
+}
+
+func handleBlockTxn(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload blocktxn
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	pending := takePendingCompactBlock(hex.EncodeToString(payload.BlockHash))
+	if pending == nil || len(payload.Indexes) != len(payload.Transactions) {
+		return
+	}
+	// only the missing transactions are taken, the peer can't swap out ours
+	for i, index := range payload.Indexes {
+		if index >= 0 && index < len(pending.txs) && pending.txs[index] == nil {
+			pending.txs[index] = &payload.Transactions[i]
+		}
 	}
+	
+	rebuildCompactBlock(pending.block, pending.txs, payload.AddrFrom, bc)
 }
 
 type tx struct {
@@ -301,54 +822,31 @@ func handleTx(request []byte, bc *BlockChain) {
 	
 	txData := payload.Transaction
 	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
+	invRelay.TxReceived(tx.ID)
+	invRelay.MarkKnown(payload.AddrFrom, [][]byte{tx.ID})
+	err = mempool.Accept(bc, tx)
+	if err != nil {
+		fmt.Printf("rejected transaction %x: %s\n", tx.ID, err)
+		return
+	}
 	
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
-			}
+	relayTransaction(&tx, payload.AddrFrom)
+}
+
+// relayTransaction announces tx to the peers except addrFrom. Only the central
+// node relays, the others hand it their own transactions.
+func relayTransaction(tx *Transaction, addrFrom string) {
+	nodes := knownPeers()
+	if len(nodes) > 0 && nodeAddress != nodes[0] {
+		if addrFrom == "" {
+			sendTx(nodes[0], tx)
 		}
-	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-			
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
-			
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
-			
-			cbTx := NewCoinbaseTx(miningAddress, "")
-			txs = append(txs, cbTx)
-			
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
-			
-			fmt.Println("New block is mined!")
-			
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
-			
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
-			
-			if len(mempool) > 0 {
-				goto MineTransactions
-			}
+		return
+	}
+	
+	for _, node := range nodes {
+		if node != nodeAddress && node != addrFrom {
+			invRelay.QueueTx(node, tx.ID)
 		}
 	}
 }
@@ -365,14 +863,27 @@ func gobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func nodeIsKnown(addr string) bool {
+// knownPeers returns a copy of knownNodes
+func knownPeers() []string {
+	knownNodesLock.Lock()
+	defer knownNodesLock.Unlock()
+	
+	return append([]string{}, knownNodes...)
+}
+
+// addPeer adds addr to knownNodes unless it is there already
+func addPeer(addr string) bool {
+	knownNodesLock.Lock()
+	defer knownNodesLock.Unlock()
+	
 	for _, node := range knownNodes {
 		if node == addr {
-			return true
+			return false
 		}
 	}
+	knownNodes = append(knownNodes, addr)
 	
-	return false
+	return true
 }
 
 // =========
@@ -380,7 +891,7 @@ func nodeIsKnown(addr string) bool {
 // =========
 
 func sendAddr(address string) {
-	nodes := addr{knownNodes}
+	nodes := addr{knownPeers()}
 	nodes.AddrList = append(nodes.AddrList, nodeAddress)
 	payload := gobEncode(nodes)
 	request := append(commandToBytes("addr"), payload...)
@@ -402,6 +913,7 @@ func sendData(addr string, data []byte) {
 		fmt.Printf("%s is not available\n", addr)
 		var updatedNodes []string
 		
+		knownNodesLock.Lock()
 		for _, node := range knownNodes {
 			if node != addr {
 				updatedNodes = append(updatedNodes, node)
@@ -409,18 +921,22 @@ func sendData(addr string, data []byte) {
 		}
 		
 		knownNodes = updatedNodes
+		knownNodesLock.Unlock()
 		
 		return
 	}
 	defer conn.Close()
 	
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	message := append(append([]byte{}, activeNet.Magic[:]...), data...)
+	_, err = io.Copy(conn, bytes.NewReader(message))
 	if err != nil {
 		log.Panic(err)
 	}
+	metrics.MessageSent(bytesToCommand(data[:commandLength]), len(message))
 }
 
 func sendInv(address, kind string, items [][]byte) {
+	invRelay.MarkKnown(address, items)
 	inventory := inv{nodeAddress, kind, items}
 	payload := gobEncode(inventory)
 	request := append(commandToBytes("inv"), payload...)
@@ -442,6 +958,80 @@ func sendGetData(address, kind string, id []byte) {
 	sendData(address, request)
 }
 
+func sendCmpctBlock(addr string, cb *CompactBlock) {
+	payload := gobEncode(cmpctblock{nodeAddress, *cb})
+	request := append(commandToBytes("cmpctblock"), payload...)
+	
+	sendData(addr, request)
+}
+
+func sendGetBlockTxn(address string, blockHash []byte, indexes []int) {
+	payload := gobEncode(getblocktxn{nodeAddress, blockHash, indexes})
+	request := append(commandToBytes("getblocktxn"), payload...)
+	
+	sendData(address, request)
+}
+
+func sendBlockTxn(address string, blockHash []byte, indexes []int, txs []Transaction) {
+	payload := gobEncode(blocktxn{nodeAddress, blockHash, indexes, txs})
+	request := append(commandToBytes("blocktxn"), payload...)
+	
+	sendData(address, request)
+}
+
+func sendCFilter(address string, blockHash, filter []byte) {
+	payload := gobEncode(cfilter{nodeAddress, blockHash, filter})
+	request := append(commandToBytes("cfilter"), payload...)
+	
+	sendData(address, request)
+}
+
+func sendCFHeaders(address string, data cfheaders) {
+	payload := gobEncode(data)
+	request := append(commandToBytes("cfheaders"), payload...)
+	
+	sendData(address, request)
+}
+
+func sendFilterLoad(address string, filter *BloomFilter) {
+	payload := gobEncode(filterload{nodeAddress, *filter})
+	request := append(commandToBytes("filterload"), payload...)
+	
+	sendData(address, request)
+}
+
+func sendGetHeaders(address string, locator [][]byte) {
+	payload := gobEncode(getheaders{nodeAddress, locator})
+	request := append(commandToBytes("getheaders"), payload...)
+	
+	sendData(address, request)
+}
+
+func sendHeaders(address string, list []BlockHeader) {
+	payload := gobEncode(headers{nodeAddress, list})
+	request := append(commandToBytes("headers"), payload...)
+	
+	sendData(address, request)
+}
+
+func sendGetTxProof(address string, txid []byte) {
+	payload := gobEncode(gettxproof{nodeAddress, txid})
+	request := append(commandToBytes("gettxproof"), payload...)
+	
+	sendData(address, request)
+}
+
+func sendMerkleBlock(addr string, merkleBlock *MerkleBlock, txs []*Transaction) {
+	data := merkleblock{nodeAddress, *merkleBlock, nil}
+	for _, tx := range txs {
+		data.Transactions = append(data.Transactions, tx.Serialize())
+	}
+	payload := gobEncode(data)
+	request := append(commandToBytes("merkleblock"), payload...)
+	
+	sendData(addr, request)
+}
+
 func sendTx(addr string, tnx *Transaction) {
 	data := tx{nodeAddress, tnx.Serialize()}
 	payload := gobEncode(data)
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestPendingCompactBlocksExpire(t *testing.T) {
+	compactBlocks = make(map[string]*pendingCompactBlock)
+	pending := func(i int, received time.Time) *pendingCompactBlock {
+		return &pendingCompactBlock{&CompactBlock{Header: BlockHeader{Hash: []byte{byte(i)}}}, nil, received}
+	}
+	
+	addPendingCompactBlock(pending(0, time.Now().Add(-compactBlockTimeout-time.Second)))
+	if takePendingCompactBlock("00") != nil {
+		t.Error("took an expired compact block")
+	}
+	
+	for i := 0; i <= maxPendingCompactBlocks; i++ {
+		addPendingCompactBlock(pending(i, time.Now().Add(time.Duration(i)*time.Millisecond)))
+	}
+	if len(compactBlocks) != maxPendingCompactBlocks {
+		t.Errorf("%d compact blocks are pending, want at most %d", len(compactBlocks), maxPendingCompactBlocks)
+	}
+	if takePendingCompactBlock("00") != nil {
+		t.Error("the oldest compact block wasn't dropped")
+	}
+	if takePendingCompactBlock(hex.EncodeToString([]byte{maxPendingCompactBlocks})) == nil {
+		t.Error("the newest compact block was dropped")
+	}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+	
+	"github.com/boltdb/bolt"
+)
+
+const (
+	headersBucket   = "headers"
+	walletTxsBucket = "wallettxs"
+	// the hashes of the headers on the best chain
+	bestHeadersBucket = "bestheaders"
+)
+
+// false positive rate of the bloom filter light clients load
+const lightFilterFPRate = 0.0001
+
+// LightChain is what a light client keeps instead of the blockchain: the
+// block headers and the transactions of its wallet, each proven to be in
+// one of the blocks by a merkle proof. Light clients follow the proof-of-work
+// chain with the most work and trust the genesis block of the first peer they
+// sync from.
+type LightChain struct {
+	tip    []byte
+	db     *bolt.DB
+	engine ConsensusEngine
+	// headers may arrive on several connections at once
+	lock sync.Mutex
+}
+
+// WalletTx is a transaction of the wallet with the block it was proven in
+type WalletTx struct {
+	Tx     Transaction
+	Block  []byte
+	Height int
+}
+
+func lightDBExists(nodeID string) bool {
+	return dbExists(fmt.Sprintf(activeNet.HeadersFile, nodeID))
+}
+
+// NewLightChain opens the header store of nodeID, creating it when missing
+func NewLightChain(nodeID string) *LightChain {
+	db, err := bolt.Open(fmt.Sprintf(activeNet.HeadersFile, nodeID), 0600, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	var tip []byte
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(headersBucket))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(walletTxsBucket))
+		if err != nil {
+			return err
+		}
+		tip = b.Get([]byte("l"))
+		
+		if tx.Bucket([]byte(bestHeadersBucket)) != nil {
+			return nil
+		}
+		best, err := tx.CreateBucket([]byte(bestHeadersBucket))
+		if err != nil {
+			return err
+		}
+		// header stores from before side branches were kept only hold the best chain
+		for hash := tip; len(hash) > 0; {
+			var header BlockHeader
+			err := gob.NewDecoder(bytes.NewReader(b.Get(hash))).Decode(&header)
+			if err != nil {
+				return err
+			}
+			err = best.Put(hash, []byte{1})
+			if err != nil {
+				return err
+			}
+			hash = header.PrevBlockHash
+		}
+		
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	return &LightChain{tip: tip, db: db, engine: NewPowEngine(defaultMiner)}
+}
+
+func (lc *LightChain) GetHeader(hash []byte) (BlockHeader, error) {
+	var header BlockHeader
+	
+	err := lc.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(headersBucket)).Get(hash)
+		if data == nil {
+			return errors.New("Header is not found.")
+		}
+		
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(&header)
+	})
+	
+	return header, err
+}
+
+// GetBestHeight is the height of the last header, -1 before the first one
+func (lc *LightChain) GetBestHeight() int {
+	if lc.tip == nil {
+		return -1
+	}
+	
+	header, err := lc.GetHeader(lc.tip)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	return header.Height
+}
+
+// Locator lists hashes back from the tip, ten in a row and then further and
+// further apart, for a peer to find where our chains part
+func (lc *LightChain) Locator() [][]byte {
+	var locator [][]byte
+	step, skip := 1, 0
+	
+	for hash := lc.tip; len(hash) > 0; {
+		header, err := lc.GetHeader(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		
+		// always end with the genesis block
+		if skip == 0 || len(header.PrevBlockHash) == 0 {
+			locator = append(locator, hash)
+			if len(locator) >= 10 {
+				step *= 2
+			}
+			skip = step
+		}
+		skip--
+		hash = header.PrevBlockHash
+	}
+	
+	return locator
+}
+
+// AddHeader verifies and stores header. It must follow a stored header, or be
+// the genesis block of an empty chain. The tip moves to header when its branch
+// has more work than the best chain, the transactions saved from the blocks
+// that leave the best chain are dropped. It returns the headers that joined
+// the best chain, in chain order. Headers stored already are skipped.
+func (lc *LightChain) AddHeader(header BlockHeader) ([]BlockHeader, error) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	
+	if _, err := lc.GetHeader(header.Hash); err == nil {
+		return nil, nil
+	}
+	
+	var prev *Block
+	if lc.tip == nil {
+		if header.Height != 0 || len(header.PrevBlockHash) != 0 {
+			return nil, errors.New("the first header must be the genesis block")
+		}
+	} else {
+		parent, err := lc.GetHeader(header.PrevBlockHash)
+		if err != nil {
+			return nil, fmt.Errorf("header %x doesn't follow a known header", header.Hash)
+		}
+		if header.Height != parent.Height+1 {
+			return nil, fmt.Errorf("bad height %d, expected %d", header.Height, parent.Height+1)
+		}
+		prev = parent.Block()
+	}
+	if header.Timestamp > time.Now().Add(2*time.Hour).Unix() {
+		return nil, errors.New("header timestamp is too far in the future")
+	}
+	
+	err := lc.engine.VerifyHeader(header.Block(), prev)
+	if err != nil {
+		return nil, err
+	}
+	
+	connect := []BlockHeader{header}
+	var disconnect []BlockHeader
+	if lc.tip != nil && bytes.Compare(header.PrevBlockHash, lc.tip) != 0 {
+		tip, err := lc.GetHeader(lc.tip)
+		if err != nil {
+			return nil, err
+		}
+		disconnect, connect, err = lc.branches(tip, header)
+		if err != nil {
+			return nil, err
+		}
+		if headerWork(connect).Cmp(headerWork(disconnect)) <= 0 {
+			connect, disconnect = nil, nil
+		}
+	}
+	
+	err = lc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		best := tx.Bucket([]byte(bestHeadersBucket))
+		
+		err := b.Put(header.Hash, gobEncode(header))
+		if err != nil || len(connect) == 0 {
+			return err
+		}
+		
+		for _, h := range disconnect {
+			err := best.Delete(h.Hash)
+			if err != nil {
+				return err
+			}
+		}
+		err = dropWalletTxs(tx.Bucket([]byte(walletTxsBucket)), disconnect)
+		if err != nil {
+			return err
+		}
+		for _, h := range connect {
+			err := best.Put(h.Hash, []byte{1})
+			if err != nil {
+				return err
+			}
+		}
+		
+		return b.Put([]byte("l"), header.Hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(connect) == 0 {
+		return nil, nil
+	}
+	lc.tip = header.Hash
+	
+	for i, j := 0, len(connect)-1; i < j; i, j = i+1, j-1 {
+		connect[i], connect[j] = connect[j], connect[i]
+	}
+	
+	return connect, nil
+}
+
+// branches walks a and b back to their common header and returns the headers
+// of both branches, the highest first
+func (lc *LightChain) branches(a, b BlockHeader) ([]BlockHeader, []BlockHeader, error) {
+	var aBranch, bBranch []BlockHeader
+	var err error
+	
+	for bytes.Compare(a.Hash, b.Hash) != 0 {
+		if a.Height > b.Height {
+			aBranch = append(aBranch, a)
+			a, err = lc.GetHeader(a.PrevBlockHash)
+		} else {
+			bBranch = append(bBranch, b)
+			b, err = lc.GetHeader(b.PrevBlockHash)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	
+	return aBranch, bBranch, nil
+}
+
+// headerWork adds up the work behind headers like branchWork does for blocks
+func headerWork(headers []BlockHeader) *big.Int {
+	work := new(big.Int)
+	for _, header := range headers {
+		work.Add(work, new(big.Int).Lsh(big.NewInt(1), uint(header.Bits)))
+	}
+	
+	return work
+}
+
+// dropWalletTxs deletes the wallet transactions proven in headers
+func dropWalletTxs(b *bolt.Bucket, headers []BlockHeader) error {
+	blocks := make(map[string]bool)
+	for _, header := range headers {
+		blocks[hex.EncodeToString(header.Hash)] = true
+	}
+	
+	var drop [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var walletTx WalletTx
+		err := gob.NewDecoder(bytes.NewReader(v)).Decode(&walletTx)
+		if err != nil {
+			return err
+		}
+		if blocks[hex.EncodeToString(walletTx.Block)] {
+			drop = append(drop, k)
+		}
+		
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	
+	for _, k := range drop {
+		err := b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// AddMerkleBlock checks merkleBlock against the stored header and saves the
+// transactions it proves. Its block must be on the best chain. It returns the
+// saved ones.
+func (lc *LightChain) AddMerkleBlock(merkleBlock *MerkleBlock, txs []*Transaction) ([]*Transaction, error) {
+	header, err := lc.GetHeader(merkleBlock.Header.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Compare(header.MerkleRoot, merkleBlock.Header.MerkleRoot) != 0 {
+		return nil, errors.New("merkle root doesn't match the stored header")
+	}
+	
+	leaves, err := merkleBlock.Verify()
+	if err != nil {
+		return nil, err
+	}
+	proven := make(map[string]bool)
+	for _, leaf := range leaves {
+		proven[hex.EncodeToString(leaf)] = true
+	}
+	
+	var saved []*Transaction
+	err = lc.db.Update(func(dbtx *bolt.Tx) error {
+		b := dbtx.Bucket([]byte(walletTxsBucket))
+		if dbtx.Bucket([]byte(bestHeadersBucket)).Get(header.Hash) == nil {
+			return fmt.Errorf("block %x is not on the best chain", header.Hash)
+		}
+		
+		for _, tx := range txs {
+			if !proven[hex.EncodeToString(hashMerkleLeaf(tx.Serialize()))] {
+				continue
+			}
+			
+			err := b.Put(tx.ID, gobEncode(WalletTx{*tx, header.Hash, header.Height}))
+			if err != nil {
+				return err
+			}
+			saved = append(saved, tx)
+		}
+		
+		return nil
+	})
+	
+	return saved, err
+}
+
+// WalletTxs returns the saved transactions of the wallet
+func (lc *LightChain) WalletTxs() []WalletTx {
+	var txs []WalletTx
+	
+	err := lc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(walletTxsBucket)).ForEach(func(k, v []byte) error {
+			var walletTx WalletTx
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&walletTx)
+			if err != nil {
+				return err
+			}
+			txs = append(txs, walletTx)
+			
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	return txs
+}
+
+// FindUTXO returns the outputs locked with pubKeyHash that none of the saved
+// transactions spends
+func (lc *LightChain) FindUTXO(pubKeyHash []byte) []TxOutput {
+	var UTXOs []TxOutput
+	txs := lc.WalletTxs()
+	
+	spent := make(map[string]bool)
+	for _, walletTx := range txs {
+		if walletTx.Tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range walletTx.Tx.Vin {
+			spent[outpointKey(vin.Txid, vin.Vout)] = true
+		}
+	}
+	
+	for _, walletTx := range txs {
+		for outIdx, out := range walletTx.Tx.Vout {
+			if !spent[outpointKey(walletTx.Tx.ID, outIdx)] && out.IsLockedWithKey(pubKeyHash) {
+				UTXOs = append(UTXOs, out)
+			}
+		}
+	}
+	
+	return UTXOs
+}
+
+// walletFilter matches the transactions paying or spending from wallets
+func walletFilter(wallets *Wallets) *BloomFilter {
+	var hashes [][]byte
+	for _, address := range wallets.GetAddresses() {
+		hashes = append(hashes, AddressToPubKeyHash(address))
+	}
+	for _, script := range wallets.Scripts {
+		hashes = append(hashes, HashPubKey(script))
+	}
+	
+	var tweak [4]byte
+	_, err := rand.Read(tweak[:])
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	filter := NewBloomFilter(len(hashes), lightFilterFPRate, binary.LittleEndian.Uint32(tweak[:]))
+	for _, hash := range hashes {
+		filter.Add(hash)
+	}
+	
+	return filter
+}
+
+// StartLightClient syncs the headers of peer and the transactions of the
+// wallet of nodeID, then keeps following the blocks peer announces
+func StartLightClient(nodeID, peer string) {
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer ln.Close()
+	
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	lc := NewLightChain(nodeID)
+	defer lc.db.Close()
+	
+	sendFilterLoad(peer, walletFilter(wallets))
+	sendData(peer, append(commandToBytes("version"), gobEncode(verzion{nodeVersion, lc.GetBestHeight(), nodeAddress})...))
+	
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Panic(err)
+		}
+		go handleLightConnection(conn, lc, peer)
+	}
+}
+
+func handleLightConnection(conn net.Conn, lc *LightChain, peer string) {
+	defer conn.Close()
+	
+	request, err := ioutil.ReadAll(conn)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	magic := activeNet.Magic[:]
+	if len(request) < len(magic)+commandLength || bytes.Compare(request[:len(magic)], magic) != 0 {
+		fmt.Printf("ignoring a message that is not from the %s network\n", activeNet.Name)
+		return
+	}
+	request = request[len(magic):]
+	command := bytesToCommand(request[:commandLength])
+	
+	switch command {
+	case "headers":
+		handleLightHeaders(request, lc, peer)
+	case "inv":
+		handleLightInv(request, lc, peer)
+	case "merkleblock":
+		handleLightMerkleBlock(request, lc)
+	case "version":
+		handleLightVersion(request, lc, peer)
+	}
+}
+
+func handleLightVersion(request []byte, lc *LightChain, peer string) {
+	var buff bytes.Buffer
+	var payload verzion
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		fmt.Printf("dropping a malformed version message: %s\n", err)
+		return
+	}
+	
+	if payload.BestHeight > lc.GetBestHeight() {
+		sendGetHeaders(peer, lc.Locator())
+	}
+}
+
+func handleLightInv(request []byte, lc *LightChain, peer string) {
+	var buff bytes.Buffer
+	var payload inv
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		fmt.Printf("dropping a malformed inv message: %s\n", err)
+		return
+	}
+	
+	if payload.Type == "block" {
+		sendGetHeaders(peer, lc.Locator())
+	}
+}
+
+func handleLightHeaders(request []byte, lc *LightChain, peer string) {
+	var buff bytes.Buffer
+	var payload headers
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		fmt.Printf("dropping a malformed headers message: %s\n", err)
+		return
+	}
+	
+	for _, header := range payload.Headers {
+		connected, err := lc.AddHeader(header)
+		if err != nil {
+			fmt.Printf("rejected header %x: %s\n", header.Hash, err)
+			return
+		}
+		for _, header := range connected {
+			sendGetData(peer, "merkleblock", header.Hash)
+		}
+	}
+	fmt.Printf("synced headers up to height %d\n", lc.GetBestHeight())
+	
+	if len(payload.Headers) == maxHeadersPerMessage {
+		sendGetHeaders(peer, lc.Locator())
+	}
+}
+
+func handleLightMerkleBlock(request []byte, lc *LightChain) {
+	var buff bytes.Buffer
+	var payload merkleblock
+	
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		fmt.Printf("dropping a malformed merkleblock message: %s\n", err)
+		return
+	}
+	
+	var txs []*Transaction
+	for _, txData := range payload.Transactions {
+		var tx Transaction
+		err := gob.NewDecoder(bytes.NewReader(txData)).Decode(&tx)
+		if err != nil {
+			fmt.Printf("dropping a merkleblock message with a malformed transaction: %s\n", err)
+			return
+		}
+		txs = append(txs, &tx)
+	}
+	
+	saved, err := lc.AddMerkleBlock(&payload.MerkleBlock, txs)
+	if err != nil {
+		fmt.Printf("rejected merkle block %x: %s\n", payload.MerkleBlock.Header.Hash, err)
+		return
+	}
+	for _, tx := range saved {
+		fmt.Printf("transaction %x confirmed in block %d\n", tx.ID, payload.MerkleBlock.Header.Height)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// addHeaders adds the headers of blocks to lc and returns the headers that
+// joined its best chain
+func addHeaders(t *testing.T, lc *LightChain, blocks ...*Block) [][]byte {
+	t.Helper()
+	
+	var connected [][]byte
+	for _, block := range blocks {
+		headers, err := lc.AddHeader(block.Header())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, header := range headers {
+			connected = append(connected, header.Hash)
+		}
+	}
+	
+	return connected
+}
+
+func TestLightChainAddsHeaders(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	lc := NewLightChain("test")
+	defer lc.db.Close()
+	
+	genesis, _ := bc.GetBlock(bc.Tip())
+	blocks := bc.Generate(3, address(wallet))
+	if _, err := lc.AddHeader(blocks[0].Header()); err == nil {
+		t.Error("an empty chain took a header other than the genesis block")
+	}
+	
+	for _, block := range append([]*Block{&genesis}, blocks...) {
+		connected, err := lc.AddHeader(block.Header())
+		if err != nil || len(connected) != 1 {
+			t.Fatalf("header %d not added: %v", block.Height, err)
+		}
+	}
+	if connected, err := lc.AddHeader(blocks[1].Header()); err != nil || connected != nil {
+		t.Errorf("a stored header was added again: %v", err)
+	}
+	if lc.GetBestHeight() != 3 || !bytes.Equal(lc.tip, blocks[2].Hash) {
+		t.Errorf("best height %d, want 3", lc.GetBestHeight())
+	}
+	
+	locator := lc.Locator()
+	if len(locator) != 4 || !bytes.Equal(locator[0], blocks[2].Hash) || !bytes.Equal(locator[3], genesis.Hash) {
+		t.Errorf("locator %x, want the chain from the tip to the genesis block", locator)
+	}
+	
+	next := bc.Generate(2, address(wallet))
+	if _, err := lc.AddHeader(next[1].Header()); err == nil {
+		t.Error("added a header without its parent")
+	}
+	header := next[0].Header()
+	header.Nonce++
+	if _, err := lc.AddHeader(header); err == nil {
+		t.Error("added a header whose hash doesn't match")
+	}
+}
+
+func TestLightChainSavesProvenTransactions(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	lc := NewLightChain("test")
+	defer lc.db.Close()
+	
+	genesis, _ := bc.GetBlock(bc.Tip())
+	funding := genesis.Transactions[0]
+	tx := newTestTx(wallet, funding, []int{0}, 4, activeNet.Subsidy-4)
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTx(address(NewWallet()), ""), tx})
+	for _, b := range []*Block{&genesis, block} {
+		if _, err := lc.AddHeader(b.Header()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	filter := NewBloomFilter(10, 0.000001, 0)
+	filter.Add(HashPubKey(wallet.PublicKey))
+	mb, matched := NewMerkleBlock(block, filter.MatchesTx)
+	if len(matched) != 1 || matched[0] != tx {
+		t.Fatalf("matched %d transactions, want the wallet's", len(matched))
+	}
+	
+	unproven := NewCoinbaseTx(address(wallet), "")
+	saved, err := lc.AddMerkleBlock(mb, append(matched, unproven))
+	if err != nil || len(saved) != 1 || saved[0] != tx {
+		t.Fatalf("saved %d transactions: %v", len(saved), err)
+	}
+	if utxos := lc.FindUTXO(HashPubKey(wallet.PublicKey)); len(utxos) != 2 {
+		t.Errorf("%d unspent outputs, want the two of the saved transaction", len(utxos))
+	}
+	
+	mb.Header.MerkleRoot = genesis.HashTransaction()
+	if _, err := lc.AddMerkleBlock(mb, matched); err == nil {
+		t.Error("saved transactions proven against another merkle root")
+	}
+}
+
+func TestLightChainSwitchesToMoreWork(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	lc := NewLightChain("test")
+	defer lc.db.Close()
+	
+	genesis, _ := bc.GetBlock(bc.Tip())
+	a1 := mineOn(bc, &genesis, address(wallet))
+	a2 := mineOn(bc, a1, address(wallet))
+	addHeaders(t, lc, &genesis, a1, a2)
+	
+	mine := func(tx *Transaction) bool { return true }
+	saved, err := lc.AddMerkleBlock(NewMerkleBlock(a2, mine))
+	if err != nil || len(saved) != 1 {
+		t.Fatalf("saved %d transactions of the best chain: %v", len(saved), err)
+	}
+	
+	b1 := mineOn(bc, &genesis, address(wallet))
+	b2 := mineOn(bc, b1, address(wallet))
+	b3 := mineOn(bc, b2, address(wallet))
+	if connected := addHeaders(t, lc, b1, b2); len(connected) != 0 || bytes.Compare(lc.tip, a2.Hash) != 0 {
+		t.Fatal("an equal branch became the best chain")
+	}
+	if _, err := lc.AddMerkleBlock(NewMerkleBlock(b2, mine)); err == nil {
+		t.Error("saved transactions of a side branch")
+	}
+	
+	connected := addHeaders(t, lc, b3)
+	if len(connected) != 3 || bytes.Compare(connected[0], b1.Hash) != 0 || bytes.Compare(lc.tip, b3.Hash) != 0 {
+		t.Fatalf("connected %x, want the branch with more work in chain order", connected)
+	}
+	if txs := lc.WalletTxs(); len(txs) != 0 {
+		t.Errorf("%d transactions of the old branch stayed saved", len(txs))
+	}
+	if _, err := lc.AddMerkleBlock(NewMerkleBlock(b2, mine)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLightChainRejectsUnknownParent(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	lc := NewLightChain("test")
+	defer lc.db.Close()
+	
+	genesis, _ := bc.GetBlock(bc.Tip())
+	b1 := mineOn(bc, &genesis, address(wallet))
+	b2 := mineOn(bc, b1, address(wallet))
+	addHeaders(t, lc, &genesis)
+	if _, err := lc.AddHeader(b2.Header()); err == nil {
+		t.Error("added a header without its parent")
+	}
+}
+
+func TestLightHandlersDropMalformedMessages(t *testing.T) {
+	newTestChain(t)
+	lc := NewLightChain("test")
+	defer lc.db.Close()
+	
+	garbage := func(command string) []byte {
+		return append(commandToBytes(command), "garbage"...)
+	}
+	handleLightVersion(garbage("version"), lc, "localhost:0")
+	handleLightInv(garbage("inv"), lc, "localhost:0")
+	handleLightHeaders(garbage("headers"), lc, "localhost:0")
+	handleLightMerkleBlock(garbage("merkleblock"), lc)
+	
+	payload := gobEncode(merkleblock{"localhost:0", MerkleBlock{}, [][]byte{[]byte("garbage")}})
+	handleLightMerkleBlock(append(commandToBytes("merkleblock"), payload...), lc)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// upper bound for the serialized transactions of a block
+const maxBlockSize = 1000000
+
+type mempoolEntry struct {
+	tx       *Transaction
+	fee      int
+	size     int
+	parents  []string
+	children []string
+}
+
+// NewBlockTemplate picks transactions from pool for the next block. Transactions
+// are grouped with their unconfirmed ancestors into packages and packages are taken
+// by fee rate, so a child paying a high fee pulls its parents in with it.
+// Parents are always placed before their children.
+func (bc *BlockChain) NewBlockTemplate(pool map[string]Transaction, maxSize int) []*Transaction {
+	entries := make(map[string]*mempoolEntry)
+	
+	for id := range pool {
+		tx := pool[id]
+		entries[id] = &mempoolEntry{tx: &tx, size: len(tx.Serialize())}
+	}
+	
+	for id, entry := range entries {
+		for _, vin := range entry.tx.Vin {
+			parentID := hex.EncodeToString(vin.Txid)
+			parent, ok := entries[parentID]
+			if !ok || containsString(entry.parents, parentID) {
+				continue
+			}
+			entry.parents = append(entry.parents, parentID)
+			parent.children = append(parent.children, id)
+		}
+	}
+	
+	UTXOSet := UTXOSet{bc}
+	invalid := make(map[string]bool)
+	height := bc.GetBestHeight() + 1
+	mtp := bc.MedianTimePast(bc.Tip())
+	
+	for id, entry := range entries {
+		prevTXs, err := bc.prevTransactions(entry.tx, pool)
+		if err != nil || !entry.tx.Verify(prevTXs) || bc.CheckLocks(entry.tx, height, mtp) != nil {
+			markInvalid(id, entries, invalid)
+			continue
+		}
+		
+		entry.fee = entry.tx.Fee(prevTXs)
+		if entry.fee < 0 {
+			markInvalid(id, entries, invalid)
+			continue
+		}
+		
+		for _, vin := range entry.tx.Vin {
+			if _, ok := entries[hex.EncodeToString(vin.Txid)]; ok {
+				continue
+			}
+			if _, ok := UTXOSet.FindOutput(vin.Txid, vin.Vout); !ok {
+				markInvalid(id, entries, invalid)
+				break
+			}
+		}
+	}
+	
+	var txs []*Transaction
+	included := make(map[string]bool)
+	spent := make(map[string]bool)
+	blockSize := 0
+	
+	for {
+		var bestID string
+		var bestPackage []string
+		bestFee, bestSize := 0, 0
+		
+		for id := range entries {
+			if included[id] || invalid[id] {
+				continue
+			}
+			
+			pkg := packageOf(id, entries, included)
+			fee, size := 0, 0
+			for _, pid := range pkg {
+				fee += entries[pid].fee
+				size += entries[pid].size
+			}
+			
+			// compare fee/size against bestFee/bestSize without dividing
+			better := bestPackage == nil || fee*bestSize > bestFee*size ||
+				(fee*bestSize == bestFee*size && id < bestID)
+			if better {
+				bestID, bestPackage, bestFee, bestSize = id, pkg, fee, size
+			}
+		}
+		
+		if bestPackage == nil {
+			break
+		}
+		
+		if blockSize+bestSize > maxSize || conflicts(bestPackage, entries, spent) {
+			markInvalid(bestID, entries, invalid)
+			continue
+		}
+		
+		for _, id := range bestPackage {
+			for _, vin := range entries[id].tx.Vin {
+				spent[outpointKey(vin.Txid, vin.Vout)] = true
+			}
+			included[id] = true
+			txs = append(txs, entries[id].tx)
+		}
+		blockSize += bestSize
+	}
+	
+	return txs
+}
+
+// packageOf returns id with all of its ancestors that are not yet included,
+// parents ordered before children
+func packageOf(id string, entries map[string]*mempoolEntry, included map[string]bool) []string {
+	var pkg []string
+	visited := make(map[string]bool)
+	
+	var visit func(id string)
+	visit = func(id string) {
+		if visited[id] || included[id] {
+			return
+		}
+		visited[id] = true
+		
+		parents := append([]string{}, entries[id].parents...)
+		sort.Strings(parents)
+		for _, parent := range parents {
+			visit(parent)
+		}
+		pkg = append(pkg, id)
+	}
+	visit(id)
+	
+	return pkg
+}
+
+func markInvalid(id string, entries map[string]*mempoolEntry, invalid map[string]bool) {
+	if invalid[id] {
+		return
+	}
+	invalid[id] = true
+	
+	for _, child := range entries[id].children {
+		markInvalid(child, entries, invalid)
+	}
+}
+
+func conflicts(pkg []string, entries map[string]*mempoolEntry, spent map[string]bool) bool {
+	seen := make(map[string]bool)
+	
+	for _, id := range pkg {
+		for _, vin := range entries[id].tx.Vin {
+			key := outpointKey(vin.Txid, vin.Vout)
+			if spent[key] || seen[key] {
+				return true
+			}
+			seen[key] = true
+		}
+	}
+	
+	return false
+}
+
+func outpointKey(txid []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txid, vout)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// templateIDs lists the IDs of txs in order
+func templateIDs(txs []*Transaction) []string {
+	var ids []string
+	for _, tx := range txs {
+		ids = append(ids, hex.EncodeToString(tx.ID))
+	}
+	
+	return ids
+}
+
+func poolOf(txs ...*Transaction) map[string]Transaction {
+	pool := make(map[string]Transaction)
+	for _, tx := range txs {
+		pool[hex.EncodeToString(tx.ID)] = *tx
+	}
+	
+	return pool
+}
+
+// newTemplatePool funds three outputs of 6, 3 and 1 on bc and returns a
+// parent paying no fee, its child paying 5 and an unrelated transaction
+// paying 2
+func newTemplatePool(t *testing.T) (*BlockChain, *Wallet, *Transaction, []*Transaction) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	funding := newTestTx(wallet, genesis.Transactions[0], []int{0}, 6, 3, 1)
+	addTestBlock(bc, NewCoinbaseTx(address(wallet), "funding"), funding)
+	
+	parent := newTestTx(wallet, funding, []int{0}, 6)
+	child := newTestTx(wallet, parent, []int{0}, 1)
+	other := newTestTx(wallet, funding, []int{1}, 1)
+	
+	return bc, wallet, funding, []*Transaction{parent, child, other}
+}
+
+func TestTemplateChildPaysForParent(t *testing.T) {
+	bc, _, _, txs := newTemplatePool(t)
+	parent, child, other := txs[0], txs[1], txs[2]
+	
+	got := templateIDs(bc.NewBlockTemplate(poolOf(child, other, parent), maxBlockSize))
+	want := templateIDs([]*Transaction{parent, child, other})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("template %v, want the parent and its child before the other transaction", got)
+	}
+}
+
+func TestTemplateLeavesOutConflictsAndOrphans(t *testing.T) {
+	bc, wallet, funding, txs := newTemplatePool(t)
+	parent, child, other := txs[0], txs[1], txs[2]
+	
+	// spends the output other spends, for a lower fee
+	conflict := newTestTx(wallet, funding, []int{1}, 2)
+	got := templateIDs(bc.NewBlockTemplate(poolOf(parent, child, other, conflict), maxBlockSize))
+	want := templateIDs([]*Transaction{parent, child, other})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("template %v, want the conflicting transaction left out", got)
+	}
+	
+	// without its parent the child spends an output that doesn't exist
+	got = templateIDs(bc.NewBlockTemplate(poolOf(child, other), maxBlockSize))
+	if !reflect.DeepEqual(got, templateIDs([]*Transaction{other})) {
+		t.Errorf("template %v, want the orphan left out", got)
+	}
+}
+
+func TestTemplateRespectsMaxSize(t *testing.T) {
+	bc, _, _, txs := newTemplatePool(t)
+	parent, child, other := txs[0], txs[1], txs[2]
+	
+	// the package of parent and child doesn't fit, other does
+	size := len(other.Serialize())
+	got := templateIDs(bc.NewBlockTemplate(poolOf(parent, child, other), size))
+	if !reflect.DeepEqual(got, templateIDs([]*Transaction{other})) {
+		t.Errorf("template %v, want only the transaction that fits", got)
+	}
+}
+
+func TestTemplateRejectsBadSignatures(t *testing.T) {
+	bc, _, _, txs := newTemplatePool(t)
+	parent, other := txs[0], txs[2]
+	
+	forged := *parent
+	forged.Vout = []TxOutput{parent.Vout[0]}
+	forged.Vout[0].Value = 5
+	forged.ID = forged.Hash()
+	got := templateIDs(bc.NewBlockTemplate(poolOf(&forged, other), maxBlockSize))
+	if !reflect.DeepEqual(got, templateIDs([]*Transaction{other})) {
+		t.Errorf("template %v, want the forged transaction left out", got)
+	}
+}
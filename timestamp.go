@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+)
+
+// TimestampProof shows that data was recorded in the transaction at Index
+// of Block, Path links the transaction to the block's merkle root
+type TimestampProof struct {
+	Block *Block
+	Index int
+	Path  []MerkleStep
+}
+
+// HashFile is the SHA-256 hash committed for a timestamped file
+func HashFile(file string) ([]byte, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(content)
+	
+	return hash[:], nil
+}
+
+// FindTimestamp looks for the earliest data output carrying data
+func (bc *BlockChain) FindTimestamp(data []byte) (*TimestampProof, error) {
+	var proof *TimestampProof
+	bci := bc.Iterator()
+	
+	for {
+		block := bci.Next()
+		
+		for i, tx := range block.Transactions {
+			for _, out := range tx.Vout {
+				if out.IsUnspendable() && bytes.Compare(out.CarriedData(), data) == 0 {
+					proof = &TimestampProof{Block: block, Index: i}
+				}
+			}
+		}
+		
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	if proof == nil {
+		return nil, fmt.Errorf("%x is not timestamped", data)
+	}
+	
+	path, err := proof.Block.MerkleTree().Proof(proof.Index)
+	if err != nil {
+		return nil, err
+	}
+	proof.Path = path
+	
+	return proof, nil
+}
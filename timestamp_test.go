@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestDataOutputs(t *testing.T) {
+	data := []byte("document hash")
+	out := NewDataOutput(data)
+	if !out.IsUnspendable() || !bytes.Equal(out.CarriedData(), data) || out.Value != 0 {
+		t.Errorf("data output %+v does not carry %q", out, data)
+	}
+	
+	if NewTxOutput(1, address(NewWallet())).CarriedData() != nil {
+		t.Error("a key hash output carries data")
+	}
+	twoPushes := NewScriptOutput(0, NewScriptBuilder().AddOp(OP_RETURN).AddData(data).AddData(data).Script())
+	if twoPushes.CarriedData() != nil {
+		t.Error("a data output with two pushes carries data")
+	}
+}
+
+func TestCheckDataOutputs(t *testing.T) {
+	data := NewDataOutput([]byte("document hash"))
+	pay := NewTxOutput(1, address(NewWallet()))
+	
+	tests := []struct {
+		name string
+		vout []TxOutput
+		ok   bool
+	}{
+		{"no data", []TxOutput{*pay}, true},
+		{"one data output", []TxOutput{*data, *pay}, true},
+		{"two data outputs", []TxOutput{*data, *data}, false},
+		{"oversized", []TxOutput{*NewDataOutput(make([]byte, maxDataCarrierSize+1))}, false},
+		{"bare OP_RETURN", []TxOutput{*NewScriptOutput(0, NewScriptBuilder().AddOp(OP_RETURN).Script())}, false},
+	}
+	
+	for _, test := range tests {
+		tx := &Transaction{Vout: test.vout}
+		if err := tx.CheckDataOutputs(); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	data := sha256.Sum256([]byte("document"))
+	
+	tx := NewDataTransaction(wallet, data[:], &UTXOSet{bc}, nil)
+	if len(tx.Vout) != 2 || tx.Vout[1].Value != activeNet.Subsidy {
+		t.Fatalf("outputs %v, want a data output and the whole input back as change", tx.Vout)
+	}
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTx(address(wallet), ""), tx})
+	
+	if _, ok := (UTXOSet{bc}).FindOutput(tx.ID, 0); ok {
+		t.Error("the data output went into the UTXO set")
+	}
+	if _, ok := (UTXOSet{bc}).FindOutput(tx.ID, 1); !ok {
+		t.Error("the change is missing from the UTXO set")
+	}
+	
+	proof, err := bc.FindTimestamp(data[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.Index != 1 || !bytes.Equal(proof.Block.Hash, block.Hash) {
+		t.Fatalf("proof points at transaction %d of %x", proof.Index, proof.Block.Hash)
+	}
+	if !VerifyMerkleProof(block.HashTransaction(), hashMerkleLeaf(tx.Serialize()), proof.Path) {
+		t.Error("the merkle path does not lead to the block's root")
+	}
+	
+	if _, err := bc.FindTimestamp([]byte("never recorded")); err == nil {
+		t.Error("found a timestamp for data that was never recorded")
+	}
+}
+
+func TestBlockRejectsMalformedDataOutputs(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	prev := genesis.Transactions[0]
+	tx := &Transaction{
+		Vin:  []TxInput{{Txid: prev.ID, Vout: 0, PubKey: wallet.PublicKey}},
+		Vout: []TxOutput{*NewDataOutput(make([]byte, maxDataCarrierSize+1)), *NewTxOutput(activeNet.Subsidy, address(wallet))},
+	}
+	tx.ID = tx.Hash()
+	tx.Sign(wallet.PrivateKey, poolOf(prev))
+	
+	block, err := NewBlockContext(context.Background(), bc.engine, []*Transaction{NewCoinbaseTx(address(wallet), ""), tx}, &genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.ConnectBlock(block); err == nil || !strings.Contains(err.Error(), "data output") {
+		t.Errorf("got %v connecting a block with an oversized data output", err)
+	}
+}
@@ -3,27 +3,31 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"log"
-	"math/big"
-	
-	"cyain/utils"
+	"sort"
 )
 
-// reward for mining
-const subsidy = 10
 const utxoBucket = "chainstate"
 
+// outputs spent by each block of the best chain, by block hash
+const undoBucket = "undo"
+
+// most bytes a data output may carry
+const maxDataCarrierSize = 80
+
 type Transaction struct {
 	ID   []byte
 	Vin  []TxInput
 	Vout []TxOutput
+	// height or time the transaction can't be mined before, 0 for none
+	LockTime int64
 }
 
 func (tx Transaction) IsCoinbase() bool {
@@ -43,11 +47,17 @@ func (tx *Transaction) SetID() {
 	tx.ID = hash[:]
 }
 
+// TxInput spends output Vout of transaction Txid. Inputs spending a plain
+// key hash output only carry Signature and PubKey, all others put the data
+// their output's script expects into ScriptSig. Sequence holds a lock relative
+// to the confirmation of the spent output.
 type TxInput struct {
 	Txid      []byte
 	Vout      int
 	Signature []byte
 	PubKey    []byte
+	ScriptSig []byte
+	Sequence  uint32
 }
 
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
@@ -56,23 +66,140 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
+// UnlockingScript is run before the locking script of the spent output
+func (in *TxInput) UnlockingScript() []byte {
+	if len(in.ScriptSig) > 0 {
+		return in.ScriptSig
+	}
+	
+	return NewScriptBuilder().AddData(in.Signature).AddData(in.PubKey).Script()
+}
+
+// TxOutput is locked either to PubKeyHash or, when Script is set, to Script
 type TxOutput struct {
 	Value      int
 	PubKeyHash []byte
+	Script     []byte
+}
+
+// NewScriptOutput creates an output spendable by whoever satisfies script
+func NewScriptOutput(value int, script []byte) *TxOutput {
+	return &TxOutput{value, nil, script}
+}
+
+// NewDataOutput creates an output carrying data that can never be spent
+func NewDataOutput(data []byte) *TxOutput {
+	return NewScriptOutput(0, NewScriptBuilder().AddOp(OP_RETURN).AddData(data).Script())
+}
+
+// IsUnspendable tells data outputs apart, they are never added to the UTXO set
+func (out *TxOutput) IsUnspendable() bool {
+	return len(out.Script) > 0 && out.Script[0] == OP_RETURN
+}
+
+// CarriedData returns the data of a data output, nil for any other output
+func (out *TxOutput) CarriedData() []byte {
+	if !out.IsUnspendable() {
+		return nil
+	}
+	
+	ops, err := parseScript(out.Script[1:])
+	if err != nil || len(ops) != 1 || ops[0].opcode > OP_PUSHDATA2 {
+		return nil
+	}
+	
+	return append([]byte{}, ops[0].data...)
+}
+
+// CheckDataOutputs allows a transaction at most one data output, carrying a
+// single push of up to maxDataCarrierSize bytes
+func (tx *Transaction) CheckDataOutputs() error {
+	carriers := 0
+	for _, out := range tx.Vout {
+		if !out.IsUnspendable() {
+			continue
+		}
+		carriers++
+		
+		data := out.CarriedData()
+		if data == nil || len(data) > maxDataCarrierSize {
+			return fmt.Errorf("transaction %x has a malformed data output", tx.ID)
+		}
+	}
+	if carriers > 1 {
+		return fmt.Errorf("transaction %x has %d data outputs", tx.ID, carriers)
+	}
+	
+	return nil
+}
+
+// CheckOutputLocks makes sure outputs naming a hash in PubKeyHash are locked
+// by the script paying to it, as balances are looked up by PubKeyHash alone
+func (tx *Transaction) CheckOutputLocks() error {
+	for i, out := range tx.Vout {
+		if len(out.PubKeyHash) > 0 && !out.locksToPubKeyHash() {
+			return fmt.Errorf("output %d of transaction %x isn't locked to its hash", i, tx.ID)
+		}
+	}
+	
+	return nil
+}
+
+// locksToPubKeyHash tells whether spending out takes the key or the script
+// hashing to PubKeyHash
+func (out *TxOutput) locksToPubKeyHash() bool {
+	return len(out.Script) == 0 ||
+		bytes.Equal(out.Script, PayToPubKeyHashScript(out.PubKeyHash)) ||
+		bytes.Equal(out.Script, PayToScriptHashScript(out.PubKeyHash))
+}
+
+// LockingScript is the script an input spending out has to satisfy
+func (out *TxOutput) LockingScript() []byte {
+	if len(out.Script) > 0 {
+		return out.Script
+	}
+	
+	return PayToPubKeyHashScript(out.PubKeyHash)
 }
 
+// scriptCode is what signatures spending out commit to. Key hash outputs
+// keep committing to the bare hash so older signatures stay valid.
+func (out *TxOutput) scriptCode() []byte {
+	if len(out.Script) > 0 {
+		return out.Script
+	}
+	
+	return out.PubKeyHash
+}
+
+// Lock pays out to address. Outputs to script addresses also keep the script
+// hash in PubKeyHash so they can be looked up like any other.
 func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := utils.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	out.PubKeyHash = AddressToPubKeyHash(string(address))
+	if IsScriptAddress(string(address)) {
+		out.Script = PayToScriptHashScript(out.PubKeyHash)
+	}
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0 && out.locksToPubKeyHash()
 }
 
+// unspent outputs of a transaction, Indexes holds their positions in Vout.
+// Height is the height of the block that confirmed them and Time the median
+// time past before that block.
 type TxOutputs struct {
 	Outputs []TxOutput
+	Indexes []int
+	Height  int
+	Time    int64
+}
+
+func (outs TxOutputs) Index(i int) int {
+	if outs.Indexes == nil {
+		return i
+	}
+	return outs.Indexes[i]
 }
 
 func (outs TxOutputs) Serialize() []byte {
@@ -101,52 +228,106 @@ func NewTxOutput(value int, address string) *TxOutput {
 	txo := &TxOutput{
 		value,
 		nil,
+		nil,
 	}
 	txo.Lock([]byte(address))
 	
 	return txo
 }
 
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// NewUTXOTransaction spends outputs of wallet, including unconfirmed ones from
+// pending, and skips outputs the pending transactions already spend
+func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet, pending map[string]Transaction) *Transaction {
+	from := fmt.Sprintf("%s", wallet.GetAddress())
+	tx, err := NewUnsignedTransaction(from, to, amount, UTXOSet, pending)
+	if err != nil {
+		log.Panic("ERROR: ", err)
+	}
+	
+	for i := range tx.Vin {
+		tx.Vin[i].PubKey = wallet.PublicKey
+	}
+	tx.ID = tx.Hash()
+	UTXOSet.BlockChain.SignTransactionWith(tx, wallet.PrivateKey, pending)
+	
+	return tx
+}
+
+// NewDataTransaction records data on chain in an output nobody can spend. An
+// output of wallet pays for it and comes back as change.
+func NewDataTransaction(wallet *Wallet, data []byte, UTXOSet *UTXOSet, pending map[string]Transaction) *Transaction {
+	if len(data) > maxDataCarrierSize {
+		log.Panicf("ERROR: Data outputs carry at most %d bytes", maxDataCarrierSize)
+	}
+	
+	from := fmt.Sprintf("%s", wallet.GetAddress())
+	tx, err := NewUnsignedTransaction(from, from, 1, UTXOSet, pending)
+	if err != nil {
+		log.Panic("ERROR: The wallet has no outputs to spend")
+	}
+	
+	// everything goes back as change
+	change := 0
+	for _, out := range tx.Vout {
+		change += out.Value
+	}
+	tx.Vout = []TxOutput{*NewDataOutput(data), *NewTxOutput(change, from)}
+	
+	for i := range tx.Vin {
+		tx.Vin[i].PubKey = wallet.PublicKey
+	}
+	tx.ID = tx.Hash()
+	UTXOSet.BlockChain.SignTransactionWith(tx, wallet.PrivateKey, pending)
+	
+	return tx
+}
+
+// NewUnsignedTransaction sends amount from the outputs paying to address from
+// to to, the change goes back to from. Nothing is signed, so the keys of from
+// don't have to be around.
+func NewUnsignedTransaction(from, to string, amount int, UTXOSet *UTXOSet, pending map[string]Transaction) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 	
-	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
-	
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(AddressToPubKeyHash(from), amount, pending)
 	if acc < amount {
-		log.Panic("ERROR: Not enough funds")
+		return nil, errors.New("not enough funds")
 	}
 	
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 		
 		for _, out := range outs {
-			input := TxInput{txID, out, nil, wallet.PublicKey}
+			input := TxInput{txID, out, nil, nil, nil, 0}
 			inputs = append(inputs, input)
 		}
 	}
 	
-	from := fmt.Sprintf("%s", wallet.GetAddress())
 	outputs = append(outputs, *NewTxOutput(amount, to))
 	if acc > amount {
 		outputs = append(outputs, *NewTxOutput(acc-amount, from)) // a change
 	}
 	
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, 0}
 	tx.ID = tx.Hash()
-	UTXOSet.BlockChain.SignTransaction(&tx, wallet.PrivateKey)
 	
-	return &tx
+	return &tx, nil
 }
 
 // coinbase -> input是0，但是有output的tx
 func NewCoinbaseTx(to, data string) *Transaction {
 	if data == "" {
-		data = fmt.Sprintf("Reward to '%s'", to)
+		// random bytes keep coinbase IDs unique across blocks paying the same address
+		randData := make([]byte, 20)
+		_, err := rand.Read(randData)
+		if err != nil {
+			log.Panic(err)
+		}
+		
+		data = fmt.Sprintf("Reward to '%s' %x", to, randData)
 	}
 	
 	txin := TxInput{
@@ -154,21 +335,31 @@ func NewCoinbaseTx(to, data string) *Transaction {
 		-1,
 		nil,
 		[]byte(data),
+		nil,
+		0,
 	}
 	txout := NewTxOutput(
-		subsidy,
+		activeNet.Subsidy,
 		to,
 	)
 	tx := Transaction{
 		nil,
 		[]TxInput{txin},
 		[]TxOutput{*txout},
+		0,
 	}
 	tx.SetID()
 	
 	return &tx
 }
 
+// gob numbers types in the order a process first meets them and the numbers
+// end up in Serialize, which IDs, signatures and merkle roots hash. Meeting
+// Transaction before anything else makes them the same in every process.
+func init() {
+	Transaction{}.Serialize()
+}
+
 func (tx Transaction) Serialize() []byte {
 	var encoded bytes.Buffer
 	
@@ -193,75 +384,76 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
+// Fee is the difference between the spent and the created value
+func (tx *Transaction) Fee(prevTxs map[string]Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+	
+	fee := 0
+	for _, vin := range tx.Vin {
+		prevTx := prevTxs[hex.EncodeToString(vin.Txid)]
+		fee += prevTx.Vout[vin.Vout].Value
+	}
+	for _, vout := range tx.Vout {
+		fee -= vout.Value
+	}
+	
+	return fee
+}
+
+// Sign signs every input with privKey, it is meant for inputs spending key hash outputs
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
 	}
 	
-	txCopy := tx.TrimmedCopy()
-	
-	for inID, vin := range txCopy.Vin {
+	for inID, vin := range tx.Vin {
 		prevTx := prevTxs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
 		// vout 作为int只是为了表示在tx中，这个out的序号
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
-		
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		signature := append(r.Bytes(), s.Bytes()...)
+		prevOut := prevTx.Vout[vin.Vout]
 		
-		tx.Vin[inID].Signature = signature
-		_ = err
+		tx.Vin[inID].Signature = signHash(privKey, tx.sigHash(inID, prevOut.scriptCode()))
 	}
 }
 
+// sigHash is the hash signed by input inID, scriptCode takes the place of its
+// public key in the trimmed copy
+func (tx *Transaction) sigHash(inID int, scriptCode []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inID].PubKey = scriptCode
+	
+	return txCopy.Hash()
+}
+
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 	
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TxInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TxInput{vin.Txid, vin.Vout, nil, nil, nil, vin.Sequence})
 	}
 	
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TxOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TxOutput{vout.Value, vout.PubKeyHash, vout.Script})
 	}
 	
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 	
 	return txCopy
 }
 
+// Verify runs the scripts of every input
 func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
 	
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-	
 	for inID, vin := range tx.Vin {
 		prevTx := prevTxs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
 		
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-		
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-		
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
+		err := VerifyInput(tx, inID, prevTx.Vout[vin.Vout])
+		if err != nil {
 			return false
 		}
 	}
@@ -274,6 +466,9 @@ type UTXOSet struct {
 }
 
 func (u UTXOSet) Reindex() {
+	u.BlockChain.chainLock.Lock()
+	defer u.BlockChain.chainLock.Unlock()
+	
 	db := u.BlockChain.db
 	bucketName := []byte(utxoBucket)
 	
@@ -313,11 +508,17 @@ func (u UTXOSet) Reindex() {
 		
 		return nil
 	})
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	events.Publish(UTXOSetChanged{u.BlockChain, nil})
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
+func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int, pending map[string]Transaction) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
+	claimed := pendingSpends(pending)
 	db := u.BlockChain.db
 	
 	err := db.View(func(tx *bolt.Tx) error {
@@ -329,9 +530,12 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 			outs := DeserializeOutputs(v)
 			
 			for outIdx, out := range outs.Outputs {
+				if claimed[outpointKey(k, outs.Index(outIdx))] {
+					continue
+				}
 				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
 					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+					unspentOutputs[txID] = append(unspentOutputs[txID], outs.Index(outIdx))
 				}
 			}
 		}
@@ -342,9 +546,41 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 		log.Panic(err)
 	}
 	
+	var pendingIDs []string
+	for txID := range pending {
+		pendingIDs = append(pendingIDs, txID)
+	}
+	sort.Strings(pendingIDs)
+	
+	for _, txID := range pendingIDs {
+		tx := pending[txID]
+		for outIdx, out := range tx.Vout {
+			if claimed[outpointKey(tx.ID, outIdx)] {
+				continue
+			}
+			if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
+				accumulated += out.Value
+				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+			}
+		}
+	}
+	
 	return accumulated, unspentOutputs
 }
 
+// outpoints spent by the given unconfirmed transactions
+func pendingSpends(pending map[string]Transaction) map[string]bool {
+	spent := make(map[string]bool)
+	
+	for _, tx := range pending {
+		for _, vin := range tx.Vin {
+			spent[outpointKey(vin.Txid, vin.Vout)] = true
+		}
+	}
+	
+	return spent
+}
+
 func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TxOutput {
 	var UTXOs []TxOutput
 	db := u.BlockChain.db
@@ -370,53 +606,207 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TxOutput {
 	return UTXOs
 }
 
-func (u UTXOSet) Update(block *Block) {
+// UTXO is an unspent output with the transaction it belongs to
+type UTXO struct {
+	Txid   []byte
+	Vout   int
+	Output TxOutput
+	Height int
+}
+
+// FindUnspent is FindUTXO with the outpoints, ordered by transaction ID and index
+func (u UTXOSet) FindUnspent(pubKeyHash []byte) []UTXO {
+	var UTXOs []UTXO
 	db := u.BlockChain.db
 	
-	err := db.Update(func(tx *bolt.Tx) error {
+	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
 		
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updatedOuts := TxOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-					
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-					
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			
+			for outIdx, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) {
+					txid := append([]byte{}, k...)
+					UTXOs = append(UTXOs, UTXO{txid, outs.Index(outIdx), out, outs.Height})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return UTXOs
+}
+
+// FindOutput looks up the unspent output vout of transaction txid
+func (u UTXOSet) FindOutput(txid []byte, vout int) (TxOutput, bool) {
+	outs, ok := u.FindOutputs(txid)
+	if !ok {
+		return TxOutput{}, false
+	}
+	
+	for outIdx, out := range outs.Outputs {
+		if outs.Index(outIdx) == vout {
+			return out, true
+		}
+	}
+	
+	return TxOutput{}, false
+}
+
+// FindOutputs looks up the unspent outputs of transaction txid
+func (u UTXOSet) FindOutputs(txid []byte) (TxOutputs, bool) {
+	var outs TxOutputs
+	found := false
+	db := u.BlockChain.db
+	
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		outsBytes := b.Get(txid)
+		if outsBytes == nil {
+			return nil
+		}
+		
+		outs = DeserializeOutputs(outsBytes)
+		found = true
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	return outs, found
+}
+
+// spentOutput is an output a block spent, kept to put it back into the UTXO
+// set when the block is disconnected
+type spentOutput struct {
+	Txid   []byte
+	Vout   int
+	Output TxOutput
+	Height int
+	Time   int64
+}
+
+// updateUTXO takes block into the UTXO set in b, mtp is the median time past
+// before block. It returns the outputs block spent in the order of its inputs.
+func updateUTXO(b *bolt.Bucket, block *Block, mtp int64) ([]spentOutput, error) {
+	var spent []spentOutput
+	
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, vin := range tx.Vin {
+				outsBytes := b.Get(vin.Txid)
+				if outsBytes == nil {
+					return nil, fmt.Errorf("output %s is not in the UTXO set", outpointKey(vin.Txid, vin.Vout))
+				}
+				outs := DeserializeOutputs(outsBytes)
+				updatedOuts := TxOutputs{Height: outs.Height, Time: outs.Time}
+				
+				for outIdx, out := range outs.Outputs {
+					if outs.Index(outIdx) != vin.Vout {
+						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Index(outIdx))
 					} else {
-						err := b.Put(vin.Txid, updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
+						spent = append(spent, spentOutput{vin.Txid, vin.Vout, out, outs.Height, outs.Time})
+					}
+				}
+				
+				if len(updatedOuts.Outputs) == 0 {
+					err := b.Delete(vin.Txid)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					err := b.Put(vin.Txid, updatedOuts.Serialize())
+					if err != nil {
+						return nil, err
 					}
 				}
 			}
-			
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+		}
+		
+		newOutputs := TxOutputs{Height: block.Height, Time: mtp}
+		for outIdx, out := range tx.Vout {
+			if out.IsUnspendable() {
+				continue
 			}
-			err := b.Put(tx.ID, newOutputs.Serialize())
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+		}
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
+		err := b.Put(tx.ID, newOutputs.Serialize())
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	return spent, nil
+}
+
+// revertUTXO takes block back out of the UTXO set in b, spent are the outputs
+// updateUTXO returned for it
+func revertUTXO(b *bolt.Bucket, block *Block, spent []spentOutput) error {
+	next := len(spent)
+	
+	// later transactions of the block may spend earlier ones
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		err := b.Delete(tx.ID)
+		if err != nil {
+			return err
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		
+		for j := len(tx.Vin) - 1; j >= 0; j-- {
+			next--
+			vin := tx.Vin[j]
+			if next < 0 || bytes.Compare(spent[next].Txid, vin.Txid) != 0 || spent[next].Vout != vin.Vout {
+				return fmt.Errorf("the undo data of block %x doesn't match it", block.Hash)
+			}
+			
+			err = restoreOutput(b, spent[next])
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
 		}
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
 	}
+	
+	return nil
+}
+
+// restoreOutput puts a spent output back among the unspent outputs of its
+// transaction
+func restoreOutput(b *bolt.Bucket, spent spentOutput) error {
+	outs := TxOutputs{Height: spent.Height, Time: spent.Time}
+	if outsBytes := b.Get(spent.Txid); outsBytes != nil {
+		outs = DeserializeOutputs(outsBytes)
+	}
+	
+	restored := TxOutputs{Height: outs.Height, Time: outs.Time}
+	added := false
+	for outIdx, out := range outs.Outputs {
+		if !added && outs.Index(outIdx) > spent.Vout {
+			restored.Outputs = append(restored.Outputs, spent.Output)
+			restored.Indexes = append(restored.Indexes, spent.Vout)
+			added = true
+		}
+		restored.Outputs = append(restored.Outputs, out)
+		restored.Indexes = append(restored.Indexes, outs.Index(outIdx))
+	}
+	if !added {
+		restored.Outputs = append(restored.Outputs, spent.Output)
+		restored.Indexes = append(restored.Indexes, spent.Vout)
+	}
+	
+	return b.Put(spent.Txid, restored.Serialize())
 }
 
 func (u UTXOSet) CountTransactions() int {
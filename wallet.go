@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
 	
 	"golang.org/x/crypto/ripemd160"
@@ -17,11 +21,7 @@ import (
 	"cyain/utils"
 )
 
-const (
-	version            = byte(0x01)
-	addressChecksumLen = 4
-	wallet_file        = "wallet.db"
-)
+const addressChecksumLen = 4
 
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
@@ -29,7 +29,124 @@ type Wallet struct {
 }
 
 type Wallets struct {
+	// name of the network the addresses belong to
+	Network string
 	Wallets map[string]*Wallet
+	// transactions sent to the mempool but not mined yet
+	Pending map[string]Transaction
+	// redeem scripts of the multisig addresses we take part in
+	Scripts map[string][]byte
+}
+
+// walletData is the stored form of a Wallet, ecdsa.PrivateKey itself can't go
+// through gob
+type walletData struct {
+	D         []byte
+	PublicKey []byte
+}
+
+func (w Wallet) GobEncode() ([]byte, error) {
+	var content bytes.Buffer
+	
+	err := gob.NewEncoder(&content).Encode(walletData{w.PrivateKey.D.Bytes(), w.PublicKey})
+	if err != nil {
+		return nil, err
+	}
+	
+	return content.Bytes(), nil
+}
+
+// GobDecode derives the public point from the private key rather than
+// splitting PublicKey, whose halves may differ in length
+func (w *Wallet) GobDecode(data []byte) error {
+	var wd walletData
+	
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wd)
+	if err != nil {
+		return err
+	}
+	if len(wd.D) == 0 || len(wd.PublicKey) == 0 {
+		return errors.New("the wallet has no key")
+	}
+	
+	// P-256 scalars take 32 bytes, big.Int drops the leading zeros
+	d := make([]byte, 32)
+	if len(wd.D) > len(d) {
+		return errors.New("the private key of the wallet is too long")
+	}
+	copy(d[len(d)-len(wd.D):], wd.D)
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return err
+	}
+	
+	// the uncompressed point, 4 followed by X and Y
+	point := key.PublicKey().Bytes()
+	x := new(big.Int).SetBytes(point[1:33])
+	y := new(big.Int).SetBytes(point[33:])
+	// older wallets stored X and Y without their leading zeros
+	if bytes.Compare(point[1:], wd.PublicKey) != 0 && bytes.Compare(append(x.Bytes(), y.Bytes()...), wd.PublicKey) != 0 {
+		return errors.New("the public key of the wallet doesn't match its private key")
+	}
+	
+	w.PrivateKey = ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+		D:         new(big.Int).SetBytes(wd.D),
+	}
+	w.PublicKey = wd.PublicKey
+	
+	return nil
+}
+
+// legacyWallets is the layout of wallet files written before Wallet had its
+// own encoding, when gob stored ecdsa.PrivateKey field by field with the curve
+// registered as an interface value. They are read once and saved in the
+// current layout.
+type legacyWallets struct {
+	Wallets map[string]*struct {
+		PrivateKey struct {
+			PublicKey struct {
+				Curve interface{}
+				X, Y  *big.Int
+			}
+			D *big.Int
+		}
+		PublicKey []byte
+	}
+}
+
+// legacyCurve decodes the P-256 curve value of legacy wallet files
+type legacyCurve struct {
+	CurveParams *elliptic.CurveParams
+}
+
+func init() {
+	gob.RegisterName("crypto/elliptic.p256Curve", legacyCurve{})
+}
+
+func decodeLegacyWallets(data []byte) (map[string]*Wallet, error) {
+	var legacy legacyWallets
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&legacy)
+	if err != nil {
+		return nil, err
+	}
+	
+	wallets := make(map[string]*Wallet)
+	for address, lw := range legacy.Wallets {
+		key := lw.PrivateKey
+		if key.D == nil || key.PublicKey.X == nil || key.PublicKey.Y == nil {
+			return nil, fmt.Errorf("the key of %s is incomplete", address)
+		}
+		wallets[address] = &Wallet{
+			ecdsa.PrivateKey{
+				PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: key.PublicKey.X, Y: key.PublicKey.Y},
+				D:         key.D,
+			},
+			lw.PublicKey,
+		}
+	}
+	
+	return wallets, nil
 }
 
 func NewWallet() *Wallet {
@@ -48,15 +165,25 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	if err != nil {
 		log.Panic(err)
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// X and Y padded to the curve size, so the key splits in half
+	pubKey := make([]byte, 64)
+	private.PublicKey.X.FillBytes(pubKey[:32])
+	private.PublicKey.Y.FillBytes(pubKey[32:])
 	
 	return *private, pubKey
 }
 
 func (w Wallet) GetAddress() []byte {
-	pubKeyHash := HashPubKey(w.PublicKey)
-	
-	versionedPayload := append([]byte{version}, pubKeyHash...)
+	return encodeAddress(activeNet.AddressVersion, HashPubKey(w.PublicKey))
+}
+
+// ScriptAddress is the pay-to-script-hash address of redeemScript
+func ScriptAddress(redeemScript []byte) string {
+	return string(encodeAddress(activeNet.ScriptHashVersion, HashPubKey(redeemScript)))
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedPayload := append([]byte{version}, hash...)
 	checksum := checksum(versionedPayload)
 	
 	fullPayload := append(versionedPayload, checksum...)
@@ -65,6 +192,13 @@ func (w Wallet) GetAddress() []byte {
 	return address
 }
 
+// IsScriptAddress tells pay-to-script-hash addresses from key hash ones
+func IsScriptAddress(address string) bool {
+	payload := utils.Base58Decode([]byte(address))
+	
+	return len(payload) > 0 && payload[0] == activeNet.ScriptHashVersion
+}
+
 func HashPubKey(pubKey []byte) []byte {
 	publicSHA256 := sha256.Sum256(pubKey)
 	
@@ -78,6 +212,55 @@ func HashPubKey(pubKey []byte) []byte {
 	return publicRIPEMD160
 }
 
+// AddressToPubKeyHash strips the version byte and checksum off an address
+func AddressToPubKeyHash(address string) []byte {
+	pubKeyHash := utils.Base58Decode([]byte(address))
+	
+	return pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
+}
+
+// signHash signs hash and returns r and s padded to the curve size
+func signHash(privKey ecdsa.PrivateKey, hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+	if err != nil {
+		log.Panic(err)
+	}
+	
+	size := (privKey.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	
+	return signature
+}
+
+// verifySignature checks a r||s signature of hash against a X||Y public key
+func verifySignature(pubKey, hash, signature []byte) bool {
+	if len(signature) == 0 || len(pubKey) == 0 {
+		return false
+	}
+	
+	r := big.Int{}
+	s := big.Int{}
+	sigLen := len(signature)
+	r.SetBytes(signature[:(sigLen / 2)])
+	s.SetBytes(signature[(sigLen / 2):])
+	
+	x := big.Int{}
+	y := big.Int{}
+	keyLen := len(pubKey)
+	x.SetBytes(pubKey[:(keyLen / 2)])
+	y.SetBytes(pubKey[(keyLen / 2):])
+	
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(&x, &y) {
+		return false
+	}
+	
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
+	return ecdsa.Verify(&rawPubKey, hash, &r, &s)
+}
+
 func checksum(payload []byte) []byte {
 	firstSHA := sha256.Sum256(payload)
 	secondSHA := sha256.Sum256(firstSHA[:])
@@ -87,7 +270,10 @@ func checksum(payload []byte) []byte {
 
 func NewWallets(nodeid string) (*Wallets, error) {
 	wallets := Wallets{}
+	wallets.Network = activeNet.Name
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Pending = make(map[string]Transaction)
+	wallets.Scripts = make(map[string][]byte)
 	
 	err := wallets.LoadFromFile(nodeid)
 	
@@ -117,8 +303,50 @@ func (ws Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+// FindWallet returns the wallet whose public key hashes to pubKeyHash, or nil
+func (ws *Wallets) FindWallet(pubKeyHash []byte) *Wallet {
+	for _, wallet := range ws.Wallets {
+		if bytes.Compare(HashPubKey(wallet.PublicKey), pubKeyHash) == 0 {
+			return wallet
+		}
+	}
+	
+	return nil
+}
+
+func (ws *Wallets) AddPending(tx *Transaction) {
+	ws.Pending[hex.EncodeToString(tx.ID)] = *tx
+}
+
+// SyncPending forgets pending transactions whose inputs are gone, either because
+// they were mined or because a conflicting transaction was
+func (ws *Wallets) SyncPending(UTXOSet *UTXOSet) {
+	for {
+		removed := false
+		
+		for txID, tx := range ws.Pending {
+			for _, vin := range tx.Vin {
+				if _, ok := UTXOSet.FindOutput(vin.Txid, vin.Vout); ok {
+					continue
+				}
+				if parent, ok := ws.Pending[hex.EncodeToString(vin.Txid)]; ok && vin.Vout < len(parent.Vout) {
+					continue
+				}
+				
+				delete(ws.Pending, txID)
+				removed = true
+				break
+			}
+		}
+		
+		if !removed {
+			return
+		}
+	}
+}
+
 func (ws *Wallets) LoadFromFile(nodeid string) error {
-	wallet_file := fmt.Sprintf(wallet_file, nodeid)
+	wallet_file := fmt.Sprintf(activeNet.WalletFile, nodeid)
 	if _, err := os.Stat(wallet_file); os.IsNotExist(err) {
 		return err
 	}
@@ -129,29 +357,41 @@ func (ws *Wallets) LoadFromFile(nodeid string) error {
 	}
 	
 	var wallets Wallets
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
-		log.Panic(err)
+		wallets = Wallets{}
+		wallets.Wallets, err = decodeLegacyWallets(fileContent)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	
+	if wallets.Network != "" && wallets.Network != activeNet.Name {
+		return fmt.Errorf("the wallet belongs to the %s network, not %s", wallets.Network, activeNet.Name)
 	}
 	
 	ws.Wallets = wallets.Wallets
+	if wallets.Pending != nil {
+		ws.Pending = wallets.Pending
+	}
+	if wallets.Scripts != nil {
+		ws.Scripts = wallets.Scripts
+	}
 	
 	return nil
 }
 
-func (ws Wallets) SaveToFile() {
+func (ws Wallets) SaveToFile(nodeid string) {
 	var content bytes.Buffer
 	
-	gob.Register(elliptic.P256())
-	
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
 		log.Panic(err)
 	}
 	
+	wallet_file := fmt.Sprintf(activeNet.WalletFile, nodeid)
 	err = ioutil.WriteFile(wallet_file, content.Bytes(), 0644)
 	if err != nil {
 		log.Panic(err)
@@ -160,8 +400,14 @@ func (ws Wallets) SaveToFile() {
 
 func ValidateAddress(address string) bool {
 	pubKeyHash := utils.Base58Decode([]byte(address))
+	if len(pubKeyHash) <= addressChecksumLen {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
+	if version != activeNet.AddressVersion && version != activeNet.ScriptHashVersion {
+		return false
+	}
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
 	
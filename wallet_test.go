@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"testing"
+)
+
+func TestSpendingUnconfirmedChange(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	other := NewWallet()
+	utxo := &UTXOSet{bc}
+	
+	first := NewUTXOTransaction(wallet, address(other), 3, utxo, nil)
+	pending := poolOf(first)
+	
+	acc, outs := utxo.FindSpendableOutputs(HashPubKey(wallet.PublicKey), activeNet.Subsidy, pending)
+	if acc != activeNet.Subsidy-3 || len(outs) != 1 || len(outs[hex.EncodeToString(first.ID)]) != 1 {
+		t.Fatalf("spendable %d in %v, want only the change of the pending transaction", acc, outs)
+	}
+	
+	second := NewUTXOTransaction(wallet, address(other), 2, utxo, pending)
+	if len(second.Vin) != 1 || !bytes.Equal(second.Vin[0].Txid, first.ID) || second.Vin[0].Vout != 1 {
+		t.Fatalf("inputs %v, want the change of the pending transaction", second.Vin)
+	}
+	if !second.Verify(pending) {
+		t.Error("spend of unconfirmed change has a bad signature")
+	}
+}
+
+func TestSyncPendingDropsMinedAndConflicted(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	utxo := &UTXOSet{bc}
+	ws := &Wallets{Wallets: map[string]*Wallet{address(wallet): wallet}, Pending: make(map[string]Transaction)}
+	
+	first := NewUTXOTransaction(wallet, address(NewWallet()), 3, utxo, ws.Pending)
+	ws.AddPending(first)
+	second := NewUTXOTransaction(wallet, address(NewWallet()), 2, utxo, ws.Pending)
+	ws.AddPending(second)
+	
+	ws.SyncPending(utxo)
+	if len(ws.Pending) != 2 {
+		t.Fatalf("%d pending, want both kept before anything is mined", len(ws.Pending))
+	}
+	
+	addTestBlock(bc, NewCoinbaseTx(address(wallet), "first"), first)
+	ws.SyncPending(utxo)
+	if _, ok := ws.Pending[hex.EncodeToString(first.ID)]; ok {
+		t.Error("mined transaction is still pending")
+	}
+	if _, ok := ws.Pending[hex.EncodeToString(second.ID)]; !ok {
+		t.Error("spend of mined change was dropped")
+	}
+	
+	conflict := newTestTx(wallet, first, []int{1}, activeNet.Subsidy-3)
+	addTestBlock(bc, NewCoinbaseTx(address(wallet), "conflict"), conflict)
+	ws.SyncPending(utxo)
+	if len(ws.Pending) != 0 {
+		t.Errorf("%d pending, want the conflicted spend dropped", len(ws.Pending))
+	}
+}
+
+func TestWalletEncoding(t *testing.T) {
+	// one key in 256 has a private key shorter than 32 bytes
+	var short *Wallet
+	for short == nil {
+		if wallet := NewWallet(); len(wallet.PrivateKey.D.Bytes()) < 32 {
+			short = wallet
+		}
+	}
+	
+	for _, wallet := range []*Wallet{NewWallet(), short} {
+		var decoded Wallet
+		if err := gob.NewDecoder(bytes.NewReader(gobEncode(wallet))).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.PrivateKey.Equal(&wallet.PrivateKey) || bytes.Compare(decoded.PublicKey, wallet.PublicKey) != 0 {
+			t.Errorf("the wallet of %s changed going through gob", address(wallet))
+		}
+	}
+}
+
+func TestWalletDecodingChecksPublicKey(t *testing.T) {
+	wallet := NewWallet()
+	wallet.PublicKey = NewWallet().PublicKey
+	
+	var decoded Wallet
+	if err := gob.NewDecoder(bytes.NewReader(gobEncode(wallet))).Decode(&decoded); err == nil {
+		t.Error("decoded a wallet whose public key belongs to another private key")
+	}
+}
+
+func TestPublicKeysHaveFixedWidth(t *testing.T) {
+	// one key in 128 has a coordinate shorter than 32 bytes
+	var short *Wallet
+	for short == nil {
+		wallet := NewWallet()
+		if len(wallet.PrivateKey.X.Bytes()) < 32 || len(wallet.PrivateKey.Y.Bytes()) < 32 {
+			short = wallet
+		}
+	}
+	if len(short.PublicKey) != 64 {
+		t.Fatalf("public key of %d bytes, want 64", len(short.PublicKey))
+	}
+	hash := sha256.Sum256([]byte("message"))
+	if !verifySignature(short.PublicKey, hash[:], signHash(short.PrivateKey, hash[:])) {
+		t.Error("the signature of a key with a short coordinate didn't verify")
+	}
+	
+	// wallets saved with the leading zeros dropped keep their key and address
+	legacy := *short
+	legacy.PublicKey = append(short.PrivateKey.X.Bytes(), short.PrivateKey.Y.Bytes()...)
+	var decoded Wallet
+	if err := gob.NewDecoder(bytes.NewReader(gobEncode(&legacy))).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(decoded.PublicKey, legacy.PublicKey) != 0 {
+		t.Error("the public key of an older wallet changed")
+	}
+}
+
+func TestLoadLegacyWalletFile(t *testing.T) {
+	newTestChain(t)
+	wallet := NewWallet()
+	
+	// the layout gob gave wallets when ecdsa.PrivateKey went in field by field
+	type legacyKey struct {
+		PublicKey struct {
+			Curve interface{}
+			X, Y  *big.Int
+		}
+		D *big.Int
+	}
+	type legacyWallet struct {
+		PrivateKey legacyKey
+		PublicKey  []byte
+	}
+	var key legacyKey
+	key.PublicKey.Curve = legacyCurve{elliptic.P256().Params()}
+	key.PublicKey.X, key.PublicKey.Y = wallet.PrivateKey.X, wallet.PrivateKey.Y
+	key.D = wallet.PrivateKey.D
+	file := struct{ Wallets map[string]*legacyWallet }{map[string]*legacyWallet{address(wallet): {key, wallet.PublicKey}}}
+	
+	if err := ioutil.WriteFile(fmt.Sprintf(activeNet.WalletFile, "legacy"), gobEncode(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wallets, err := NewWallets("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	loaded := wallets.GetWallet(address(wallet))
+	if loaded.PrivateKey.D == nil || loaded.PrivateKey.D.Cmp(wallet.PrivateKey.D) != 0 || !bytes.Equal(loaded.PublicKey, wallet.PublicKey) {
+		t.Fatalf("the legacy wallet of %s didn't load", address(wallet))
+	}
+	hash := sha256.Sum256([]byte("message"))
+	if !verifySignature(loaded.PublicKey, hash[:], signHash(loaded.PrivateKey, hash[:])) {
+		t.Error("the loaded key doesn't sign for its public key")
+	}
+}